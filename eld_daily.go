@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// A driver's distance for a day of ELD navigation records, kept at
+// /account/{id}/driver/{userId}/daily/{YYYY-MM-DD} with days in ELD_DAILY_TIMEZONE.
+// Totals are always summed from records, so an edited record replaces what it counted before.
+// What each record counted is kept in the day's records subcollection, a busy day's worth
+// of records would push the day document toward Firestore's 1 MiB limit.
+type FirestoreDriverDailyV1 struct {
+	Date                     string                   `firestore:"date"`
+	UserId                   float64                  `firestore:"userId,omitempty"`
+	TotalMeters              float64                  `firestore:"totalMeters"`
+	DrivingMeters            float64                  `firestore:"drivingMeters"` // normal driving, not personal conveyance or yard moves
+	PersonalConveyanceMeters float64                  `firestore:"personalConveyanceMeters"`
+	YardMovesMeters          float64                  `firestore:"yardMovesMeters"`
+	Vehicles                 []float64                `firestore:"vehicles"`         // transponderIds driven
+	NavigationEvents         map[string]int           `firestore:"navigationEvents"` // navigationEvent:records
+	RecordCount              int                      `firestore:"recordCount"`
+	Records                  map[string]DailyRecordV1 `firestore:"-"` // recordId:what it counted
+	SchemaVersion            int                      `firestore:"schemaVersion"`
+	FirestoreUpdate          time.Time                `firestore:"fsUpdateTimestamp,serverTimestamp"`
+}
+
+// what a single navigation record counts toward its day, kept at .../daily/{YYYY-MM-DD}/records/{recordId}.
+// A record that is no longer ACTIVE, or was edited into another day, stays with counted false.
+type DailyRecordV1 struct {
+	RecordId        string  `firestore:"recordId"`
+	Date            string  `firestore:"date"`
+	Counted         bool    `firestore:"counted"`
+	Meters          float64 `firestore:"meters"`
+	VehicleMode     string  `firestore:"vehicleMode,omitempty"`
+	NavigationEvent string  `firestore:"navigationEvent,omitempty"`
+	TransponderId   float64 `firestore:"transponderId,omitempty"`
+}
+
+// in-memory copy of every driver day we've updated, plus the day each record was counted in
+// so an edit that moves a record to another day takes it out of the old one
+type DriverDailyTracker struct {
+	mu         sync.Mutex
+	days       map[string]*FirestoreDriverDailyV1 // "cwAccountId/clUserId/date":day
+	recordDays map[string]string                  // "cwAccountId/clUserId/recordId":date
+	lastPrune  time.Time
+}
+
+// days kept in memory, edits to records older than this re-read their day from Firestore
+const driverDailyMemory time.Duration = 8 * 24 * time.Hour
+
+// create a firestore reference location for a driver's day
+func driverDailyReference(c *firestore.Client, cwAccountId string, clUserId string, date string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("driver").Doc(clUserId).Collection("daily").Doc(date)
+}
+
+// create a firestore reference location for what a record counted toward a driver's day
+func driverDailyRecordReference(c *firestore.Client, cwAccountId string, clUserId string, record DailyRecordV1) *firestore.DocumentRef {
+	return driverDailyReference(c, cwAccountId, clUserId, record.Date).Collection("records").Doc(record.RecordId)
+}
+
+// distance bucket of a vehicleMode
+func dailyVehicleMode(mode string) string {
+	switch strings.ToUpper(mode) {
+	case "PERSONAL_CONVEYANCE", "PC":
+		return "PERSONAL_CONVEYANCE"
+	case "YARD_MOVES", "YARD_MOVE", "YM":
+		return "YARD_MOVES"
+	}
+	return ``
+}
+
+// fold a navigation record into its driver's day, returning every day it changed and what the
+// record now counts toward each of them. Records that are no longer ACTIVE are taken back out.
+// Days we haven't seen since boot start from the records read returns for them (read may be nil
+// when there's nothing to read); when a read fails nothing changes and the error is returned.
+func (t *DriverDailyTracker) observe(cwAccountId string, clUserId string, record FirestoreEldReportV1, read func(date string) ([]DailyRecordV1, error)) ([]FirestoreDriverDailyV1, []DailyRecordV1, error) {
+	at := record.EventStartTimestamp
+	if at.IsZero() {
+		at = record.RecordTimestamp
+	}
+	if at.IsZero() {
+		return nil, nil, nil
+	}
+	recordId := record.RecordId
+	if recordId == "" {
+		recordId = at.Format(time.RFC3339Nano)
+	}
+	date := at.In(eldDailyLocation).Format("2006-01-02")
+	driver := cwAccountId + "/" + clUserId
+	active := record.RecordStatus == "" || strings.EqualFold(record.RecordStatus, "ACTIVE")
+
+	t.mu.Lock()
+	if t.days == nil {
+		t.days = make(map[string]*FirestoreDriverDailyV1)
+		t.recordDays = make(map[string]string)
+	}
+	t.prune(now())
+	previous, counted := t.recordDays[driver+"/"+recordId]
+	t.mu.Unlock()
+
+	for _, d := range []string{previous, date} {
+		if d == "" {
+			continue
+		}
+		key := driver + "/" + d
+		var stored []DailyRecordV1
+		err := seedTracker(&t.mu,
+			func() bool { _, known := t.days[key]; return known },
+			func() (err error) {
+				if read != nil {
+					stored, err = read(d)
+				}
+				return err
+			},
+			func() {
+				seed := &FirestoreDriverDailyV1{Records: make(map[string]DailyRecordV1)}
+				for _, r := range stored {
+					if r.Counted {
+						seed.Records[r.RecordId] = r
+					}
+				}
+				t.days[key] = seed
+			})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changed []FirestoreDriverDailyV1
+	var records []DailyRecordV1
+	if counted && previous != date {
+		day := t.days[driver+"/"+previous]
+		delete(day.Records, recordId)
+		changed = append(changed, day.summarize(previous, record.UserId))
+		records = append(records, DailyRecordV1{RecordId: recordId, Date: previous})
+	}
+	day := t.days[driver+"/"+date]
+	contribution := DailyRecordV1{
+		RecordId:        recordId,
+		Date:            date,
+		Counted:         active,
+		Meters:          record.Meters,
+		VehicleMode:     dailyVehicleMode(record.VehicleMode),
+		NavigationEvent: record.NavigationEvent,
+		TransponderId:   record.TransponderId,
+	}
+	if active {
+		day.Records[recordId] = contribution
+		t.recordDays[driver+"/"+recordId] = date
+	} else {
+		delete(day.Records, recordId)
+		delete(t.recordDays, driver+"/"+recordId)
+	}
+	changed = append(changed, day.summarize(date, record.UserId))
+	return changed, append(records, contribution), nil
+}
+
+// forget days older than driverDailyMemory, at most once an hour, t.mu must be held
+func (t *DriverDailyTracker) prune(at time.Time) {
+	if at.Sub(t.lastPrune) < time.Hour {
+		return
+	}
+	t.lastPrune = at
+	cutoff := at.Add(-driverDailyMemory).In(eldDailyLocation).Format("2006-01-02")
+	for key, day := range t.days {
+		if day.Date != "" && day.Date < cutoff {
+			delete(t.days, key)
+		}
+	}
+	for key, date := range t.recordDays {
+		if date < cutoff {
+			delete(t.recordDays, key)
+		}
+	}
+}
+
+// recompute a day's totals from its records
+func (d *FirestoreDriverDailyV1) summarize(date string, userId float64) FirestoreDriverDailyV1 {
+	d.Date = date
+	if userId != 0 {
+		d.UserId = userId
+	}
+	d.TotalMeters, d.DrivingMeters, d.PersonalConveyanceMeters, d.YardMovesMeters = 0, 0, 0, 0
+	d.NavigationEvents = make(map[string]int)
+	vehicles := make(map[float64]bool)
+	for _, r := range d.Records {
+		d.TotalMeters += r.Meters
+		switch r.VehicleMode {
+		case "PERSONAL_CONVEYANCE":
+			d.PersonalConveyanceMeters += r.Meters
+		case "YARD_MOVES":
+			d.YardMovesMeters += r.Meters
+		default:
+			d.DrivingMeters += r.Meters
+		}
+		if r.NavigationEvent != "" {
+			d.NavigationEvents[r.NavigationEvent]++
+		}
+		if r.TransponderId != 0 {
+			vehicles[r.TransponderId] = true
+		}
+	}
+	d.Vehicles = make([]float64, 0, len(vehicles))
+	for v := range vehicles {
+		d.Vehicles = append(d.Vehicles, v)
+	}
+	sort.Float64s(d.Vehicles)
+	d.RecordCount = len(d.Records)
+	d.SchemaVersion = schemaVersionV1
+	summary := *d
+	summary.Records = nil                 // written on their own, and still ours to update
+	summary.FirestoreUpdate = time.Time{} // let Firestore stamp every update
+	return summary
+}
+
+// update and write a driver's daily rollups from a navigation record. A day that can't be read
+// back from Firestore isn't updated at all, rather than rewritten from only the records seen since boot.
+func writeDriverDaily(ctx context.Context, c *firestore.Client, r *EldReportDataStreamV1, record FirestoreEldReportV1) {
+	read := func(date string) ([]DailyRecordV1, error) {
+		var docs []*firestore.DocumentSnapshot
+		err := withFirestoreRetry(ctx, func(attemptCtx context.Context) (err error) {
+			docs, err = driverDailyReference(c, r.cwAccountId, r.clUserId, date).Collection("records").Documents(attemptCtx).GetAll()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		records := make([]DailyRecordV1, 0, len(docs))
+		for _, doc := range docs {
+			dr := DailyRecordV1{}
+			if err := doc.DataTo(&dr); err != nil {
+				return nil, fmt.Errorf("unable to decode %s: %v", doc.Ref.Path, err)
+			}
+			records = append(records, dr)
+		}
+		return records, nil
+	}
+	days, records, err := driverDailies.observe(r.cwAccountId, r.clUserId, record, read)
+	if err != nil {
+		log.Warnf("DriverDailyTracker: unable to read a day of driver %s/%s, skipping record %s: %v", r.cwAccountId, r.clUserId, record.RecordId, err)
+		return
+	}
+	for _, dr := range records {
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: driverDailyRecordReference(c, r.cwAccountId, r.clUserId, dr), data: dr})
+	}
+	for _, day := range days {
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: driverDailyReference(c, r.cwAccountId, r.clUserId, day.Date), data: day})
+	}
+}
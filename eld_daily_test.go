@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a navigation record of driver 3344 covering some distance
+func testDailyNavigation(id string, at time.Time, meters float64, mode string, transponderId float64) FirestoreEldReportV1 {
+	r := testEldNavigation(id, at)
+	r.Meters, r.VehicleMode, r.NavigationEvent = meters, mode, "MOVING"
+	r.TransponderId = transponderId
+	r.UserId = 3344
+	return r
+}
+
+// daily totals add up by vehicleMode and follow edits, including edits into another day
+func TestDriverDailyRollup(t *testing.T) {
+	eldDailyLocation = time.UTC
+	var tracker DriverDailyTracker
+	day := time.Date(2021, 2, 17, 12, 0, 0, 0, time.UTC)
+	read := func(date string) ([]DailyRecordV1, error) {
+		if date == "2021-02-17" {
+			return []DailyRecordV1{
+				{RecordId: "old", Date: date, Counted: true, Meters: 500, TransponderId: 519372},
+				{RecordId: "moved", Date: date, Counted: false, Meters: 700, TransponderId: 519372},
+			}, nil
+		}
+		return nil, nil
+	}
+
+	tracker.observe("1001", "3344", testDailyNavigation("a", day, 1000, "", 519372), read)
+	tracker.observe("1001", "3344", testDailyNavigation("b", day.Add(time.Hour), 200, "YARD_MOVES", 519372), read)
+	days, _, _ := tracker.observe("1001", "3344", testDailyNavigation("c", day.Add(2*time.Hour), 300, "PC", 600001), read)
+	if len(days) != 1 {
+		t.Fatalf("observe() changed %d days, want: 1", len(days))
+	}
+	d := days[0]
+	if d.Date != "2021-02-17" || d.TotalMeters != 2000 || d.DrivingMeters != 1500 || d.YardMovesMeters != 200 || d.PersonalConveyanceMeters != 300 {
+		t.Errorf("day = %+v", d)
+	}
+	if len(d.Vehicles) != 2 || d.Vehicles[0] != 519372 || d.Vehicles[1] != 600001 || d.RecordCount != 4 || d.NavigationEvents["MOVING"] != 3 {
+		t.Errorf("day vehicles, records, events = %v, %d, %v", d.Vehicles, d.RecordCount, d.NavigationEvents)
+	}
+
+	// an edit replaces what the record counted
+	days, _, _ = tracker.observe("1001", "3344", testDailyNavigation("a", day, 400, "", 519372), read)
+	if days[0].TotalMeters != 1400 || days[0].DrivingMeters != 900 {
+		t.Errorf("after an edit: total %v, driving %v, want: 1400, 900", days[0].TotalMeters, days[0].DrivingMeters)
+	}
+	// an edit into the next day moves it
+	days, records, _ := tracker.observe("1001", "3344", testDailyNavigation("c", day.Add(13*time.Hour), 300, "PC", 600001), read)
+	if len(records) != 2 || records[0].Date != "2021-02-17" || records[0].Counted || records[1].Date != "2021-02-18" || !records[1].Counted {
+		t.Errorf("edit into the next day, records = %+v, want: uncounted in the old day, counted in the new", records)
+	}
+	if len(days) != 2 || days[0].Date != "2021-02-17" || days[0].PersonalConveyanceMeters != 0 || len(days[0].Vehicles) != 1 {
+		t.Errorf("edit into the next day, old day = %+v", days)
+	}
+	if days[1].Date != "2021-02-18" || days[1].PersonalConveyanceMeters != 300 {
+		t.Errorf("edit into the next day, new day = %+v", days[1])
+	}
+	// an inactivated record stops counting
+	inactive := testDailyNavigation("b", day.Add(time.Hour), 200, "YARD_MOVES", 519372)
+	inactive.RecordStatus = "INACTIVE_CHANGED"
+	days, _, _ = tracker.observe("1001", "3344", inactive, read)
+	if days[0].YardMovesMeters != 0 || days[0].TotalMeters != 900 {
+		t.Errorf("after inactivating: yard moves %v, total %v, want: 0, 900", days[0].YardMovesMeters, days[0].TotalMeters)
+	}
+}
+
+// a day that can't be read back isn't started over from what we've seen since boot
+func TestDriverDailyReadError(t *testing.T) {
+	eldDailyLocation = time.UTC
+	var tracker DriverDailyTracker
+	day := time.Date(2021, 2, 17, 12, 0, 0, 0, time.UTC)
+	failing := func(date string) ([]DailyRecordV1, error) {
+		return nil, errors.New("unavailable")
+	}
+	days, records, err := tracker.observe("1001", "3344", testDailyNavigation("a", day, 1000, "", 519372), failing)
+	if err == nil || len(days) != 0 || len(records) != 0 {
+		t.Fatalf("observe() with a failed read = %d days, %d records, %v, want an error and no changes", len(days), len(records), err)
+	}
+	days, _, err = tracker.observe("1001", "3344", testDailyNavigation("b", day, 200, "", 519372), nil)
+	if err != nil || len(days) != 1 || days[0].TotalMeters != 200 {
+		t.Errorf("observe() after a failed read = %+v, %v, want the day read afresh", days, err)
+	}
+}
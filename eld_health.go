@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// kinds of ELD compliance problem we track
+const eldHealthMalfunction string = "malfunction"
+const eldHealthDiagnostic string = "diagnostic"
+
+// An ELD malfunction or data diagnostic becoming active or clearing for a driver or vehicle, kept at
+// /account/{id}/driver/{userId}/eld_alert/{alertId} and /account/{id}/vehicle/{webId}/eld_alert/{alertId}
+type FirestoreEldAlertV1 struct {
+	Kind              string    `firestore:"kind"`       // malfunction or diagnostic
+	Transition        string    `firestore:"transition"` // active or cleared
+	Timestamp         time.Time `firestore:"timestamp"`  // event time of the record that flipped the state
+	Code              string    `firestore:"code,omitempty"`
+	Description       string    `firestore:"description,omitempty"`
+	RecordId          string    `firestore:"recordId,omitempty"`
+	RecordType        string    `firestore:"recordType"`
+	UserId            float64   `firestore:"userId,omitempty"`
+	TransponderId     float64   `firestore:"transponderId,omitempty"`
+	SchemaVersion     int       `firestore:"schemaVersion"`
+	FirestoreCreation time.Time `firestore:"fsCreateTimestamp,serverTimestamp"`
+}
+
+// Current ELD compliance health of a driver or vehicle, kept at .../state/eld_health
+// next to the alerts, for fleet managers to listen to
+type FirestoreEldHealthV1 struct {
+	IsMalfunctionActive bool      `firestore:"isMalfunctionActive"`
+	MalfunctionSince    time.Time `firestore:"malfunctionSince,omitempty"`
+	MalfunctionCode     string    `firestore:"malfunctionCode,omitempty"`
+	IsDiagnosticActive  bool      `firestore:"isDiagnosticActive"`
+	DiagnosticSince     time.Time `firestore:"diagnosticSince,omitempty"`
+	DiagnosticCode      string    `firestore:"diagnosticCode,omitempty"`
+	LastChangeRecordId  string    `firestore:"lastChangeRecordId,omitempty"`  // record that last flipped a state
+	LastRecord          time.Time `firestore:"lastRecordTimestamp,omitempty"` // event time of the newest record seen
+	SchemaVersion       int       `firestore:"schemaVersion"`
+	FirestoreUpdate     time.Time `firestore:"fsUpdateTimestamp,serverTimestamp"`
+}
+
+// in-memory compliance health of every driver and vehicle we've seen ELD records for
+type EldHealthTracker struct {
+	mu     sync.Mutex
+	health map[string]*FirestoreEldHealthV1 // "cwAccountId/{driver|vehicle}/id":health
+}
+
+// what an ELD record says about malfunction and diagnostic state, a state the record
+// says nothing about (has... false) is left as it is
+type eldHealthObservation struct {
+	header         EldRecordHeaderV1
+	malfunction    bool
+	hasMalfunction bool
+	diagnostic     bool
+	hasDiagnostic  bool
+	code           string // from malfunction_diagnostic records, for whichever state they flip
+	description    string
+}
+
+// create a firestore reference location for a driver's or vehicle's ELD health, owner is driver or vehicle
+func eldHealthReference(c *firestore.Client, cwAccountId string, owner string, ownerId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection(owner).Doc(ownerId).Collection("state").Doc("eld_health")
+}
+
+// create a firestore reference location for a driver's or vehicle's ELD alerts
+func eldAlertReference(c *firestore.Client, cwAccountId string, owner string, ownerId string) *firestore.CollectionRef {
+	return c.Collection("account").Doc(cwAccountId).Collection(owner).Doc(ownerId).Collection("eld_alert")
+}
+
+// read malfunction and diagnostic state out of any ELD record that carries the active flags,
+// malfunction_diagnostic records also say which one was logged or cleared
+func eldHealthFromRecord(record interface{}) (o eldHealthObservation, ok bool) {
+	o.header, ok = eldRecordHeader(record)
+	if !ok {
+		return o, false
+	}
+	o.malfunction, o.hasMalfunction = o.header.IsMalfunctionActive, o.header.hasMalfunctionActive
+	o.diagnostic, o.hasDiagnostic = o.header.IsDiagnosticActive, o.header.hasDiagnosticActive
+	if r, ok := record.(FirestoreEldMalfunctionDiagnosticV1); ok {
+		o.code = r.Code
+		o.description = r.Description
+		// the event is more specific than the flags sent along with it
+		event := strings.ToUpper(r.MalfunctionEvent)
+		active := strings.HasSuffix(event, "_LOGGED")
+		switch {
+		case strings.HasPrefix(event, "MALFUNCTION"):
+			o.malfunction, o.hasMalfunction = active, true
+		case strings.HasPrefix(event, "DIAGNOSTIC"):
+			o.diagnostic, o.hasDiagnostic = active, true
+		}
+	}
+	return o, true
+}
+
+// fold an observation into a driver's or vehicle's health, returning the alerts for any state
+// it flipped and whether the health changed. Records older than the newest one seen are ignored.
+// The first record for a key since boot starts from the stored health read returns, so states
+// that were already active don't alert again; when read fails nothing is alerted or written.
+func (t *EldHealthTracker) observe(key string, o eldHealthObservation, read func() (FirestoreEldHealthV1, bool, error)) (health FirestoreEldHealthV1, alerts []FirestoreEldAlertV1, changed bool) {
+	at := o.header.EventStartTimestamp
+	if at.IsZero() {
+		at = o.header.RecordTimestamp
+	}
+	if at.IsZero() {
+		return health, nil, false
+	}
+	stored, found := FirestoreEldHealthV1{}, false
+	created := false
+	err := seedTracker(&t.mu,
+		func() bool { _, known := t.health[key]; return known },
+		func() (err error) {
+			if read != nil {
+				stored, found, err = read()
+			}
+			return err
+		},
+		func() {
+			if t.health == nil {
+				t.health = make(map[string]*FirestoreEldHealthV1)
+			}
+			stored.SchemaVersion = schemaVersionV1
+			t.health[key] = &stored
+			created = !found
+		})
+	if err != nil {
+		log.Warnf("EldHealthTracker: unable to read stored health of %s, skipping record %s: %v", key, o.header.RecordId, err)
+		return health, nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.health[key]
+	if at.Before(h.LastRecord) {
+		log.Debugf("EldHealthTracker: ignoring record %s for %s older than its health (%v < %v)", o.header.RecordId, key, at, h.LastRecord)
+		return *h, nil, false
+	}
+
+	alert := func(kind string, active bool) {
+		a := FirestoreEldAlertV1{
+			Kind:          kind,
+			Transition:    "cleared",
+			Timestamp:     at,
+			RecordId:      o.header.RecordId,
+			RecordType:    o.header.Type,
+			UserId:        o.header.UserId,
+			TransponderId: o.header.TransponderId,
+			SchemaVersion: schemaVersionV1,
+		}
+		if active {
+			a.Transition = "active"
+		}
+		if o.header.Type == "malfunction_diagnostic" {
+			a.Code = o.code
+			a.Description = o.description
+		}
+		alerts = append(alerts, a)
+	}
+	if o.hasMalfunction && o.malfunction != h.IsMalfunctionActive {
+		h.IsMalfunctionActive = o.malfunction
+		h.MalfunctionSince, h.MalfunctionCode = time.Time{}, ``
+		if o.malfunction {
+			h.MalfunctionSince, h.MalfunctionCode = at, o.code
+		}
+		alert(eldHealthMalfunction, o.malfunction)
+	}
+	if o.hasDiagnostic && o.diagnostic != h.IsDiagnosticActive {
+		h.IsDiagnosticActive = o.diagnostic
+		h.DiagnosticSince, h.DiagnosticCode = time.Time{}, ``
+		if o.diagnostic {
+			h.DiagnosticSince, h.DiagnosticCode = at, o.code
+		}
+		alert(eldHealthDiagnostic, o.diagnostic)
+	}
+	if len(alerts) > 0 {
+		h.LastChangeRecordId = o.header.RecordId
+	}
+	h.LastRecord = at
+	changed = len(alerts) > 0 || created
+	return *h, alerts, changed
+}
+
+// alerts are keyed by what flipped and the record that flipped it, so replays don't repeat them
+func eldAlertId(a FirestoreEldAlertV1) string {
+	identity := fmt.Sprintf("%s|%s|%s|%d", a.Kind, a.Transition, a.RecordId, a.Timestamp.UnixNano())
+	return fmt.Sprintf("%x", sha1.Sum([]byte(identity)))
+}
+
+// track malfunction and diagnostic state for the driver and vehicle of an ELD record,
+// writing alerts when it flips and the health document when it changes
+func writeEldHealth(ctx context.Context, c *firestore.Client, r *EldReportDataStreamV1, record interface{}) {
+	o, ok := eldHealthFromRecord(record)
+	if !ok {
+		return
+	}
+	var owners [][2]string
+	if !r.unidentified() {
+		owners = append(owners, [2]string{"driver", r.clUserId})
+	}
+	if o.header.TransponderId != 0 {
+		navajoReferenceIds.mutex.Lock()
+		cwDeviceWebId, known := navajoReferenceIds.clDeviceIdMap[fmt.Sprintf("%.0f", o.header.TransponderId)]
+		navajoReferenceIds.mutex.Unlock()
+		if known {
+			owners = append(owners, [2]string{"vehicle", cwDeviceWebId})
+		}
+	}
+	for _, owner := range owners {
+		ref := eldHealthReference(c, r.cwAccountId, owner[0], owner[1])
+		read := func() (stored FirestoreEldHealthV1, found bool, err error) {
+			found, err = readSeedDocument(ctx, ref, &stored)
+			return stored, found, err
+		}
+		health, alerts, changed := eldHealthStates.observe(r.cwAccountId+"/"+owner[0]+"/"+owner[1], o, read)
+		for _, a := range alerts {
+			log.Infof("ELD %s %s for %s %s/%s (record %s)", a.Kind, a.Transition, owner[0], r.cwAccountId, owner[1], a.RecordId)
+			queueFirestoreWrite(ctx, FirestoreWriteV1{ref: eldAlertReference(c, r.cwAccountId, owner[0], owner[1]).Doc(eldAlertId(a)), data: a})
+		}
+		if changed {
+			guard := &FirestoreWriteGuardV1{field: "lastRecordTimestamp", at: health.LastRecord}
+			queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: health, guard: guard})
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a navigation record carrying the malfunction and diagnostic flags
+func testEldFlags(id string, at time.Time, malfunction bool, diagnostic bool) FirestoreEldReportV1 {
+	r := testEldNavigation(id, at)
+	r.IsMalfunctionActive, r.hasMalfunctionActive = malfunction, true
+	r.IsDiagnosticActive, r.hasDiagnosticActive = diagnostic, true
+	return r
+}
+
+// alerts are written only when a state flips, and carry the record that flipped it
+func TestEldHealthTransitions(t *testing.T) {
+	var tracker EldHealthTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	observe := func(record interface{}) (FirestoreEldHealthV1, []FirestoreEldAlertV1, bool) {
+		o, ok := eldHealthFromRecord(record)
+		if !ok {
+			t.Fatalf("eldHealthFromRecord(%T) = false", record)
+		}
+		return tracker.observe("1001/driver/3344", o, nil)
+	}
+
+	health, alerts, changed := observe(testEldFlags("a", start, false, false))
+	if len(alerts) != 0 || !changed || health.IsMalfunctionActive {
+		t.Errorf("first healthy record: alerts %v, changed %t, want: none, true", alerts, changed)
+	}
+	if _, alerts, changed = observe(testEldFlags("b", start.Add(time.Minute), false, false)); len(alerts) != 0 || changed {
+		t.Errorf("unchanged record: alerts %v, changed %t, want: none, false", alerts, changed)
+	}
+
+	logged := FirestoreEldMalfunctionDiagnosticV1{MalfunctionEvent: "MALFUNCTION_LOGGED", Code: "P", Description: "power compliance"}
+	logged.RecordId = "c"
+	logged.RecordTimestamp = start.Add(2 * time.Minute)
+	logged.Type = "malfunction_diagnostic"
+	health, alerts, _ = observe(logged)
+	if len(alerts) != 1 || alerts[0].Kind != eldHealthMalfunction || alerts[0].Transition != "active" || alerts[0].Code != "P" || alerts[0].RecordId != "c" {
+		t.Fatalf("malfunction logged: alerts %+v", alerts)
+	}
+	if !health.IsMalfunctionActive || health.MalfunctionCode != "P" || !health.MalfunctionSince.Equal(logged.RecordTimestamp) {
+		t.Errorf("malfunction logged: health %+v", health)
+	}
+
+	// an older record arriving late doesn't clear anything
+	if _, alerts, _ = observe(testEldFlags("late", start.Add(time.Minute), false, false)); len(alerts) != 0 {
+		t.Errorf("late record: alerts %+v, want: none", alerts)
+	}
+
+	health, alerts, _ = observe(testEldFlags("d", start.Add(3*time.Minute), false, true))
+	if len(alerts) != 2 {
+		t.Fatalf("malfunction cleared and diagnostic active: alerts %+v, want 2", alerts)
+	}
+	if alerts[0].Kind != eldHealthMalfunction || alerts[0].Transition != "cleared" || alerts[1].Kind != eldHealthDiagnostic || alerts[1].Transition != "active" {
+		t.Errorf("alerts = %+v", alerts)
+	}
+	if health.IsMalfunctionActive || !health.MalfunctionSince.IsZero() || !health.IsDiagnosticActive || health.LastChangeRecordId != "d" {
+		t.Errorf("health = %+v", health)
+	}
+	if eldAlertId(alerts[0]) == eldAlertId(alerts[1]) {
+		t.Errorf("eldAlertId() is the same for different alerts")
+	}
+}
+
+// after a restart health picks up from the stored state instead of alerting again
+func TestEldHealthSeed(t *testing.T) {
+	var tracker EldHealthTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	observe := func(record interface{}, read func() (FirestoreEldHealthV1, bool, error)) (FirestoreEldHealthV1, []FirestoreEldAlertV1, bool) {
+		o, _ := eldHealthFromRecord(record)
+		return tracker.observe("1001/vehicle/77", o, read)
+	}
+	failing := func() (FirestoreEldHealthV1, bool, error) {
+		return FirestoreEldHealthV1{}, false, errors.New("unavailable")
+	}
+	if _, alerts, changed := observe(testEldFlags("a", start, true, false), failing); len(alerts) != 0 || changed {
+		t.Fatalf("failed read: alerts %v, changed %t, want: none, false", alerts, changed)
+	}
+
+	stored := func() (FirestoreEldHealthV1, bool, error) {
+		return FirestoreEldHealthV1{IsMalfunctionActive: true, MalfunctionSince: start, MalfunctionCode: "P", LastRecord: start}, true, nil
+	}
+	health, alerts, changed := observe(testEldFlags("b", start.Add(time.Minute), true, false), stored)
+	if len(alerts) != 0 || changed || health.MalfunctionCode != "P" || !health.LastRecord.Equal(start.Add(time.Minute)) {
+		t.Errorf("still active after a restart: alerts %v, changed %t, health %+v", alerts, changed, health)
+	}
+	if _, alerts, _ = observe(testEldFlags("c", start.Add(2*time.Minute), false, false), failing); len(alerts) != 1 || alerts[0].Transition != "cleared" {
+		t.Errorf("cleared after a restart: alerts %+v, want: one cleared", alerts)
+	}
+}
+
+// records that don't carry the active flags leave an active state alone
+func TestEldHealthFlaglessRecord(t *testing.T) {
+	var tracker EldHealthTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	observe := func(record interface{}) (FirestoreEldHealthV1, []FirestoreEldAlertV1, bool) {
+		o, _ := eldHealthFromRecord(record)
+		return tracker.observe("1001/driver/3344", o, nil)
+	}
+	if _, alerts, _ := observe(testEldFlags("a", start, true, false)); len(alerts) != 1 {
+		t.Fatalf("malfunction active: alerts %+v, want one", alerts)
+	}
+	health, alerts, changed := observe(testDutyStatus("b", start.Add(time.Minute), "ON_DUTY"))
+	if len(alerts) != 0 || changed || !health.IsMalfunctionActive {
+		t.Errorf("record without flags: alerts %+v, changed %t, health %+v, want the malfunction still active", alerts, changed, health)
+	}
+}
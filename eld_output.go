@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ELD output files (49 CFR 395 Appendix A, section 4.8.2) built from a driver's stored ELD records,
+// for `firestream eld-output`. Every data line ends in a line data check value, event lines also
+// carry an event data check value, and the file ends with a file data check value (section 4.4.5).
+
+// every line ends in a carriage return, followed by a line feed so the file reads as text
+const eldOutputLineEnd string = "\r\n"
+
+// Header values we don't keep in Firestore, supplied by whoever asks for the file
+type EldOutputHeaderV1 struct {
+	DriverLastName  string
+	DriverFirstName string
+	LicenseState    string
+	LicenseNumber   string
+	CarrierName     string
+	RegistrationId  string // ELD registration id from FMCSA
+	EldIdentifier   string // ELD model identifier from FMCSA
+	Comment         string // output file comment, ex the auditor's routing code
+	Location        *time.Location
+	Generated       time.Time // {current} date and time
+}
+
+// an ELD record placed in the output file
+type eldOutputEvent struct {
+	sequence int
+	at       time.Time
+	header   EldRecordHeaderV1
+	record   interface{}
+}
+
+// map a character to its check value (section 4.4.5.1): digits and letters count as their
+// ASCII value minus 48, everything else counts as zero
+func eldCharValue(r rune) int {
+	if (r >= '1' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') {
+		return int(r) - 48
+	}
+	return 0
+}
+
+func eldCharSum(fields ...string) int {
+	sum := 0
+	for _, f := range fields {
+		for _, r := range f {
+			sum += eldCharValue(r)
+		}
+	}
+	return sum
+}
+
+// lower 8 bits of the sum, three circular left shifts, xor with a constant
+func eldCheckByte(sum int, xor uint8) uint8 {
+	b := uint8(sum)
+	b = b<<3 | b>>5
+	return b ^ xor
+}
+
+// event data check value (section 4.4.5.1) over an event's type, code, date, time, miles, hours,
+// latitude, longitude, CMV order number and ELD username
+func eldEventCheckValue(fields ...string) string {
+	return fmt.Sprintf("%02X", eldCheckByte(eldCharSum(fields...), 0xC3))
+}
+
+// line data check value (section 4.4.5.2) over every character of a line before it
+func eldLineCheckValue(line string) uint8 {
+	return eldCheckByte(eldCharSum(line), 0x96)
+}
+
+// file data check value (section 4.4.5.3) over every line data check value in the file:
+// lower 16 bits of their sum, three circular left shifts, xor with 0x969C
+func eldFileCheckValue(lineValues []uint8) string {
+	sum := 0
+	for _, v := range lineValues {
+		sum += int(v)
+	}
+	w := uint16(sum)
+	w = w<<3 | w>>13
+	return fmt.Sprintf("%04X", w^0x969C)
+}
+
+// an ELD output file being written line by line, keeping track of line check values
+type eldOutputWriter struct {
+	w          io.Writer
+	lineValues []uint8
+	err        error
+}
+
+func (o *eldOutputWriter) section(title string) {
+	o.write(title + ":")
+}
+
+// a data line, its fields joined by commas and followed by its line data check value
+func (o *eldOutputWriter) line(fields ...string) {
+	line := strings.Join(fields, ",")
+	v := eldLineCheckValue(line)
+	o.lineValues = append(o.lineValues, v)
+	o.write(fmt.Sprintf("%s,%02X", line, v))
+}
+
+func (o *eldOutputWriter) write(s string) {
+	if o.err == nil {
+		_, o.err = io.WriteString(o.w, s+eldOutputLineEnd)
+	}
+}
+
+// ELD record status codes (section 7.23)
+func eldRecordStatusCode(s string) string {
+	switch strings.ToUpper(s) {
+	case "INACTIVE_CHANGED", "2":
+		return "2"
+	case "INACTIVE_CHANGE_REQUESTED", "3":
+		return "3"
+	case "INACTIVE_CHANGE_REJECTED", "4":
+		return "4"
+	}
+	return "1"
+}
+
+// ELD record origin codes (section 7.22)
+func eldRecordOriginCode(s string) string {
+	switch strings.ToUpper(s) {
+	case "DRIVER", "2":
+		return "2"
+	case "OTHER_USER", "CARRIER", "EDIT_REQUEST", "3":
+		return "3"
+	case "UNIDENTIFIED", "UNIDENTIFIED_DRIVER", "4":
+		return "4"
+	}
+	return "1"
+}
+
+// event type and code of an ELD record (section 7.25, table 6), false for records
+// that don't belong in an output file
+func eldEventTypeCode(record interface{}) (eventType string, eventCode string, ok bool) {
+	switch r := record.(type) {
+	case FirestoreEldDutyStatusV1:
+		switch strings.ToUpper(r.DutyStatus) {
+		case "PERSONAL_CONVEYANCE", "PC":
+			return "3", "1", true
+		case "YARD_MOVES", "YARD_MOVE", "YM":
+			return "3", "2", true
+		}
+		status, ok := hosDutyStatus(r.DutyStatus)
+		if !ok {
+			return ``, ``, false
+		}
+		code := map[string]string{hosOffDuty: "1", hosSleeperBerth: "2", hosDriving: "3", hosOnDuty: "4"}[status]
+		return "1", code, true
+	case FirestoreEldIntermediateLogV1:
+		if r.ReducedPrecision {
+			return "2", "2", true
+		}
+		return "2", "1", true
+	case FirestoreEldCertificationV1:
+		count := int(r.CertificationCount)
+		if count < 1 {
+			count = 1
+		} else if count > 9 {
+			count = 9
+		}
+		return "4", strconv.Itoa(count), true
+	case FirestoreEldLoginLogoutV1:
+		if strings.EqualFold(r.LoginEvent, "LOGOUT") {
+			return "5", "2", true
+		}
+		return "5", "1", true
+	case FirestoreEldEnginePowerV1:
+		code := 1
+		if strings.Contains(strings.ToUpper(r.PowerEvent), "SHUT") {
+			code = 3
+		}
+		if r.ReducedPrecision {
+			code++
+		}
+		return "6", strconv.Itoa(code), true
+	case FirestoreEldMalfunctionDiagnosticV1:
+		codes := map[string]string{"MALFUNCTION_LOGGED": "1", "MALFUNCTION_CLEARED": "2", "DIAGNOSTIC_LOGGED": "3", "DIAGNOSTIC_CLEARED": "4"}
+		code, ok := codes[strings.ToUpper(r.MalfunctionEvent)]
+		return "7", code, ok
+	}
+	return ``, ``, false
+}
+
+// latitude or longitude to 2 decimals, 1 with reduced precision. Records without
+// a position show E during a malfunction and M otherwise (section 7.31)
+func eldCoordinate(h EldRecordHeaderV1, latitude bool, reduced bool) string {
+	if h.Location == nil {
+		if h.IsMalfunctionActive {
+			return "E"
+		}
+		return "M"
+	}
+	v := h.Location.Longitude
+	if latitude {
+		v = h.Location.Latitude
+	}
+	if reduced {
+		return strconv.FormatFloat(math.Round(v*10)/10, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', 2, 64)
+}
+
+func eldFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// unidentified driving as it shows in an output file: a change to driving at the first record of a
+// segment, then an intermediate log at the first record of each further hour of driving (section 4.5.1.1)
+func eldUnidentifiedEvents(segment []FirestoreEldReportV1) []eldOutputEvent {
+	var events []eldOutputEvent
+	var next time.Time
+	for i, r := range segment {
+		header := r.EldRecordHeaderV1
+		header.RecordOrigin = "UNIDENTIFIED"
+		at := header.EventStartTimestamp
+		if at.IsZero() {
+			at = header.RecordTimestamp
+		}
+		switch {
+		case i == 0:
+			events = append(events, eldOutputEvent{at: at, header: header, record: FirestoreEldDutyStatusV1{EldRecordHeaderV1: header, DutyStatus: hosDriving}})
+		case !at.Before(next):
+			events = append(events, eldOutputEvent{at: at, header: header, record: FirestoreEldIntermediateLogV1{EldRecordHeaderV1: header}})
+		default:
+			continue
+		}
+		next = at.Add(time.Hour)
+	}
+	return events
+}
+
+// write a driver's ELD records as an ELD output file. Records are placed in event time order,
+// keeping their eventId as sequence id when it's a number the format can hold. Unidentified
+// driving segments (their navigation records in time order) are listed for the CMVs the driver used.
+func writeEldOutputFile(w io.Writer, h EldOutputHeaderV1, username string, records []interface{}, unidentified [][]FirestoreEldReportV1) error {
+	loc := h.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	date := func(t time.Time) string { return t.In(loc).Format("010206") }
+	clock := func(t time.Time) string { return t.In(loc).Format("150405") }
+	miles := func(v float64) string { return strconv.FormatFloat(math.Round(v), 'f', 0, 64) }
+	hours := func(v float64) string { return strconv.FormatFloat(math.Round(v*10)/10, 'f', 1, 64) }
+
+	var events []eldOutputEvent
+	cmvOrder := make(map[float64]int)
+	var cmvs []float64
+	var usDot string
+	for _, record := range records {
+		header, ok := eldRecordHeader(record)
+		if !ok {
+			continue
+		}
+		at := header.EventStartTimestamp
+		if at.IsZero() {
+			at = header.RecordTimestamp
+		}
+		events = append(events, eldOutputEvent{at: at, header: header, record: record})
+		if header.UsDotNumber != "" {
+			usDot = header.UsDotNumber
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+	for i := range events {
+		events[i].sequence = i + 1
+		if seq, err := strconv.ParseUint(events[i].header.EventId, 10, 16); err == nil {
+			events[i].sequence = int(seq)
+		}
+		if t := events[i].header.TransponderId; t != 0 {
+			if _, ok := cmvOrder[t]; !ok {
+				cmvs = append(cmvs, t)
+				cmvOrder[t] = len(cmvs)
+			}
+		}
+	}
+	unit := func(t float64) string {
+		if t == 0 {
+			return ``
+		}
+		return fmt.Sprintf("%.0f", t)
+	}
+	var current EldRecordHeaderV1
+	if len(events) > 0 {
+		current = events[len(events)-1].header
+	}
+	_, offset := h.Generated.In(loc).Zone()
+
+	o := &eldOutputWriter{w: w}
+	o.section("ELD File Header Segment")
+	o.line(h.DriverLastName, h.DriverFirstName, username, h.LicenseState, h.LicenseNumber)
+	o.line(``, ``, ``) // no co-driver
+	o.line(unit(current.TransponderId), ``, ``)
+	o.line(usDot, h.CarrierName, "8", "000000", fmt.Sprintf("%02d", -offset/3600))
+	o.line(``, "0")
+	o.line(date(h.Generated), clock(h.Generated), eldCoordinate(current, true, false), eldCoordinate(current, false, false), miles(current.TotalVehicleMiles), hours(current.TotalEngineHours))
+	o.line(h.RegistrationId, h.EldIdentifier, ``, h.Comment)
+
+	o.section("User List")
+	o.line("1", "D", h.DriverLastName, h.DriverFirstName)
+
+	o.section("CMV List")
+	for i, t := range cmvs {
+		o.line(strconv.Itoa(i+1), unit(t), ``)
+	}
+
+	sequence := func(e eldOutputEvent) string { return fmt.Sprintf("%X", e.sequence) }
+	o.section("ELD Event List")
+	for _, e := range events {
+		eventType, eventCode, ok := eldEventTypeCode(e.record)
+		if !ok || (eventType != "1" && eventType != "2" && eventType != "3") {
+			continue
+		}
+		reduced := eventType == "2" && eventCode == "2"
+		cmv := strconv.Itoa(cmvOrder[e.header.TransponderId])
+		originator := "1"
+		if eldRecordOriginCode(e.header.RecordOrigin) == "4" {
+			originator = "0"
+		}
+		lat, lng := eldCoordinate(e.header, true, reduced), eldCoordinate(e.header, false, reduced)
+		accumulated, elapsed := miles(e.header.AccumulatedVehicleMiles), hours(e.header.ElapsedEngineHours)
+		check := eldEventCheckValue(eventType, eventCode, date(e.at), clock(e.at), accumulated, elapsed, lat, lng, cmv, username)
+		o.line(sequence(e), eldRecordStatusCode(e.header.RecordStatus), eldRecordOriginCode(e.header.RecordOrigin), eventType, eventCode,
+			date(e.at), clock(e.at), accumulated, elapsed, lat, lng, "0", cmv, originator,
+			eldFlag(e.header.IsMalfunctionActive), eldFlag(e.header.IsDiagnosticActive), check)
+	}
+
+	o.section("ELD Event Annotations or Comments")
+	for _, e := range events {
+		if r, ok := e.record.(FirestoreEldDutyStatusV1); ok && r.Comment != "" {
+			// commas would split the comment into fields
+			o.line(sequence(e), username, strings.ReplaceAll(r.Comment, ",", " "), date(e.at), clock(e.at), strings.ReplaceAll(e.header.GeoDescription, ",", " "))
+		}
+	}
+
+	o.section("Driver's Certification/Recertification Actions")
+	for _, e := range events {
+		r, ok := e.record.(FirestoreEldCertificationV1)
+		if !ok {
+			continue
+		}
+		_, eventCode, _ := eldEventTypeCode(r)
+		certified := r.CertifiedDate
+		if d, err := time.Parse("2006-01-02", r.CertifiedDate); err == nil {
+			certified = d.Format("010206")
+		}
+		o.line(sequence(e), eventCode, date(e.at), clock(e.at), certified, strconv.Itoa(cmvOrder[e.header.TransponderId]))
+	}
+
+	o.section("Malfunctions and Data Diagnostic Events")
+	for _, e := range events {
+		r, ok := e.record.(FirestoreEldMalfunctionDiagnosticV1)
+		if !ok {
+			continue
+		}
+		eventType, eventCode, ok := eldEventTypeCode(r)
+		if !ok {
+			continue
+		}
+		cmv := strconv.Itoa(cmvOrder[e.header.TransponderId])
+		total, engine := miles(e.header.TotalVehicleMiles), hours(e.header.TotalEngineHours)
+		check := eldEventCheckValue(eventType, eventCode, date(e.at), clock(e.at), total, engine, cmv, username)
+		o.line(sequence(e), eventCode, r.Code, date(e.at), clock(e.at), total, engine, cmv, username, check)
+	}
+
+	o.section("ELD Login/Logout Report")
+	for _, e := range events {
+		if _, ok := e.record.(FirestoreEldLoginLogoutV1); !ok {
+			continue
+		}
+		_, eventCode, _ := eldEventTypeCode(e.record)
+		o.line(sequence(e), eventCode, username, date(e.at), clock(e.at), miles(e.header.TotalVehicleMiles), hours(e.header.TotalEngineHours))
+	}
+
+	o.section("CMV Engine Power-Up and Shut Down Activity")
+	for _, e := range events {
+		r, ok := e.record.(FirestoreEldEnginePowerV1)
+		if !ok {
+			continue
+		}
+		eventType, eventCode, _ := eldEventTypeCode(r)
+		lat, lng := eldCoordinate(e.header, true, r.ReducedPrecision), eldCoordinate(e.header, false, r.ReducedPrecision)
+		total, engine := miles(e.header.TotalVehicleMiles), hours(e.header.TotalEngineHours)
+		check := eldEventCheckValue(eventType, eventCode, date(e.at), clock(e.at), total, engine, lat, lng, strconv.Itoa(cmvOrder[e.header.TransponderId]), username)
+		o.line(sequence(e), eventCode, date(e.at), clock(e.at), total, engine, lat, lng, unit(e.header.TransponderId), ``, ``, ``, check)
+	}
+
+	// unidentified events have no username, and sequence ids of their own past the driver's
+	o.section("Unidentified Driver Profile Records")
+	var profile []eldOutputEvent
+	for _, segment := range unidentified {
+		for _, e := range eldUnidentifiedEvents(segment) {
+			if _, ok := cmvOrder[e.header.TransponderId]; ok {
+				profile = append(profile, e)
+			}
+		}
+	}
+	sort.SliceStable(profile, func(i, j int) bool { return profile[i].at.Before(profile[j].at) })
+	for i := range profile {
+		profile[i].sequence = len(events) + i + 1
+		if seq, err := strconv.ParseUint(profile[i].header.EventId, 10, 16); err == nil {
+			profile[i].sequence = int(seq)
+		}
+	}
+	for _, e := range profile {
+		eventType, eventCode, _ := eldEventTypeCode(e.record)
+		cmv := strconv.Itoa(cmvOrder[e.header.TransponderId])
+		lat, lng := eldCoordinate(e.header, true, false), eldCoordinate(e.header, false, false)
+		accumulated, elapsed := miles(e.header.AccumulatedVehicleMiles), hours(e.header.ElapsedEngineHours)
+		check := eldEventCheckValue(eventType, eventCode, date(e.at), clock(e.at), accumulated, elapsed, lat, lng, cmv, ``)
+		o.line(sequence(e), eldRecordStatusCode(e.header.RecordStatus), eldRecordOriginCode(e.header.RecordOrigin), eventType, eventCode,
+			date(e.at), clock(e.at), accumulated, elapsed, lat, lng, "0", cmv, check)
+	}
+
+	o.section("End of File")
+	o.write(eldFileCheckValue(o.lineValues))
+	return o.err
+}
+
+// read the ELD records of a report_data collection that happened in [from, to), in event time order.
+// Edits are recorded after the event they edit, so records are picked by event time: their
+// eventStartTimestamp, or their recordTimestamp when they don't have one.
+func eldOutputDocuments(ctx context.Context, reportData *firestore.CollectionRef, from time.Time, to time.Time) ([]*firestore.DocumentSnapshot, error) {
+	docs, err := reportData.
+		Where("eventStartTimestamp", ">=", from).
+		Where("eventStartTimestamp", "<", to).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	// a query on a field never returns documents without it
+	byRecordTime, err := reportData.
+		Where("recordTimestamp", ">=", from).
+		Where("recordTimestamp", "<", to).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range byRecordTime {
+		if _, err := doc.DataAt("eventStartTimestamp"); err != nil {
+			docs = append(docs, doc)
+		}
+	}
+	at := func(doc *firestore.DocumentSnapshot) time.Time {
+		for _, field := range []string{"eventStartTimestamp", "recordTimestamp"} {
+			if v, err := doc.DataAt(field); err == nil {
+				if ts, ok := v.(time.Time); ok {
+					return ts
+				}
+			}
+		}
+		return time.Time{}
+	}
+	sort.SliceStable(docs, func(i, j int) bool { return at(docs[i]).Before(at(docs[j])) })
+	return docs, nil
+}
+
+// read a stored ELD record or version back into its typed record, false for navigation
+// records and anything else that isn't part of an output file
+func eldOutputRecord(doc *firestore.DocumentSnapshot) (record interface{}, ok bool, err error) {
+	dataType, _ := doc.DataAt("type")
+	switch dataType {
+	case "duty_status":
+		r := FirestoreEldDutyStatusV1{}
+		err = doc.DataTo(&r)
+		record = r
+	case "intermediate_log":
+		r := FirestoreEldIntermediateLogV1{}
+		err = doc.DataTo(&r)
+		record = r
+	case "login_logout":
+		r := FirestoreEldLoginLogoutV1{}
+		err = doc.DataTo(&r)
+		record = r
+	case "certification":
+		r := FirestoreEldCertificationV1{}
+		err = doc.DataTo(&r)
+		record = r
+	case "engine_power":
+		r := FirestoreEldEnginePowerV1{}
+		err = doc.DataTo(&r)
+		record = r
+	case "malfunction_diagnostic":
+		r := FirestoreEldMalfunctionDiagnosticV1{}
+		err = doc.DataTo(&r)
+		record = r
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read ELD record %s: %v", doc.Ref.Path, err)
+	}
+	return record, true, nil
+}
+
+// the edit history of a record as it belongs in an output file (section 4.8.2.1.4): every version,
+// oldest first, with the ones a later version replaced that still say ACTIVE marked inactive-changed
+func eldRecordHistory(versions []interface{}) []interface{} {
+	history := make([]interface{}, 0, len(versions))
+	for i, version := range versions {
+		if i < len(versions)-1 {
+			if h, ok := eldRecordHeader(version); ok && eldRecordStatusCode(h.RecordStatus) == "1" {
+				version = withEldRecordStatus(version, "INACTIVE_CHANGED")
+			}
+		}
+		history = append(history, version)
+	}
+	return history
+}
+
+// a copy of a typed ELD record with another record status
+func withEldRecordStatus(record interface{}, status string) interface{} {
+	switch r := record.(type) {
+	case FirestoreEldDutyStatusV1:
+		r.RecordStatus = status
+		return r
+	case FirestoreEldIntermediateLogV1:
+		r.RecordStatus = status
+		return r
+	case FirestoreEldLoginLogoutV1:
+		r.RecordStatus = status
+		return r
+	case FirestoreEldCertificationV1:
+		r.RecordStatus = status
+		return r
+	case FirestoreEldEnginePowerV1:
+		r.RecordStatus = status
+		return r
+	case FirestoreEldMalfunctionDiagnosticV1:
+		r.RecordStatus = status
+		return r
+	}
+	return record
+}
+
+// read a driver's stored ELD records in [from, to) back into their typed records, each with its
+// history from eld_versions so edited records show as inactive-changed next to their edits
+func loadEldOutputRecords(ctx context.Context, c *firestore.Client, cwAccountId string, clUserId string, from time.Time, to time.Time) (records []interface{}, username string, err error) {
+	reportData := c.Collection("account").Doc(cwAccountId).Collection("driver").Doc(clUserId).Collection("report_data")
+	docs, err := eldOutputDocuments(ctx, reportData, from, to)
+	if err != nil {
+		return nil, ``, err
+	}
+	for _, doc := range docs {
+		record, ok, err := eldOutputRecord(doc)
+		if err != nil {
+			return nil, ``, err
+		}
+		if !ok {
+			continue
+		}
+		// version ids start with the recordTimestamp, so they read oldest first
+		versionDocs, err := doc.Ref.Collection(eldRecordVersionsCollection).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, ``, fmt.Errorf("unable to read versions of ELD record %s: %v", doc.Ref.Path, err)
+		}
+		var versions []interface{}
+		for _, v := range versionDocs {
+			version, ok, err := eldOutputRecord(v)
+			if err != nil {
+				return nil, ``, err
+			}
+			if ok {
+				versions = append(versions, version)
+			}
+		}
+		// records stored before versions were kept have only themselves
+		if len(versions) == 0 {
+			versions = []interface{}{record}
+		}
+		if h, ok := eldRecordHeader(record); ok && h.Username != "" {
+			username = h.Username
+		}
+		records = append(records, eldRecordHistory(versions)...)
+	}
+	return records, username, nil
+}
+
+// read the unidentified driving in [from, to) of the CMVs a driver's records were made in, one
+// slice of navigation records per segment. Segments are found by transponderId across the account's vehicles.
+func loadEldOutputUnidentified(ctx context.Context, c *firestore.Client, cwAccountId string, records []interface{}, from time.Time, to time.Time) (segments [][]FirestoreEldReportV1, err error) {
+	transponders := make(map[float64]bool)
+	for _, record := range records {
+		if h, ok := eldRecordHeader(record); ok && h.TransponderId != 0 {
+			transponders[h.TransponderId] = true
+		}
+	}
+	for transponderId := range transponders {
+		docs, err := c.CollectionGroup(unidentifiedDrivingCollection).
+			Where("transponderId", "==", transponderId).
+			Where("endTimestamp", ">=", from).
+			Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			// account/{id}/vehicle/{webId}/unidentified_driving/{segmentId}
+			account := doc.Ref.Parent.Parent.Parent.Parent
+			if account == nil || account.ID != cwAccountId {
+				continue
+			}
+			start, _ := doc.DataAt("startTimestamp")
+			if startTs, ok := start.(time.Time); ok && !startTs.Before(to) {
+				continue
+			}
+			navigation, err := eldOutputDocuments(ctx, doc.Ref.Collection("report_data"), from, to)
+			if err != nil {
+				return nil, err
+			}
+			var segment []FirestoreEldReportV1
+			for _, n := range navigation {
+				r := FirestoreEldReportV1{}
+				if err := n.DataTo(&r); err != nil {
+					return nil, fmt.Errorf("unable to read unidentified ELD record %s: %v", n.Ref.Path, err)
+				}
+				segment = append(segment, r)
+			}
+			if len(segment) > 0 {
+				segments = append(segments, segment)
+			}
+		}
+	}
+	return segments, nil
+}
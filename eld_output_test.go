@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// check values worked by hand from section 4.4.5
+func TestEldCheckValues(t *testing.T) {
+	if v := eldCharValue('A'); v != 17 {
+		t.Errorf("eldCharValue(A) = %d, want: 17", v)
+	}
+	if v := eldCharValue('a'); v != 49 {
+		t.Errorf("eldCharValue(a) = %d, want: 49", v)
+	}
+	if v := eldCharValue(','); v != 0 {
+		t.Errorf("eldCharValue(,) = %d, want: 0", v)
+	}
+	// 1 + 20 = 0x15, rotated 0xA8, xor 0x96
+	if v := eldLineCheckValue("1,D"); v != 0x3E {
+		t.Errorf("eldLineCheckValue(1,D) = %02X, want: 3E", v)
+	}
+	// 1 + 3 + 13 + 9 = 0x1A, rotated 0xD0, xor 0xC3
+	if v := eldEventCheckValue("1", "3", "021721", "063000"); v != "13" {
+		t.Errorf("eldEventCheckValue() = %s, want: 13", v)
+	}
+	// 0x003E rotated 0x01F0, xor 0x969C
+	if v := eldFileCheckValue([]uint8{0x3E}); v != "976C" {
+		t.Errorf("eldFileCheckValue() = %s, want: 976C", v)
+	}
+}
+
+// fixture ELD records covering every section of the output file, as loadEldOutputRecords returns them
+func testEldOutputRecords() []interface{} {
+	day := time.Date(2021, 2, 17, 11, 0, 0, 0, time.UTC) // 06:00 in New York
+	header := func(id string, eventId string, offset time.Duration) EldRecordHeaderV1 {
+		return EldRecordHeaderV1{
+			UsDotNumber:             "1234567",
+			UserId:                  3344,
+			Username:                "jdoe",
+			TransponderId:           519372,
+			EventId:                 eventId,
+			RecordId:                id,
+			RecordTimestamp:         day.Add(offset),
+			RecordStatus:            "ACTIVE",
+			RecordOrigin:            "ELD",
+			Location:                &latlng.LatLng{Latitude: 41.4123, Longitude: -70.5789},
+			GeoDescription:          "2mi N Edgartown, MA",
+			AccumulatedVehicleMiles: 12,
+			ElapsedEngineHours:      0.5,
+			TotalVehicleMiles:       120345.4,
+			TotalEngineHours:        4321.46,
+		}
+	}
+
+	login := FirestoreEldLoginLogoutV1{EldRecordHeaderV1: header("r1", "1", 0), LoginEvent: "LOGIN"}
+	power := FirestoreEldEnginePowerV1{EldRecordHeaderV1: header("r2", "2", time.Minute), PowerEvent: "POWER_UP"}
+	onDuty := FirestoreEldDutyStatusV1{EldRecordHeaderV1: header("r3", "3", 2*time.Minute), DutyStatus: "ON_DUTY", Comment: "pre-trip, inspection"}
+	driving := FirestoreEldDutyStatusV1{EldRecordHeaderV1: header("r4", "4", 30*time.Minute), DutyStatus: "DRIVING"}
+	intermediate := FirestoreEldIntermediateLogV1{EldRecordHeaderV1: header("r5", "5", 90*time.Minute)}
+	malfunction := FirestoreEldMalfunctionDiagnosticV1{EldRecordHeaderV1: header("r6", "6", 100*time.Minute), MalfunctionEvent: "MALFUNCTION_LOGGED", Code: "P"}
+	malfunction.IsMalfunctionActive = true
+	malfunction.Location = nil
+	edited := FirestoreEldDutyStatusV1{EldRecordHeaderV1: header("r7", "7", 3*time.Hour), DutyStatus: "OFF_DUTY"}
+	edited.RecordStatus = "INACTIVE_CHANGED"
+	edited.RecordOrigin = "DRIVER"
+	certification := FirestoreEldCertificationV1{EldRecordHeaderV1: header("r8", "8", 4*time.Hour), CertifiedDate: "2021-02-17", CertificationCount: 1}
+	logout := FirestoreEldLoginLogoutV1{EldRecordHeaderV1: header("r9", "9", 4*time.Hour+time.Minute), LoginEvent: "LOGOUT"}
+	// out of order, like a collection read that isn't sorted by event time
+	return []interface{}{driving, login, power, onDuty, intermediate, malfunction, edited, certification, logout}
+}
+
+// unidentified driving of the driver's vehicle after they logged out, and of a vehicle they never drove
+func testEldOutputUnidentified() [][]FirestoreEldReportV1 {
+	day := time.Date(2021, 2, 17, 11, 0, 0, 0, time.UTC)
+	navigation := func(transponderId float64, offset time.Duration, miles float64) FirestoreEldReportV1 {
+		r := FirestoreEldReportV1{}
+		r.TransponderId = transponderId
+		r.RecordId = fmt.Sprintf("u%d-%d", int(transponderId), int(offset.Minutes()))
+		r.RecordTimestamp = day.Add(offset)
+		r.EventStartTimestamp = day.Add(offset)
+		r.RecordStatus = "ACTIVE"
+		r.RecordOrigin = "ELD"
+		r.Type = "navigation"
+		r.Location = &latlng.LatLng{Latitude: 41.3891, Longitude: -70.5134}
+		r.AccumulatedVehicleMiles = miles
+		r.ElapsedEngineHours = 0.2
+		return r
+	}
+	return [][]FirestoreEldReportV1{
+		{
+			navigation(519372, 5*time.Hour, 3),
+			navigation(519372, 5*time.Hour+30*time.Minute, 18),
+			navigation(519372, 6*time.Hour+5*time.Minute, 36),
+			navigation(519372, 6*time.Hour+40*time.Minute, 51),
+		},
+		{navigation(600001, 5*time.Hour, 7)},
+	}
+}
+
+func TestEldOutputFile(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	h := EldOutputHeaderV1{
+		DriverLastName:  "Doe",
+		DriverFirstName: "Jane",
+		LicenseState:    "MA",
+		LicenseNumber:   "S12345678",
+		CarrierName:     "Island Freight",
+		RegistrationId:  "CL01",
+		EldIdentifier:   "CLELD1",
+		Comment:         "audit",
+		Location:        loc,
+		Generated:       time.Date(2021, 2, 18, 14, 0, 0, 0, time.UTC),
+	}
+	var out bytes.Buffer
+	if err := writeEldOutputFile(&out, h, "jdoe", testEldOutputRecords(), testEldOutputUnidentified()); err != nil {
+		t.Fatalf("writeEldOutputFile() = %v", err)
+	}
+	want, err := ioutil.ReadFile("testdata/eld_output/driver_3344.golden.txt")
+	if err != nil {
+		t.Fatalf("unable to read golden file: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("writeEldOutputFile() =\n%s\nwant:\n%s", out.Bytes(), want)
+	}
+}
+
+// versions a later one replaced show as inactive-changed, the newest keeps its own status
+func TestEldRecordHistory(t *testing.T) {
+	records := testEldOutputRecords()
+	original := records[0].(FirestoreEldDutyStatusV1)
+	rejected := original
+	rejected.RecordStatus = "INACTIVE_CHANGE_REJECTED"
+	edit := original
+	edit.DutyStatus, edit.RecordOrigin = "ON_DUTY", "DRIVER"
+	history := eldRecordHistory([]interface{}{original, rejected, edit})
+	want := []string{"2", "4", "1"}
+	for i, version := range history {
+		h, _ := eldRecordHeader(version)
+		if got := eldRecordStatusCode(h.RecordStatus); got != want[i] {
+			t.Errorf("version %d record status = %s, want: %s", i, got, want[i])
+		}
+	}
+	if only := eldRecordHistory([]interface{}{original}); only[0].(FirestoreEldDutyStatusV1).RecordStatus != "ACTIVE" {
+		t.Errorf("record without history = %+v, want it ACTIVE", only[0])
+	}
+}
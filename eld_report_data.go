@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	gabs "github.com/Jeffail/gabs/v2"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/genproto/googleapis/type/latlng"
 )
@@ -20,22 +23,20 @@ func eldReportWriterV1(ctx context.Context, c *firestore.Client) {
 		case rds := <-eldReportsV1:
 			log.Debugf("eldReportWriterV1() received new report: %s:%s to process into Firestore...\n", rds.reportType, rds.reportDataType)
 
-			// we are writing only navigation records for now, don't want to see warnings
-			// from failed build() method calls on ELD stream records
-			if rds.reportDataType != "navigation" {
+			// skip ELD record types we don't have a Firestore layout for, don't want to see
+			// warnings from failed build() method calls on them
+			if !rds.validDataType() {
+				log.Debugf("eldReportWriterV1() skipping unsupported ELD dataType %s", rds.reportDataType)
 				break // move on
 			}
 
 			// validate and populate our report struct
 			ok := rds.build()
 			if !ok {
-				log.Warnf("Unable to validate and build a TransponderReportDataStreamV1 object sent from upstream channel transponderReportsV1\n")
+				log.Warnf("Unable to validate and build an EldReportDataStreamV1 object sent from upstream channel eldReportsV1\n")
 				break // unable to validate the packet, drop it and move on
 			}
 
-			// build firestore reference
-			ref := rds.firestoreReference(c)
-
 			// marshall our eld data streaming record into a firestore record
 			record, err := rds.firestoreRecord()
 			if err != nil {
@@ -43,18 +44,45 @@ func eldReportWriterV1(ctx context.Context, c *firestore.Client) {
 				break // don't write potentially bad data to Firestore
 			}
 
-			// check result
-			result, err := ref.NewDoc().Set(ctx, record)
-			if err != nil {
-				log.Errorf("Firestore write error: %v", err)
+			// build firestore reference, ELD records are keyed by their recordId
+			// so replays after a checkpoint resume overwrite rather than duplicate
+			var ref *firestore.DocumentRef
+			if rds.unidentified() {
+				ref, ok = writeUnidentifiedDriving(ctx, c, &rds, record.(FirestoreEldReportV1))
+				if !ok {
+					log.Warnf("Unable to place unidentified driving record in a segment: %s", rds.json.String())
+					break
+				}
 			} else {
-				log.Debugf("Firestore write result: %v", result)
+				ref = rds.firestoreDocument(c)
+			}
+
+			// hand off to the Firestore sink to be batched. Edits and replays of a record share its
+			// document, the one recorded last wins no matter which reaches Firestore first.
+			var guard *FirestoreWriteGuardV1
+			if recordTimestamp, ok := rds.recordTimestamp(); ok {
+				guard = &FirestoreWriteGuardV1{field: "recordTimestamp", at: recordTimestamp}
+			}
+			queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: record, guard: guard})
+			// every version of a record is kept under it, edits from Ultra included
+			if versionRef, ok := rds.versionDocument(ref); ok {
+				queueFirestoreWrite(ctx, FirestoreWriteV1{ref: versionRef, data: record})
+			}
+			writeEldHealth(ctx, c, &rds, record)
+			if dutyStatus, ok := record.(FirestoreEldDutyStatusV1); ok {
+				writeHosState(ctx, c, &rds, dutyStatus)
+			}
+			if navigation, ok := record.(FirestoreEldReportV1); ok && !rds.unidentified() {
+				writeDriverDaily(ctx, c, &rds, navigation)
 			}
 			// go back to waiting for a new report to enter channel
 		}
 	}
 }
 
+// subcollection of an ELD record's document holding every version of it
+const eldRecordVersionsCollection string = "eld_versions"
+
 // Methods on *EldReportDataStreamV1
 // Intentionally not versioned for now
 
@@ -64,25 +92,89 @@ func (r *EldReportDataStreamV1) firestoreReference(c *firestore.Client) *firesto
 	return ref
 }
 
+// document reference for a V1 eld data report, keyed by recordId when we have a usable one
+func (r *EldReportDataStreamV1) firestoreDocument(c *firestore.Client) *firestore.DocumentRef {
+	recordId, ok := r.recordId()
+	if !ok || !validFirestoreDocumentId(recordId) {
+		log.Warnf("EldReportDataStreamV1: no usable recordId (%q) for %s:%s report, using generated document id", recordId, r.reportType, r.reportDataType)
+		return r.firestoreReference(c).NewDoc()
+	}
+	return r.firestoreReference(c).Doc(recordId)
+}
+
+// document reference for this version of an ELD record, in the eld_versions subcollection of
+// the record's canonical document. Records without a recordId have no history to keep.
+func (r *EldReportDataStreamV1) versionDocument(canonical *firestore.DocumentRef) (*firestore.DocumentRef, bool) {
+	recordId, ok := r.recordId()
+	if !ok || canonical.ID != recordId {
+		return nil, false
+	}
+	id, ok := r.versionId()
+	if !ok {
+		return nil, false
+	}
+	return canonical.Collection(eldRecordVersionsCollection).Doc(id), true
+}
+
+// document id for a version of an ELD record: its recordTimestamp, so versions list in the
+// order they were made, then a hash of what the version says so replays land on the same one
+func (r *EldReportDataStreamV1) versionId() (id string, ok bool) {
+	recordTimestamp, ok := r.field("recordTimestamp").Data().(float64)
+	if !ok {
+		return ``, false
+	}
+	recordStatus, _ := r.recordStatus()
+	recordOrigin, _ := r.recordOrigin()
+	identity := fmt.Sprintf("%s|%s|%s", recordStatus, recordOrigin, r.field("recordData").String())
+	return fmt.Sprintf("%013.0f-%x", recordTimestamp, sha1.Sum([]byte(identity))), true
+}
+
 // validate/populate all items needed for an actionable EldReportDataStreamV1 type
 func (r *EldReportDataStreamV1) build() (ok bool) {
 	// eld reports require an accountId and driver id
 	clApiAcctId, aOk := r.json.Path("accountId").Data().(float64)
 	clApiDrivId, dOk := r.json.Path("data.userId").Data().(float64)
-	if !aOk || !dOk {
+	// navigation records without a driver are unidentified driving, filed under their vehicle instead
+	unidentified := !dOk && r.reportDataType == "navigation"
+	if !aOk || (!dOk && !unidentified) {
 		log.Warnf("EldReportDataStreamV1.build(): report doesn't contain required value(s): accountId:%t, data.userId:%t\n", aOk, dOk)
 		return false
 	}
 	accountId := fmt.Sprintf("%.0f", clApiAcctId)
-	userId := fmt.Sprintf("%.0f", clApiDrivId)
 	// get our clapi <-> cartwheel accountId match out of global map (mutex used)
 	ok = r.cartwheelMap(accountId)
 	if !ok {
 		log.Warnf("EldReportDataStreamV1.build(): Unable to obtain cartwheel accountId from in-memory mapping (accountId): %v\n", accountId)
 		return false
 	}
+	if unidentified {
+		return r.vehicleMap()
+	}
 	// assign userId (not from cartwheel)
-	r.clUserId = userId
+	r.clUserId = fmt.Sprintf("%.0f", clApiDrivId)
+	return true
+}
+
+// is this a record without a driver?
+func (r *EldReportDataStreamV1) unidentified() bool {
+	return r.clUserId == ``
+}
+
+// fetch the cartwheel vehicle of the transponder an unidentified record was sent from
+func (r *EldReportDataStreamV1) vehicleMap() (ok bool) {
+	transponderId, ok := r.transponderId()
+	if !ok {
+		log.Warnf("EldReportDataStreamV1.build(): unidentified driving record has no sentFrom.transponderId\n")
+		return false
+	}
+	navajoReferenceIds.mutex.Lock()
+	defer navajoReferenceIds.mutex.Unlock()
+	cwDeviceWebId, ok := navajoReferenceIds.clDeviceIdMap[fmt.Sprintf("%.0f", transponderId)]
+	if !ok {
+		log.Warnf("EldReportDataStreamV1.build(): unable to find match for CL API TransponderId (%.0f) : Navajo Web Id\n", transponderId)
+		return false
+	}
+	r.cwDeviceWebId = cwDeviceWebId
 	return true
 }
 
@@ -100,19 +192,70 @@ func (r *EldReportDataStreamV1) cartwheelMap(a string) (ok bool) {
 	return true
 }
 
-// determine if the EldReportDataStreamV1 packet we received is "valid"
+// ELD record dataTypes we have a Firestore layout for. Only navigation is known from the stream;
+// the others are named after the ELD event types of 49 CFR 395 Appendix A (duty status change,
+// intermediate log, login/logout, certification, engine power up/down, malfunction/diagnostic), and
+// neither their CL API dataType strings nor their recordData keys have been confirmed against a
+// captured packet. They're only written when ELD_RECORD_TYPES turns them on.
+var eldRecordDataTypes = map[string]bool{
+	"navigation":             true,
+	"duty_status":            true,
+	"intermediate_log":       true,
+	"login_logout":           true,
+	"certification":          true,
+	"engine_power":           true,
+	"malfunction_diagnostic": true,
+}
+
+// parse a comma separated list of ELD record dataTypes to write, ex "navigation,duty_status"
+func parseEldRecordTypes(s string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		dataType := strings.TrimSpace(field)
+		if !eldRecordDataTypes[dataType] {
+			return nil, fmt.Errorf("unsupported ELD record dataType %q", field)
+		}
+		types[dataType] = true
+	}
+	return types, nil
+}
+
+// determine if the EldReportDataStreamV1 packet we received is "valid", one of the
+// dataTypes we have a layout for and ELD_RECORD_TYPES turned on
 func (r *EldReportDataStreamV1) validDataType() (ok bool) {
-	dt := r.reportDataType
-	if dt == "navigation" {
-		return true
-	} else {
-		return false
+	return eldRecordDataTypes[r.reportDataType] && eldRecordTypes[r.reportDataType]
+}
+
+// ELD record fields sit under the packet's data object, fall back to the top level
+// for packets that send the record unwrapped
+func (r *EldReportDataStreamV1) field(path string) *gabs.Container {
+	if f := r.json.Path("data." + path); f.Data() != nil {
+		return f
 	}
+	return r.json.Path(path)
+}
+
+// parse a streaming ELD report JSON packet for a string within recordData
+func (r *EldReportDataStreamV1) recordDataString(key string) (string, bool) {
+	v, ok := r.field("recordData." + key).Data().(string)
+	return v, ok
+}
+
+// parse a streaming ELD report JSON packet for a number within recordData
+func (r *EldReportDataStreamV1) recordDataFloat(key string) (float64, bool) {
+	v, ok := r.field("recordData." + key).Data().(float64)
+	return v, ok
+}
+
+// parse a streaming ELD report JSON packet for a boolean within recordData
+func (r *EldReportDataStreamV1) recordDataBool(key string) (bool, bool) {
+	v, ok := r.field("recordData." + key).Data().(bool)
+	return v, ok
 }
 
 // parse a streaming ELD report JSON packet for usDotNumber
 func (r *EldReportDataStreamV1) usDotNum() (u string, ok bool) {
-	usDotNum, ok := r.json.Path("usDotNumber").Data().(string)
+	usDotNum, ok := r.field("usDotNumber").Data().(string)
 	if ok {
 		u = usDotNum
 		return u, true
@@ -123,7 +266,7 @@ func (r *EldReportDataStreamV1) usDotNum() (u string, ok bool) {
 
 // parse a streaming ELD report JSON packet for userId
 func (r *EldReportDataStreamV1) userId() (u float64, ok bool) {
-	userId, ok := r.json.Path("userId").Data().(float64)
+	userId, ok := r.field("userId").Data().(float64)
 	if ok {
 		u = userId
 		return u, true
@@ -134,7 +277,7 @@ func (r *EldReportDataStreamV1) userId() (u float64, ok bool) {
 
 // parse a streaming ELD report JSON packet for username
 func (r *EldReportDataStreamV1) username() (u string, ok bool) {
-	username, ok := r.json.Path("userName").Data().(string)
+	username, ok := r.field("userName").Data().(string)
 	if ok {
 		u = username
 		return u, true
@@ -145,7 +288,7 @@ func (r *EldReportDataStreamV1) username() (u string, ok bool) {
 
 // parse a streaming ELD report JSON packet for transponderId
 func (r *EldReportDataStreamV1) transponderId() (t float64, ok bool) {
-	tId, ok := r.json.Path("sentFrom.transponderId").Data().(float64)
+	tId, ok := r.field("sentFrom.transponderId").Data().(float64)
 	if ok {
 		t = tId
 		return t, true
@@ -156,7 +299,7 @@ func (r *EldReportDataStreamV1) transponderId() (t float64, ok bool) {
 
 // parse a streaming ELD report JSON packet for terminalNumber
 func (r *EldReportDataStreamV1) terminalNumber() (t string, ok bool) {
-	tNum, ok := r.json.Path("sentFrom.terminalNumber").Data().(string)
+	tNum, ok := r.field("sentFrom.terminalNumber").Data().(string)
 	if ok {
 		t = tNum
 		return t, true
@@ -167,7 +310,7 @@ func (r *EldReportDataStreamV1) terminalNumber() (t string, ok bool) {
 
 // parse a streaming ELD report JSON packet for serverRxTimestamp
 func (r *EldReportDataStreamV1) serverRxTimestamp() (t time.Time, ok bool) {
-	rx, ok := r.json.Path("sentFrom.serverRxTimestamp").Data().(float64)
+	rx, ok := r.field("sentFrom.serverRxTimestamp").Data().(float64)
 	if ok {
 		// convert UTC epoch millis to time.Time
 		t, _ := nanoEpochTimeObject(rx)
@@ -179,7 +322,7 @@ func (r *EldReportDataStreamV1) serverRxTimestamp() (t time.Time, ok bool) {
 
 // parse a streaming ELD report JSON packet for eventId
 func (r *EldReportDataStreamV1) eventId() (e string, ok bool) {
-	eId, ok := r.json.Path("eventId").Data().(string)
+	eId, ok := r.field("eventId").Data().(string)
 	if ok {
 		e = eId
 		return e, true
@@ -190,7 +333,7 @@ func (r *EldReportDataStreamV1) eventId() (e string, ok bool) {
 
 // parse a streaming ELD report JSON packet for recordId
 func (r *EldReportDataStreamV1) recordId() (record string, ok bool) {
-	rId, ok := r.json.Path("recordId").Data().(string)
+	rId, ok := r.field("recordId").Data().(string)
 	if ok {
 		record = rId
 		return record, true
@@ -201,7 +344,7 @@ func (r *EldReportDataStreamV1) recordId() (record string, ok bool) {
 
 // parse a streaming ELD report JSON packet for recordTimestamp
 func (r *EldReportDataStreamV1) recordTimestamp() (t time.Time, ok bool) {
-	rTime, ok := r.json.Path("recordTimestamp").Data().(float64)
+	rTime, ok := r.field("recordTimestamp").Data().(float64)
 	if ok {
 		// convert UTC epoch millis to time.Time
 		t, _ := nanoEpochTimeObject(rTime)
@@ -213,7 +356,7 @@ func (r *EldReportDataStreamV1) recordTimestamp() (t time.Time, ok bool) {
 
 // parse a streaming ELD report JSON packet for recordStatus
 func (r *EldReportDataStreamV1) recordStatus() (s string, ok bool) {
-	recordStatus, ok := r.json.Path("recordStatus").Data().(string)
+	recordStatus, ok := r.field("recordStatus").Data().(string)
 	if ok {
 		s = recordStatus
 		return s, true
@@ -224,7 +367,7 @@ func (r *EldReportDataStreamV1) recordStatus() (s string, ok bool) {
 
 // parse a streaming ELD report JSON packet for recordOrigin
 func (r *EldReportDataStreamV1) recordOrigin() (s string, ok bool) {
-	recordOrigin, ok := r.json.Path("recordOrigin").Data().(string)
+	recordOrigin, ok := r.field("recordOrigin").Data().(string)
 	if ok {
 		s = recordOrigin
 		return s, true
@@ -235,7 +378,7 @@ func (r *EldReportDataStreamV1) recordOrigin() (s string, ok bool) {
 
 // parse a streaming ELD report JSON packet for eventStartTimestamp
 func (r *EldReportDataStreamV1) eventStartTimestamp() (t time.Time, ok bool) {
-	est, ok := r.json.Path("recordData.eventStartTimestamp").Data().(float64)
+	est, ok := r.field("recordData.eventStartTimestamp").Data().(float64)
 	if ok {
 		t, _ := nanoEpochTimeObject(est)
 		return t, true
@@ -246,7 +389,7 @@ func (r *EldReportDataStreamV1) eventStartTimestamp() (t time.Time, ok bool) {
 
 // parse a streaming ELD report JSON packet for eventEndTimestamp
 func (r *EldReportDataStreamV1) eventEndTimestamp() (t time.Time, ok bool) {
-	eet, ok := r.json.Path("recordData.eventEndTimestamp").Data().(float64)
+	eet, ok := r.field("recordData.eventEndTimestamp").Data().(float64)
 	if ok {
 		t, _ := nanoEpochTimeObject(eet)
 		return t, true
@@ -257,7 +400,7 @@ func (r *EldReportDataStreamV1) eventEndTimestamp() (t time.Time, ok bool) {
 
 // parse a streaming ELD report JSON packet for navigationEvent
 func (r *EldReportDataStreamV1) navigationEvent() (n string, ok bool) {
-	ne, ok := r.json.Path("recordData.navigationEvent").Data().(string)
+	ne, ok := r.field("recordData.navigationEvent").Data().(string)
 	if ok {
 		n = ne
 		return n, true
@@ -268,7 +411,7 @@ func (r *EldReportDataStreamV1) navigationEvent() (n string, ok bool) {
 
 // parse a streaming ELD report JSON packet for vehicleMode
 func (r *EldReportDataStreamV1) vehicleMode() (m string, ok bool) {
-	vm, ok := r.json.Path("recordData.vehicleMode").Data().(string)
+	vm, ok := r.field("recordData.vehicleMode").Data().(string)
 	if ok {
 		m = vm
 		return m, true
@@ -279,7 +422,7 @@ func (r *EldReportDataStreamV1) vehicleMode() (m string, ok bool) {
 
 // parse a streaming ELD report JSON packet for locationType
 func (r *EldReportDataStreamV1) locationType() (t string, ok bool) {
-	lc, ok := r.json.Path("recordData.locationType").Data().(string)
+	lc, ok := r.field("recordData.locationType").Data().(string)
 	if ok {
 		t = lc
 		return t, true
@@ -291,8 +434,8 @@ func (r *EldReportDataStreamV1) locationType() (t string, ok bool) {
 // parse a streaming ELD report JSON packet for location: lat, lng
 func (r *EldReportDataStreamV1) location() (l *latlng.LatLng, ok bool) {
 	// pull both lat & long from ingested json, convert into GeoPoint *obj
-	locationLatitude, latOk := r.json.Path("recordData.location.latitude").Data().(float64)
-	locationLongitude, longOk := r.json.Path("recordData.location.longitude").Data().(float64)
+	locationLatitude, latOk := r.field("recordData.location.latitude").Data().(float64)
+	locationLongitude, longOk := r.field("recordData.location.longitude").Data().(float64)
 	if latOk && longOk {
 		geoPoint := &latlng.LatLng{
 			Latitude:  locationLatitude,
@@ -308,7 +451,7 @@ func (r *EldReportDataStreamV1) location() (l *latlng.LatLng, ok bool) {
 
 // parse a streaming ELD report JSON packet for geoDescription
 func (r *EldReportDataStreamV1) geoDescription() (g string, ok bool) {
-	gd, ok := r.json.Path("recordData.location.geoDescription").Data().(string)
+	gd, ok := r.field("recordData.location.geoDescription").Data().(string)
 	if ok {
 		g = gd
 		return g, true
@@ -319,7 +462,7 @@ func (r *EldReportDataStreamV1) geoDescription() (g string, ok bool) {
 
 // parse a streaming ELD report JSON packet for meters
 func (r *EldReportDataStreamV1) meters() (m float64, ok bool) {
-	meters, ok := r.json.Path("recordData.meters").Data().(float64)
+	meters, ok := r.field("recordData.meters").Data().(float64)
 	if ok {
 		m = meters
 		return m, true
@@ -330,7 +473,7 @@ func (r *EldReportDataStreamV1) meters() (m float64, ok bool) {
 
 // parse a streaming ELD report JSON packet for isDiagnosticActive
 func (r *EldReportDataStreamV1) isDiagnosticActive() (a bool, ok bool) {
-	active, ok := r.json.Path("isDiagnosticActive").Data().(bool)
+	active, ok := r.field("isDiagnosticActive").Data().(bool)
 	if ok {
 		a = active
 		return a, true
@@ -341,7 +484,7 @@ func (r *EldReportDataStreamV1) isDiagnosticActive() (a bool, ok bool) {
 
 // parse a streaming ELD report JSON packet for isMalfunctionActive
 func (r *EldReportDataStreamV1) isMalfunctionActive() (a bool, ok bool) {
-	active, ok := r.json.Path("isMalfunctionActive").Data().(bool)
+	active, ok := r.field("isMalfunctionActive").Data().(bool)
 	if ok {
 		a = active
 		return a, true
@@ -350,98 +493,195 @@ func (r *EldReportDataStreamV1) isMalfunctionActive() (a bool, ok bool) {
 	}
 }
 
-// unpack an EldReportDataStream V1 packet into a Firebase Eld Report V1
-func (r *EldReportDataStreamV1) firestoreRecord() (fbRecord FirestoreEldReportV1, err error) {
-	if r.validDataType() {
-		usDotNum, ok := r.usDotNum()
-		if ok {
-			fbRecord.UsDotNumber = usDotNum
-		}
-		userId, ok := r.userId()
-		if ok {
-			fbRecord.UserId = userId
-		}
-		username, ok := r.username()
-		if ok {
-			fbRecord.Username = username
-		}
-		transponderId, ok := r.transponderId()
-		if ok {
-			fbRecord.TransponderId = transponderId
-		}
-		terminalNum, ok := r.terminalNumber()
-		if ok {
-			fbRecord.TerminalNumber = terminalNum
-		}
-		serverRxTimestamp, ok := r.serverRxTimestamp()
-		if ok {
-			fbRecord.ServerRxTimestamp = serverRxTimestamp
-		}
-		eventId, ok := r.eventId()
-		if ok {
-			fbRecord.EventId = eventId
-		}
-		recordId, ok := r.recordId()
-		if ok {
-			fbRecord.RecordId = recordId
-		}
-		recordTimestamp, ok := r.recordTimestamp()
-		if ok {
-			fbRecord.RecordTimestamp = recordTimestamp
-		}
-		recordStatus, ok := r.recordStatus()
-		if ok {
-			fbRecord.RecordStatus = recordStatus
-		}
-		recordOrigin, ok := r.recordOrigin()
-		if ok {
-			fbRecord.RecordOrigin = recordOrigin
-		}
-		eventStartTimestamp, ok := r.eventStartTimestamp()
-		if ok {
-			fbRecord.EventStartTimestamp = eventStartTimestamp
-		}
-		eventEndTimestamp, ok := r.eventEndTimestamp()
-		if ok {
-			fbRecord.EventEndTimestamp = eventEndTimestamp
-		}
-		navEvent, ok := r.navigationEvent()
-		if ok {
-			fbRecord.NavigationEvent = navEvent
-		}
-		vehicleMode, ok := r.vehicleMode()
-		if ok {
-			fbRecord.VehicleMode = vehicleMode
-		}
-		locationType, ok := r.locationType()
-		if ok {
-			fbRecord.LocationType = locationType
-		}
-		location, ok := r.location()
-		if ok {
-			fbRecord.Location = location
-		}
-		geoDesc, ok := r.geoDescription()
-		if ok {
-			fbRecord.GeoDescription = geoDesc
-		}
-		meters, ok := r.meters()
-		if ok {
-			fbRecord.Meters = meters
-		}
-		isDiagActive, ok := r.isDiagnosticActive()
-		if ok {
-			fbRecord.IsDiagnosticActive = isDiagActive
-		}
-		isMalActive, ok := r.isMalfunctionActive()
-		if ok {
-			fbRecord.IsMalfunctionActive = isMalActive
-		}
-		fbRecord.Type = r.reportDataType
-		return fbRecord, nil
-	} else {
-		errMsg := fmt.Sprintf("ERROR: Unable to marshall streaming JSON record to FirestoreTransponderReportV1 struct: dataType is not compatible: %s:%s", r.reportType, r.reportDataType)
+// unpack an EldReportDataStream V1 packet into the Firestore record for its ELD event type
+func (r *EldReportDataStreamV1) firestoreRecord() (record interface{}, err error) {
+	if !eldRecordDataTypes[r.reportDataType] {
+		errMsg := fmt.Sprintf("ERROR: Unable to marshall streaming JSON record to an ELD Firestore record: dataType is not compatible: %s:%s", r.reportType, r.reportDataType)
 		log.Debugln(errMsg)
-		return fbRecord, errors.New(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	header := r.recordHeader()
+	switch r.reportDataType {
+	case "duty_status":
+		return r.dutyStatusRecord(header), nil
+	case "intermediate_log":
+		return r.intermediateLogRecord(header), nil
+	case "login_logout":
+		return r.loginLogoutRecord(header), nil
+	case "certification":
+		return r.certificationRecord(header), nil
+	case "engine_power":
+		return r.enginePowerRecord(header), nil
+	case "malfunction_diagnostic":
+		return r.malfunctionDiagnosticRecord(header), nil
+	default:
+		return r.navigationRecord(header), nil
+	}
+}
+
+// header fields of a marshalled ELD record, whatever its type
+func eldRecordHeader(record interface{}) (EldRecordHeaderV1, bool) {
+	switch r := record.(type) {
+	case FirestoreEldReportV1:
+		return r.EldRecordHeaderV1, true
+	case FirestoreEldDutyStatusV1:
+		return r.EldRecordHeaderV1, true
+	case FirestoreEldIntermediateLogV1:
+		return r.EldRecordHeaderV1, true
+	case FirestoreEldLoginLogoutV1:
+		return r.EldRecordHeaderV1, true
+	case FirestoreEldCertificationV1:
+		return r.EldRecordHeaderV1, true
+	case FirestoreEldEnginePowerV1:
+		return r.EldRecordHeaderV1, true
+	case FirestoreEldMalfunctionDiagnosticV1:
+		return r.EldRecordHeaderV1, true
+	}
+	return EldRecordHeaderV1{}, false
+}
+
+// fields shared by every ELD record type
+func (r *EldReportDataStreamV1) recordHeader() (h EldRecordHeaderV1) {
+	usDotNum, ok := r.usDotNum()
+	if ok {
+		h.UsDotNumber = usDotNum
+	}
+	userId, ok := r.userId()
+	if ok {
+		h.UserId = userId
+	}
+	username, ok := r.username()
+	if ok {
+		h.Username = username
 	}
+	transponderId, ok := r.transponderId()
+	if ok {
+		h.TransponderId = transponderId
+	}
+	terminalNum, ok := r.terminalNumber()
+	if ok {
+		h.TerminalNumber = terminalNum
+	}
+	serverRxTimestamp, ok := r.serverRxTimestamp()
+	if ok {
+		h.ServerRxTimestamp = serverRxTimestamp
+	}
+	eventId, ok := r.eventId()
+	if ok {
+		h.EventId = eventId
+	}
+	recordId, ok := r.recordId()
+	if ok {
+		h.RecordId = recordId
+	}
+	recordTimestamp, ok := r.recordTimestamp()
+	if ok {
+		h.RecordTimestamp = recordTimestamp
+	}
+	recordStatus, ok := r.recordStatus()
+	if ok {
+		h.RecordStatus = recordStatus
+	}
+	recordOrigin, ok := r.recordOrigin()
+	if ok {
+		h.RecordOrigin = recordOrigin
+	}
+	eventStartTimestamp, ok := r.eventStartTimestamp()
+	if ok {
+		h.EventStartTimestamp = eventStartTimestamp
+	}
+	eventEndTimestamp, ok := r.eventEndTimestamp()
+	if ok {
+		h.EventEndTimestamp = eventEndTimestamp
+	}
+	locationType, ok := r.locationType()
+	if ok {
+		h.LocationType = locationType
+	}
+	location, ok := r.location()
+	if ok {
+		h.Location = location
+		h.Geohash = geohashes(location)
+	}
+	geoDesc, ok := r.geoDescription()
+	if ok {
+		h.GeoDescription = geoDesc
+	}
+	h.AccumulatedVehicleMiles, _ = r.recordDataFloat("accumulatedVehicleMiles")
+	h.ElapsedEngineHours, _ = r.recordDataFloat("elapsedEngineHours")
+	h.TotalVehicleMiles, _ = r.recordDataFloat("totalVehicleMiles")
+	h.TotalEngineHours, _ = r.recordDataFloat("totalEngineHours")
+	isDiagActive, ok := r.isDiagnosticActive()
+	if ok {
+		h.IsDiagnosticActive = isDiagActive
+		h.hasDiagnosticActive = true
+	}
+	isMalActive, ok := r.isMalfunctionActive()
+	if ok {
+		h.IsMalfunctionActive = isMalActive
+		h.hasMalfunctionActive = true
+	}
+	h.Type = r.reportDataType
+	h.SchemaVersion = schemaVersionV1
+	return h
+}
+
+func (r *EldReportDataStreamV1) navigationRecord(h EldRecordHeaderV1) FirestoreEldReportV1 {
+	record := FirestoreEldReportV1{EldRecordHeaderV1: h}
+	navEvent, ok := r.navigationEvent()
+	if ok {
+		record.NavigationEvent = navEvent
+	}
+	vehicleMode, ok := r.vehicleMode()
+	if ok {
+		record.VehicleMode = vehicleMode
+	}
+	meters, ok := r.meters()
+	if ok {
+		record.Meters = meters
+	}
+	return record
+}
+
+func (r *EldReportDataStreamV1) dutyStatusRecord(h EldRecordHeaderV1) FirestoreEldDutyStatusV1 {
+	record := FirestoreEldDutyStatusV1{EldRecordHeaderV1: h}
+	record.DutyStatus, _ = r.recordDataString("dutyStatus")
+	record.VehicleMode, _ = r.vehicleMode()
+	record.Comment, _ = r.recordDataString("comment")
+	return record
+}
+
+func (r *EldReportDataStreamV1) intermediateLogRecord(h EldRecordHeaderV1) FirestoreEldIntermediateLogV1 {
+	record := FirestoreEldIntermediateLogV1{EldRecordHeaderV1: h}
+	record.ReducedPrecision, _ = r.recordDataBool("reducedPrecision")
+	record.VehicleMode, _ = r.vehicleMode()
+	return record
+}
+
+func (r *EldReportDataStreamV1) loginLogoutRecord(h EldRecordHeaderV1) FirestoreEldLoginLogoutV1 {
+	record := FirestoreEldLoginLogoutV1{EldRecordHeaderV1: h}
+	record.LoginEvent, _ = r.recordDataString("loginEvent")
+	return record
+}
+
+func (r *EldReportDataStreamV1) certificationRecord(h EldRecordHeaderV1) FirestoreEldCertificationV1 {
+	record := FirestoreEldCertificationV1{EldRecordHeaderV1: h}
+	record.CertifiedDate, _ = r.recordDataString("certifiedDate")
+	record.CertificationCount, _ = r.recordDataFloat("certificationCount")
+	return record
+}
+
+func (r *EldReportDataStreamV1) enginePowerRecord(h EldRecordHeaderV1) FirestoreEldEnginePowerV1 {
+	record := FirestoreEldEnginePowerV1{EldRecordHeaderV1: h}
+	record.PowerEvent, _ = r.recordDataString("powerEvent")
+	record.ReducedPrecision, _ = r.recordDataBool("reducedPrecision")
+	return record
+}
+
+func (r *EldReportDataStreamV1) malfunctionDiagnosticRecord(h EldRecordHeaderV1) FirestoreEldMalfunctionDiagnosticV1 {
+	record := FirestoreEldMalfunctionDiagnosticV1{EldRecordHeaderV1: h}
+	record.MalfunctionEvent, _ = r.recordDataString("malfunctionEvent")
+	record.Code, _ = r.recordDataString("code")
+	record.Description, _ = r.recordDataString("description")
+	return record
 }
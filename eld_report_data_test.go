@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	gabs "github.com/Jeffail/gabs/v2"
+)
+
+// build an EldReportDataStreamV1 the same way the assembly router does
+func testEldReport(t *testing.T, packet string) EldReportDataStreamV1 {
+	json, err := gabs.ParseJSON([]byte(packet))
+	if err != nil {
+		t.Fatalf("unable to parse test packet: %v", err)
+	}
+	rds := ReportDataStreamV1{json: json}
+	rds.reportType, _ = json.Path("type").Data().(string)
+	rds.reportDataType, _ = json.Path("dataType").Data().(string)
+	return rds.eldReportDataStreamV1()
+}
+
+func eldTestPacket(dataType string, recordData string) string {
+	return `{"type":"ELD_RECORD","dataType":"` + dataType + `","accountId":12,"data":{"userId":3344,"userName":"jdoe",
+		"usDotNumber":"1234567","recordId":"rec-` + dataType + `","recordTimestamp":1613576740322,"recordStatus":"ACTIVE",
+		"recordOrigin":"DRIVER","sentFrom":{"transponderId":519372,"terminalNumber":"T1"},"recordData":` + recordData + `}}`
+}
+
+// every ELD record type lands in its own typed record with the shared header filled in
+func TestEldFirestoreRecord(t *testing.T) {
+	location := `"location":{"latitude":41.41,"longitude":-70.58,"geoDescription":"2mi N Edgartown, MA"},
+		"accumulatedVehicleMiles":12,"elapsedEngineHours":0.5,"totalVehicleMiles":120345,"totalEngineHours":4321.5`
+
+	r := testEldReport(t, eldTestPacket("duty_status", `{"dutyStatus":"DRIVING","vehicleMode":"NORMAL","comment":"leaving yard",`+location+`}`))
+	record, err := r.firestoreRecord()
+	if err != nil {
+		t.Fatalf("firestoreRecord() = %v", err)
+	}
+	duty, ok := record.(FirestoreEldDutyStatusV1)
+	if !ok {
+		t.Fatalf("firestoreRecord() = %T, want: FirestoreEldDutyStatusV1", record)
+	}
+	if duty.DutyStatus != "DRIVING" || duty.VehicleMode != "NORMAL" || duty.Comment != "leaving yard" {
+		t.Errorf("duty status fields = %+v", duty)
+	}
+	if duty.UserId != 3344 || duty.RecordId != "rec-duty_status" || duty.Type != "duty_status" || duty.TransponderId != 519372 {
+		t.Errorf("header = %+v", duty.EldRecordHeaderV1)
+	}
+	if duty.Location == nil || duty.Geohash == nil || duty.TotalVehicleMiles != 120345 || duty.ElapsedEngineHours != 0.5 {
+		t.Errorf("header location/odometer = %+v", duty.EldRecordHeaderV1)
+	}
+
+	r = testEldReport(t, eldTestPacket("login_logout", `{"loginEvent":"LOGOUT"}`))
+	record, _ = r.firestoreRecord()
+	if login, ok := record.(FirestoreEldLoginLogoutV1); !ok || login.LoginEvent != "LOGOUT" {
+		t.Errorf("firestoreRecord() login_logout = %+v", record)
+	}
+
+	r = testEldReport(t, eldTestPacket("certification", `{"certifiedDate":"2021-02-17","certificationCount":2}`))
+	record, _ = r.firestoreRecord()
+	if cert, ok := record.(FirestoreEldCertificationV1); !ok || cert.CertifiedDate != "2021-02-17" || cert.CertificationCount != 2 {
+		t.Errorf("firestoreRecord() certification = %+v", record)
+	}
+
+	r = testEldReport(t, eldTestPacket("engine_power", `{"powerEvent":"POWER_UP","reducedPrecision":true}`))
+	record, _ = r.firestoreRecord()
+	if power, ok := record.(FirestoreEldEnginePowerV1); !ok || power.PowerEvent != "POWER_UP" || !power.ReducedPrecision {
+		t.Errorf("firestoreRecord() engine_power = %+v", record)
+	}
+
+	r = testEldReport(t, eldTestPacket("malfunction_diagnostic", `{"malfunctionEvent":"MALFUNCTION_LOGGED","code":"P","description":"power compliance"}`))
+	record, _ = r.firestoreRecord()
+	if mal, ok := record.(FirestoreEldMalfunctionDiagnosticV1); !ok || mal.MalfunctionEvent != "MALFUNCTION_LOGGED" || mal.Code != "P" || mal.Description != "power compliance" {
+		t.Errorf("firestoreRecord() malfunction_diagnostic = %+v", record)
+	}
+
+	r = testEldReport(t, eldTestPacket("intermediate_log", `{"vehicleMode":"NORMAL","reducedPrecision":false}`))
+	record, _ = r.firestoreRecord()
+	if _, ok := record.(FirestoreEldIntermediateLogV1); !ok {
+		t.Errorf("firestoreRecord() intermediate_log = %T", record)
+	}
+
+	r = testEldReport(t, eldTestPacket("navigation", `{"navigationEvent":"ARRIVED","meters":120,`+location+`}`))
+	record, _ = r.firestoreRecord()
+	if nav, ok := record.(FirestoreEldReportV1); !ok || nav.NavigationEvent != "ARRIVED" || nav.Meters != 120 {
+		t.Errorf("firestoreRecord() navigation = %+v", record)
+	}
+
+	r = testEldReport(t, eldTestPacket("unassigned_driving", `{}`))
+	if r.validDataType() {
+		t.Errorf("validDataType() of unassigned_driving = true, want: false")
+	}
+	if _, err := r.firestoreRecord(); err == nil {
+		t.Errorf("firestoreRecord() of unassigned_driving = nil error, want an error")
+	}
+}
+
+// versions of a record sort by recordTimestamp, replays land on the same version
+func TestEldRecordVersionId(t *testing.T) {
+	active := eldTestPacket("duty_status", `{"dutyStatus":"DRIVING"}`)
+	r := testEldReport(t, active)
+	id, ok := r.versionId()
+	if !ok || id[:14] != "1613576740322-" {
+		t.Fatalf("versionId() = %q, %t, want an id starting with the recordTimestamp", id, ok)
+	}
+	replay := testEldReport(t, active)
+	if replayId, _ := replay.versionId(); replayId != id {
+		t.Errorf("versionId() of replayed record = %s, want: %s", replayId, id)
+	}
+	for name, packet := range map[string]string{
+		"inactivated": strings.Replace(active, `"ACTIVE"`, `"INACTIVE_CHANGED"`, 1),
+		"edited":      eldTestPacket("duty_status", `{"dutyStatus":"ON_DUTY"}`),
+	} {
+		other := testEldReport(t, packet)
+		if otherId, _ := other.versionId(); otherId == id {
+			t.Errorf("versionId() of %s record = %s, want a different id", name, otherId)
+		}
+	}
+}
+
+// ELD dataTypes not yet confirmed against the stream are only written once ELD_RECORD_TYPES turns them on
+func TestEldRecordTypes(t *testing.T) {
+	defer func(types map[string]bool) { eldRecordTypes = types }(eldRecordTypes)
+	var err error
+	eldRecordTypes, err = parseEldRecordTypes(DefaultEldRecordTypes)
+	if err != nil {
+		t.Fatalf("parseEldRecordTypes(%q) = %v", DefaultEldRecordTypes, err)
+	}
+	navigation := testEldReport(t, eldTestPacket("navigation", `{"navigationEvent":"ARRIVED"}`))
+	dutyStatus := testEldReport(t, eldTestPacket("duty_status", `{"dutyStatus":"DRIVING"}`))
+	if !navigation.validDataType() || dutyStatus.validDataType() {
+		t.Errorf("default validDataType() navigation:%t duty_status:%t, want: true, false", navigation.validDataType(), dutyStatus.validDataType())
+	}
+	eldRecordTypes, _ = parseEldRecordTypes("navigation, duty_status")
+	if !dutyStatus.validDataType() {
+		t.Errorf("validDataType() of duty_status turned on = false, want: true")
+	}
+	if _, err := parseEldRecordTypes("navigation,unassigned_driving"); err == nil {
+		t.Errorf("parseEldRecordTypes() accepted a dataType we have no layout for")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	gabs "github.com/Jeffail/gabs/v2"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Integration tests against the Firestore emulator. Start one and point FIRESTORE_EMULATOR_HOST at it:
+//   gcloud beta emulators firestore start --host-port=localhost:8070
+//   FIRESTORE_EMULATOR_HOST=localhost:8070 go test -run Emulator ./...
+// Without an emulator these tests are skipped.
+
+// CL API -> Cartwheel ids the fixtures in testdata/emulator map to
+const emulatorClAccountId string = "12"
+const emulatorClTransponderId string = "519372"
+const emulatorCwAccountId string = "1001"
+const emulatorCwDeviceWebId string = "2002"
+
+// skip unless an emulator is answering on FIRESTORE_EMULATOR_HOST
+func requireFirestoreEmulator(t *testing.T) {
+	host := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set, skipping Firestore emulator test")
+	}
+	conn, err := net.DialTimeout("tcp", host, time.Second)
+	if err != nil {
+		t.Skipf("Firestore emulator not reachable at %s, skipping: %v", host, err)
+	}
+	conn.Close()
+}
+
+// run the streaming pipeline from the assembly router through to the Firestore sink
+// against its own emulator project, returning a client to read results back with
+func startEmulatorPipeline(t *testing.T) (context.Context, *firestore.Client) {
+	requireFirestoreEmulator(t)
+	// a project per run keeps runs from seeing each other's documents
+	gcpProjectId = fmt.Sprintf("firestream-test-%d", time.Now().UnixNano())
+	firestoreBatchSize = DefaultFirestoreBatchSize
+	firestoreBatchInterval = 100 * time.Millisecond
+	firestoreWriteTimeout = 5 * time.Second
+	firestoreWriteAttempts = 3
+	firestoreRetryBackoff = 50 * time.Millisecond
+	firestoreMaxRetryBackoff = time.Second
+	firestoreDeadLetterFile = t.TempDir() + "/deadletter.jsonl"
+	firestoreDocWriteInterval = DefaultFirestoreDocWriteInterval
+	firestoreMaxWriteRate = 0
+	transponderSchemaVersions = []int{schemaVersionV1}
+	inactiveRate = 0
+	tripGapTimeout = DefaultTripGapTimeout
+	tripMaxPoints = DefaultTripMaxPoints
+	initGlobalChannels()
+
+	testNavajoReferenceIds(t, map[string]string{emulatorClAccountId: emulatorCwAccountId}, map[string]string{emulatorClTransponderId: emulatorCwDeviceWebId})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	clients := make([]*firestore.Client, 3+firestoreBatchWriters)
+	for i := range clients {
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			t.Fatalf("createFirestoreClient() = %v", err)
+		}
+		clients[i] = c
+	}
+	firestoreSinkDone.Add(1 + len(firestoreGovernedWrites))
+	firestoreBatchWritersDone.Add(len(firestoreGovernedWrites))
+	go firestoreWriteGovernor(ctx, clients[0])
+	for i, writes := range firestoreGovernedWrites {
+		go firestoreBatchWriterV1(ctx, clients[3+i], writes)
+	}
+	go firestoreAssemblyRouter(ctx)
+	// a single report writer keeps fixtures in order
+	go transponderReportWriterV1(ctx, clients[2])
+	return ctx, clients[3]
+}
+
+// feed every packet in a JSON lines fixture through processStreamingJSON, like readPump() does
+func feedFixturePackets(t *testing.T, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open fixture %s: %v", path, err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		pj, err := gabs.ParseJSON(s.Bytes())
+		if err != nil {
+			t.Fatalf("unable to parse fixture packet %q: %v", s.Text(), err)
+		}
+		processStreamingJSON(pj)
+	}
+}
+
+// documents of a collection as path:normalized fields, waiting until at least want of them
+// show up and then a little longer so anything unexpected has a chance to land too
+func collectEmulatorDocuments(t *testing.T, ctx context.Context, coll *firestore.CollectionRef, want int) map[string]interface{} {
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		docs, err := coll.Documents(ctx).GetAll()
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", coll.Path, err)
+		}
+		if len(docs) >= want || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+	docs, err := coll.Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", coll.Path, err)
+	}
+	got := make(map[string]interface{})
+	for _, doc := range docs {
+		data := doc.Data()
+		if _, ok := data["fsCreateTimestamp"].(time.Time); !ok {
+			t.Errorf("%s has no server set fsCreateTimestamp", doc.Ref.Path)
+		}
+		delete(data, "fsCreateTimestamp")
+		got[reportDataRelativePath(doc.Ref)] = normalizeEmulatorValue(data)
+	}
+	return got
+}
+
+// turn Firestore values into what encoding/json would decode the golden files into
+func normalizeEmulatorValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, child := range value {
+			m[k] = normalizeEmulatorValue(child)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(value))
+		for i, child := range value {
+			s[i] = normalizeEmulatorValue(child)
+		}
+		return s
+	case int64:
+		return float64(value)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case *latlng.LatLng:
+		return map[string]interface{}{"latitude": value.Latitude, "longitude": value.Longitude}
+	}
+	return v
+}
+
+func loadGolden(t *testing.T, path string) map[string]interface{} {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read golden file %s: %v", path, err)
+	}
+	golden := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &golden); err != nil {
+		t.Fatalf("unable to parse golden file %s: %v", path, err)
+	}
+	return golden
+}
+
+// fixture packets land in report_data exactly as the golden file describes, packets for
+// unknown transponders and unsupported dataTypes don't land at all
+func TestEmulatorTransponderReportData(t *testing.T) {
+	ctx, c := startEmulatorPipeline(t)
+	defer c.Close()
+	feedFixturePackets(t, "testdata/emulator/packets.jsonl")
+
+	want := loadGolden(t, "testdata/emulator/report_data.golden.json")
+	reportData := c.Collection("account").Doc(emulatorCwAccountId).Collection("vehicle").Doc(emulatorCwDeviceWebId).Collection("report_data")
+	got := collectEmulatorDocuments(t, ctx, reportData, len(want))
+
+	for path, wantDoc := range want {
+		gotDoc, ok := got[path]
+		if !ok {
+			t.Errorf("missing document %s", path)
+			continue
+		}
+		if !reflect.DeepEqual(gotDoc, wantDoc) {
+			gotJson, _ := json.MarshalIndent(gotDoc, "", "  ")
+			t.Errorf("document %s =\n%s\nwant:\n%v", path, gotJson, wantDoc)
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("unexpected document %s", path)
+		}
+	}
+}
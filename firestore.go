@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -12,27 +13,37 @@ import (
 
 // Transponder generated reports (speeding, status, hard_accel, ...)
 type FirestoreTransponderReportV1 struct {
-	ConfigId           float64        `firestore:"configId,omitempty"`
-	Duration           float64        `firestore:"duration,omitempty"`
-	EventStart         time.Time      `firestore:"eventStart,omitempty"`
-	InProgress         bool           `firestore:"inProgress,omitempty"`
-	LocationAccuracy   float64        `firestore:"locationAccuracy,omitempty"`
-	Heading            float64        `firestore:"heading,omitempty"`
-	Address            string         `firestore:"address,omitempty"`
-	DotOrientation     string         `firestore:"dotOrientation,omitempty"`
-	LatLng             *latlng.LatLng `firestore:"latLng,omitempty"`
-	BatteryVoltage     float64        `firestore:"batteryVoltage,omitempty"`
-	CellSignalStrength float64        `firestore:"cellSignalStrength,omitempty"`
-	IsLowBattery       bool           `firestore:"isLowBatteryVoltage,omitempty"`
-	Odometer           float64        `firestore:"odometer,omitempty"`
-	Speed              float64        `firestore:"speed,omitempty"`
-	SpeedLimit         float64        `firestore:"speedLimit,omitempty"`
-	ReportTimestamp    time.Time      `firestore:"reportTimestamp,omitempty"`
-	Serial             float64        `firestore:"serial,omitempty"`
-	Type               string         `firestore:"type"`                              // this is the "dataType" field of a streaming packet
-	FirestoreCreation  time.Time      `firestore:"fsCreateTimestamp,serverTimestamp"` // if zero, Firestore sets this on their end
-	GeoTags            []GeoTagV1     `firestore:"geoTags,omitempty"`                 // omit this whole object if nothing is here
+	ConfigId           float64                 `firestore:"configId,omitempty"`
+	Duration           float64                 `firestore:"duration,omitempty"`
+	EventStart         time.Time               `firestore:"eventStart,omitempty"`
+	InProgress         bool                    `firestore:"inProgress,omitempty"`
+	LocationAccuracy   float64                 `firestore:"locationAccuracy,omitempty"`
+	Heading            float64                 `firestore:"heading,omitempty"`
+	Address            string                  `firestore:"address,omitempty"`
+	DotOrientation     string                  `firestore:"dotOrientation,omitempty"`
+	LatLng             *latlng.LatLng          `firestore:"latLng,omitempty"`
+	Geohash            *GeohashesV1            `firestore:"geohash,omitempty"` // omitted along with latLng
+	BatteryVoltage     float64                 `firestore:"batteryVoltage,omitempty"`
+	CellSignalStrength float64                 `firestore:"cellSignalStrength,omitempty"`
+	IsLowBattery       bool                    `firestore:"isLowBatteryVoltage,omitempty"`
+	Odometer           float64                 `firestore:"odometer,omitempty"`
+	Speed              float64                 `firestore:"speed,omitempty"`
+	SpeedLimit         float64                 `firestore:"speedLimit,omitempty"`
+	ReportTimestamp    time.Time               `firestore:"reportTimestamp,omitempty"`
+	Serial             float64                 `firestore:"serial,omitempty"`
+	Type               string                  `firestore:"type"` // this is the "dataType" field of a streaming packet
+	SchemaVersion      int                     `firestore:"schemaVersion"`
+	FirestoreCreation  time.Time               `firestore:"fsCreateTimestamp,serverTimestamp"` // if zero, Firestore sets this on their end
+	GeoTags            []GeoTagV1              `firestore:"geoTags,omitempty"`                 // omit this whole object if nothing is here
+	Functions          *TransponderFunctionsV1 `firestore:"functions,omitempty"`
 }
+
+// Values the transponder computed over the event's duration, keyed by the parameter they're computed from
+type TransponderFunctionsV1 struct {
+	Average   map[string]float64 `firestore:"average,omitempty"`   // ex batteryVoltage
+	Integrate map[string]float64 `firestore:"integrate,omitempty"` // ex speed
+}
+
 type GeoTagV1 struct {
 	GeoZoneId float64   `firestore:"zoneId"`                // unique ref to a Geo Zone ID, this updates if changes are made to a tag in CLAPI
 	TagName   string    `firestore:"tagName"`               // name of Geo zone container report is within, geoZoneId can change
@@ -40,48 +51,109 @@ type GeoTagV1 struct {
 	Timestamp time.Time `firestore:"zoneModifiedTimestamp"` // timestamp GeoTagId was last modified (boundary change etc.)
 }
 
-// ELD reports
+// Fields every ELD record carries, embedded in each ELD record type below
+type EldRecordHeaderV1 struct {
+	UsDotNumber             string         `firestore:"usDotNumber,omitempty"`
+	UserId                  float64        `firestore:"userId,omitempty"`
+	Username                string         `firestore:"userName,omitempty"`
+	TransponderId           float64        `firestore:"transponderId,omitempty"`
+	TerminalNumber          string         `firestore:"terminalNumber,omitempty"`
+	ServerRxTimestamp       time.Time      `firestore:"serverRxTimestamp,omitempty"`
+	EventId                 string         `firestore:"eventId,omitempty"`
+	RecordId                string         `firestore:"recordId,omitempty"`
+	RecordTimestamp         time.Time      `firestore:"recordTimestamp,omitempty"`
+	RecordStatus            string         `firestore:"recordStatus,omitempty"`
+	RecordOrigin            string         `firestore:"recordOrigin,omitempty"`
+	EventStartTimestamp     time.Time      `firestore:"eventStartTimestamp,omitempty"`
+	EventEndTimestamp       time.Time      `firestore:"eventEndTimestamp,omitempty"`
+	LocationType            string         `firestore:"locationType,omitempty"`
+	Location                *latlng.LatLng `firestore:"location,omitempty"`
+	Geohash                 *GeohashesV1   `firestore:"geohash,omitempty"` // omitted along with location
+	GeoDescription          string         `firestore:"geoDescription,omitempty"`
+	AccumulatedVehicleMiles float64        `firestore:"accumulatedVehicleMiles,omitempty"` // since the last engine power up
+	ElapsedEngineHours      float64        `firestore:"elapsedEngineHours,omitempty"`      // since the last engine power up
+	TotalVehicleMiles       float64        `firestore:"totalVehicleMiles,omitempty"`
+	TotalEngineHours        float64        `firestore:"totalEngineHours,omitempty"`
+	IsDiagnosticActive      bool           `firestore:"isDiagnosticActive,omitempty"`
+	IsMalfunctionActive     bool           `firestore:"isMalfunctionActive,omitempty"`
+	Type                    string         `firestore:"type"` // this is the "dataType" field of a streaming packet
+	SchemaVersion           int            `firestore:"schemaVersion"`
+	FirestoreCreation       time.Time      `firestore:"fsCreateTimestamp,serverTimestamp"` // time document was created in Firestore
+	// whether the packet carried isDiagnosticActive/isMalfunctionActive, a record without them says nothing about either state
+	hasDiagnosticActive  bool
+	hasMalfunctionActive bool
+}
+
+// ELD navigation records
 type FirestoreEldReportV1 struct {
-	UsDotNumber         string         `firestore:"usDotNumber,omitempty"`
-	UserId              float64        `firestore:"userId,omitempty"`
-	Username            string         `firestore:"userName,omitempty"`
-	TransponderId       float64        `firestore:"transponderId,omitempty"`
-	TerminalNumber      string         `firestore:"terminalNumber,omitempty"`
-	ServerRxTimestamp   time.Time      `firestore:"serverRxTimestamp,omitempty"`
-	EventId             string         `firestore:"eventId,omitempty"`
-	RecordId            string         `firestore:"recordId,omitempty"`
-	RecordTimestamp     time.Time      `firestore:"recordTimestamp,omitempty"`
-	RecordStatus        string         `firestore:"recordStatus,omitempty"`
-	RecordOrigin        string         `firestore:"recordOrigin,omitempty"`
-	EventStartTimestamp time.Time      `firestore:"eventStartTimestamp,omitempty"`
-	EventEndTimestamp   time.Time      `firestore:"eventEndTimestamp,omitempty"`
-	NavigationEvent     string         `firestore:"navigationEvent,omitempty"`
-	VehicleMode         string         `firestore:"vehicleMode,omitempty"`
-	LocationType        string         `firestore:"locationType,omitempty"`
-	Location            *latlng.LatLng `firestore:"location,omitempty"`
-	GeoDescription      string         `firestore:"geoDescription,omitempty"`
-	Meters              float64        `firestore:"meters,omitempty"`
-	IsDiagnosticActive  bool           `firestore:"isDiagnosticActive,omitempty"`
-	IsMalfunctionActive bool           `firestore:"isMalfunctionActive,omitempty"`
-	Type                string         `firestore:"type"`                              // this is the "dataType" field of a streaming packet
-	FirestoreCreation   time.Time      `firestore:"fsCreateTimestamp,serverTimestamp"` // time document was created in Firestore
+	EldRecordHeaderV1
+	NavigationEvent string  `firestore:"navigationEvent,omitempty"`
+	VehicleMode     string  `firestore:"vehicleMode,omitempty"`
+	Meters          float64 `firestore:"meters,omitempty"`
+}
+
+// ELD duty status changes (OFF_DUTY, SLEEPER_BERTH, DRIVING, ON_DUTY)
+type FirestoreEldDutyStatusV1 struct {
+	EldRecordHeaderV1
+	DutyStatus  string `firestore:"dutyStatus"`
+	VehicleMode string `firestore:"vehicleMode,omitempty"` // personal conveyance, yard moves, ...
+	Comment     string `firestore:"comment,omitempty"`
+}
+
+// ELD intermediate logs, recorded every hour of driving
+type FirestoreEldIntermediateLogV1 struct {
+	EldRecordHeaderV1
+	ReducedPrecision bool   `firestore:"reducedPrecision,omitempty"` // location recorded with reduced precision (personal conveyance)
+	VehicleMode      string `firestore:"vehicleMode,omitempty"`
+}
+
+// ELD driver login and logout (LOGIN, LOGOUT)
+type FirestoreEldLoginLogoutV1 struct {
+	EldRecordHeaderV1
+	LoginEvent string `firestore:"loginEvent"`
+}
+
+// ELD certification of a driver's records for a day
+type FirestoreEldCertificationV1 struct {
+	EldRecordHeaderV1
+	CertifiedDate      string  `firestore:"certifiedDate"`                // day being certified, YYYY-MM-DD in the driver's home terminal timezone
+	CertificationCount float64 `firestore:"certificationCount,omitempty"` // times the day has been certified
+}
+
+// ELD engine power up and shut down (POWER_UP, SHUT_DOWN)
+type FirestoreEldEnginePowerV1 struct {
+	EldRecordHeaderV1
+	PowerEvent       string `firestore:"powerEvent"`
+	ReducedPrecision bool   `firestore:"reducedPrecision,omitempty"`
+}
+
+// ELD malfunctions and data diagnostics being logged or cleared
+type FirestoreEldMalfunctionDiagnosticV1 struct {
+	EldRecordHeaderV1
+	MalfunctionEvent string `firestore:"malfunctionEvent"` // MALFUNCTION_LOGGED, MALFUNCTION_CLEARED, DIAGNOSTIC_LOGGED, DIAGNOSTIC_CLEARED
+	Code             string `firestore:"code"`             // FMCSA malfunction (P, E, T, L, R, S, O) or data diagnostic (1-6) code
+	Description      string `firestore:"description,omitempty"`
 }
 
 // Dashcamera reports, triggered by transponder, driver upload, or requested footage
 type FirestoreVideoReportV1 struct {
-	VideoEventId      string         `firestore:"videoEventId,omitempty"`
-	TerminalNumber    string         `firestore:"terminalNumber,omityempty"`
-	TransponderId     float64        `firestore:"transponderId,omitempty"`
-	EventTimestamp    time.Time      `firestore:"eventTimestamp,omitempty"`
-	Username          string         `firestore:"username,omitempty"`
-	EventType         []string       `firestore:"eventType,omitEmpty"` // is this correct?
-	Location          *latlng.LatLng `firestore:"location,omitempty"`
-	LocationAccuracy  float64        `firestore:"locationAccuracy,omitempty"`
-	Speed             float64        `firestore:"speed,omitempty"`
-	Heading           float64        `firestore:"heading,omitempty"`
-	Type              string         `firestore:"type"`                              // this is the "dataType" field
-	FirestoreCreation time.Time      `firestore:"fsCreateTimestamp,serverTimestamp"` // time document was created in Firestore
-	Footage           []VideoReportFootageV1
+	VideoEventId      string                 `firestore:"videoEventId,omitempty"`
+	TerminalNumber    string                 `firestore:"terminalNumber,omitempty"`
+	TransponderId     float64                `firestore:"transponderId,omitempty"`
+	EventTimestamp    time.Time              `firestore:"eventTimestamp,omitempty"`
+	Username          string                 `firestore:"username,omitempty"`
+	EventType         []string               `firestore:"eventType,omitempty"`
+	Location          *latlng.LatLng         `firestore:"location,omitempty"`
+	Geohash           *GeohashesV1           `firestore:"geohash,omitempty"` // omitted along with location
+	LocationAccuracy  float64                `firestore:"locationAccuracy,omitempty"`
+	Speed             float64                `firestore:"speed,omitempty"`
+	Heading           float64                `firestore:"heading,omitempty"`
+	Type              string                 `firestore:"type"`          // this is the "dataType" field
+	UploadStalled     bool                   `firestore:"uploadStalled"` // any footage upload stalled
+	SchemaVersion     int                    `firestore:"schemaVersion"`
+	FirestoreCreation time.Time              `firestore:"fsCreateTimestamp,serverTimestamp"` // time document was created in Firestore
+	FirestoreUpdate   time.Time              `firestore:"fsUpdateTimestamp,serverTimestamp"`
+	Footage           []VideoReportFootageV1 `firestore:"footage,omitempty"`
 }
 
 // Individual footage element within a video report, one for each camera installed
@@ -94,15 +166,18 @@ type VideoReportFootageV1 struct {
 	FootageDuration       float64   `firestore:"footageDuration,omitempty"`
 	FootageAudioIncluded  bool      `firestore:"footageAudioIncluded,omitempty"`
 	Size                  float64   `firestore:"size,omitempty"`
-	Md5                   float64   `firestore:"md5,omitempty"`
-	Crc32c                float64   `firestore:"crc32c,omitempty"`
+	Md5                   string    `firestore:"md5,omitempty"`    // base64
+	Crc32c                string    `firestore:"crc32c,omitempty"` // base64
 	ContentType           string    `firestore:"contentType,omitempty"`
 	FootagePath           string    `firestore:"footagePrivatePath,omitempty"`
 	UploadStatus          string    `firestore:"uploadStatus,omitempty"`
 	UploadStartTime       time.Time `firestore:"uploadStartTimestamp,omitempty"`
 	LastChunkRxTime       time.Time `firestore:"uploadLastChunkRxTimestamp,omitempty"`
-	BytesRemaining        float64   `firestore:"bytesRemaining,omitempt,omitemptyy"`
+	BytesRemaining        float64   `firestore:"bytesRemaining"`
 	UploadStatusReason    string    `firestore:"uploadStatusDetails,omitempty"`
+	UploadStalled         bool      `firestore:"uploadStalled"`       // lastChunkRxTimestamp hasn't advanced for VIDEO_UPLOAD_STALL_TIMEOUT
+	SignedUrl             string    `firestore:"signedUrl,omitempty"` // V4 signed URL of FootagePath
+	SignedUrlExpiration   time.Time `firestore:"signedUrlExpiration,omitempty"`
 }
 
 func createFirestoreClient(ctx context.Context) (*firestore.Client, error) {
@@ -113,3 +188,14 @@ func createFirestoreClient(ctx context.Context) (*firestore.Client, error) {
 	}
 	return client, nil
 }
+
+// Firestore document ids can't contain a forward slash, be "." / "..", or match __.*__
+func validFirestoreDocumentId(id string) bool {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return false
+	}
+	if strings.HasPrefix(id, "__") && strings.HasSuffix(id, "__") {
+		return false
+	}
+	return len(id) <= 1500
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Firestore refuses a WriteBatch with more than 500 writes in it
+const firestoreMaxBatchSize int = 500
+
+// batch writers committing governed writes, each owns the documents that hash to it
+const firestoreBatchWriters int = 2
+
+// how long the sink gets to commit what it's holding at shutdown
+const firestoreShutdownTimeout time.Duration = 5 * time.Second
+
+// the governor and batch writers, waited on at shutdown so their final flushes land
+var firestoreSinkDone sync.WaitGroup
+
+// the batch writers alone, the governor waits for their final flushes before committing its backlog
+var firestoreBatchWritersDone sync.WaitGroup
+
+// A single document write queued for the Firestore sink. Report writers
+// build the document reference and record, the sink decides when it's committed.
+type FirestoreWriteV1 struct {
+	ref   *firestore.DocumentRef
+	data  interface{}
+	opts  []firestore.SetOption
+	guard *FirestoreWriteGuardV1 // checked against the stored document before writing, nil writes blindly
+}
+
+// A condition a write must meet against the stored document. Writes reach Firestore through two
+// batch writers, retries and the dead letter file, so one made later can commit earlier; guarded
+// writes are committed in a transaction that drops them when the stored document is newer.
+type FirestoreWriteGuardV1 struct {
+	field  string    // timestamp field documents are ordered by, the write carries at in it
+	at     time.Time // written unless the stored field is after this
+	create bool      // only written when the document doesn't exist yet
+}
+
+// whether a write guarded this way must be dropped, given the stored document (nil if missing)
+func (g *FirestoreWriteGuardV1) stale(snap *firestore.DocumentSnapshot) bool {
+	if snap == nil || !snap.Exists() {
+		return false
+	}
+	if g.create {
+		return true
+	}
+	stored, err := snap.DataAt(g.field)
+	if err != nil {
+		return false // nothing to order by yet
+	}
+	storedAt, ok := stored.(time.Time)
+	return ok && storedAt.After(g.at)
+}
+
+// hand a write off to the Firestore sink, returns false if we're shutting down
+func queueFirestoreWrite(ctx context.Context, w FirestoreWriteV1) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case firestoreWrites <- w:
+		return true
+	}
+}
+
+// Firestore sink worker. Groups writes the write governor routed to it into a WriteBatch that is committed
+// when it reaches firestoreBatchSize or every firestoreBatchInterval, whichever comes first. A document
+// is written at most once per batch, so its writes are committed in the order they were released.
+// Callers add it to firestoreSinkDone and firestoreBatchWritersDone before starting it, so shutdown
+// can't miss a writer not yet scheduled.
+func firestoreBatchWriterV1(ctx context.Context, c *firestore.Client, writes <-chan FirestoreWriteV1) {
+	defer firestoreSinkDone.Done()
+	defer firestoreBatchWritersDone.Done()
+	fmmetrics.mu.Lock()
+	fmmetrics.writers++
+	fmmetrics.mu.Unlock()
+	defer func() {
+		fmmetrics.mu.Lock()
+		fmmetrics.writers--
+		fmmetrics.mu.Unlock()
+	}()
+
+	pending := make([]FirestoreWriteV1, 0, firestoreBatchSize)
+	paths := make(map[string]bool) // documents with a write in pending
+	commit := func(ctx context.Context) {
+		commitFirestoreBatch(ctx, c, pending)
+		pending = pending[:0]
+		paths = make(map[string]bool)
+	}
+	ticker := time.NewTicker(firestoreBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// pick up whatever was handed to us on the way down, then give the final
+			// flush a context of its own since ours is already cancelled
+			flushCtx, cancel := context.WithTimeout(context.Background(), firestoreShutdownTimeout)
+			for _, w := range drainFirestoreWrites(writes) {
+				if len(pending) >= firestoreBatchSize || paths[w.ref.Path] {
+					commit(flushCtx)
+				}
+				pending = append(pending, w)
+				paths[w.ref.Path] = true
+			}
+			commit(flushCtx)
+			cancel()
+			return
+		case w := <-writes:
+			if paths[w.ref.Path] {
+				// the document's previous write has to land first
+				commit(ctx)
+			}
+			pending = append(pending, w)
+			paths[w.ref.Path] = true
+			if len(pending) >= firestoreBatchSize {
+				commit(ctx)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				commit(ctx)
+			}
+		}
+	}
+}
+
+// writes already sitting in a sink channel, without waiting for more
+func drainFirestoreWrites(writes <-chan FirestoreWriteV1) []FirestoreWriteV1 {
+	var drained []FirestoreWriteV1
+	for {
+		select {
+		case w := <-writes:
+			drained = append(drained, w)
+		default:
+			return drained
+		}
+	}
+}
+
+// wait for the sink's final flushes at shutdown, giving up after a while rather than hanging
+func waitFirestoreSink(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		firestoreSinkDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// commit a group of writes as a single WriteBatch. Batches are atomic, so if the
+// commit is refused outright we fall back to writing each document on its own to
+// find out which of them Firestore is actually unhappy with.
+func commitFirestoreBatch(ctx context.Context, c *firestore.Client, writes []FirestoreWriteV1) {
+	if len(writes) == 0 {
+		return
+	}
+	// guarded writes need a read of the stored document, they can't go in the batch
+	var unguarded []FirestoreWriteV1
+	for _, w := range writes {
+		if w.guard == nil {
+			unguarded = append(unguarded, w)
+			continue
+		}
+		if err := commitGuardedFirestoreWrite(ctx, c, w); err != nil {
+			log.Errorf("Firestore guarded write error: %s: %v", w.ref.Path, err)
+			deadLetterFirestoreWrite(w, err)
+		} else {
+			fmmetrics.recordWrite()
+		}
+	}
+	writes = unguarded
+	if len(writes) == 0 {
+		return
+	}
+	start := time.Now()
+	err := withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+		batch := c.Batch()
+		for _, w := range writes {
+			batch.Set(w.ref, w.data, w.opts...)
+		}
+		_, err := batch.Commit(attemptCtx)
+		return err
+	})
+	fmmetrics.recordBatchCommit(len(writes), time.Since(start), err)
+	if err == nil {
+		log.Debugf("Firestore batch of %d writes committed in %v", len(writes), time.Since(start))
+		return
+	}
+	if retryableFirestoreError(err) {
+		// Firestore is struggling rather than refusing our data, writing
+		// documents one by one won't go any better. Park the lot for later.
+		log.Errorf("Firestore batch commit of %d writes failed after %d attempts: %v", len(writes), firestoreWriteAttempts, err)
+		for _, w := range writes {
+			deadLetterFirestoreWrite(w, err)
+		}
+		return
+	}
+	log.Warnf("Firestore batch commit of %d writes refused, retrying documents individually: %v", len(writes), err)
+	for _, w := range writes {
+		err := withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+			_, err := w.ref.Set(attemptCtx, w.data, w.opts...)
+			return err
+		})
+		if err != nil {
+			log.Errorf("Firestore write error: %s: %v", w.ref.Path, err)
+			deadLetterFirestoreWrite(w, err)
+		} else {
+			fmmetrics.recordWrite()
+		}
+	}
+}
+
+// write a guarded document in a transaction, leaving the stored document alone when the guard says it's stale
+func commitGuardedFirestoreWrite(ctx context.Context, c *firestore.Client, w FirestoreWriteV1) error {
+	return withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+		return c.RunTransaction(attemptCtx, func(txCtx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(w.ref)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if w.guard.stale(snap) {
+				log.Debugf("Firestore write to %s dropped, the stored document is newer than %v", w.ref.Path, w.guard.at)
+				return nil
+			}
+			return tx.Set(w.ref, w.data, w.opts...)
+		})
+	})
+}
+
+// run a Firestore call with its own deadline per attempt, backing off and retrying
+// errors that are likely to go away on their own. Anything else fails fast.
+func withFirestoreRetry(ctx context.Context, call func(context.Context) error) (err error) {
+	backoff := firestoreRetryBackoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, firestoreWriteTimeout)
+		err = call(attemptCtx)
+		cancel()
+		if err == nil || !retryableFirestoreError(err) || attempt >= firestoreWriteAttempts {
+			return err
+		}
+		// full jitter so our writers don't retry in lock step
+		wait := time.Duration(rand.Int63n(int64(backoff)) + 1)
+		log.Debugf("Firestore call failed (attempt %d/%d), retrying in %v: %v", attempt, firestoreWriteAttempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > firestoreMaxRetryBackoff {
+			backoff = firestoreMaxRetryBackoff
+		}
+	}
+}
+
+// classify a Firestore error by its gRPC status code. Unavailable, DeadlineExceeded,
+// ResourceExhausted and Aborted are transient, everything else (InvalidArgument,
+// PermissionDenied, ...) will fail the same way no matter how often we ask.
+func retryableFirestoreError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true // our own per-attempt deadline expired
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// A write Firestore wouldn't take, as recorded in the dead letter file
+type FirestoreDeadLetterV1 struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Path      string      `json:"path"`
+	Merge     bool        `json:"merge"`
+	Code      string      `json:"code"`
+	Error     string      `json:"error"`
+	Data      interface{} `json:"data"`
+	// guarded writes only replay if the stored document's GuardField isn't after GuardTimestamp,
+	// or with GuardCreate only if it doesn't exist
+	GuardField     string    `json:"guardField,omitempty"`
+	GuardTimestamp time.Time `json:"guardTimestamp,omitempty"`
+	GuardCreate    bool      `json:"guardCreate,omitempty"`
+}
+
+var deadLetterMu sync.Mutex
+
+// append a write that failed for good to the dead letter file (one JSON object per line)
+// so it can be inspected and replayed instead of vanishing into the logs
+func deadLetterFirestoreWrite(w FirestoreWriteV1, err error) {
+	fmmetrics.recordFailedWrite()
+	entry := FirestoreDeadLetterV1{
+		Timestamp: now(),
+		Path:      w.ref.Path,
+		Merge:     len(w.opts) > 0,
+		Code:      status.Code(err).String(),
+		Error:     err.Error(),
+		Data:      w.data,
+	}
+	if w.guard != nil {
+		entry.GuardField, entry.GuardTimestamp, entry.GuardCreate = w.guard.field, w.guard.at, w.guard.create
+	}
+	line, mErr := json.Marshal(entry)
+	if mErr != nil {
+		log.Errorf("Unable to marshal dead letter for %s: %v", w.ref.Path, mErr)
+		return
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, oErr := os.OpenFile(firestoreDeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if oErr != nil {
+		log.Errorf("Unable to open dead letter file %s, dropping write to %s: %v", firestoreDeadLetterFile, w.ref.Path, oErr)
+		return
+	}
+	defer f.Close()
+	if _, wErr := f.Write(append(line, '\n')); wErr != nil {
+		log.Errorf("Unable to append to dead letter file %s, dropping write to %s: %v", firestoreDeadLetterFile, w.ref.Path, wErr)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryableFirestoreError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unavailable", err: status.Error(codes.Unavailable, "unavailable"), want: true},
+		{name: "deadline exceeded", err: status.Error(codes.DeadlineExceeded, "slow"), want: true},
+		{name: "resource exhausted", err: status.Error(codes.ResourceExhausted, "quota"), want: true},
+		{name: "aborted", err: status.Error(codes.Aborted, "contention"), want: true},
+		{name: "attempt timeout", err: context.DeadlineExceeded, want: true},
+		{name: "invalid argument", err: status.Error(codes.InvalidArgument, "bad doc"), want: false},
+		{name: "permission denied", err: status.Error(codes.PermissionDenied, "nope"), want: false},
+		{name: "plain error", err: errors.New("boom"), want: false},
+	}
+	for _, tc := range tests {
+		if got := retryableFirestoreError(tc.err); got != tc.want {
+			t.Errorf("retryableFirestoreError(%s) = %t, want: %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWithFirestoreRetry(t *testing.T) {
+	firestoreWriteTimeout = time.Second
+	firestoreWriteAttempts = 3
+	firestoreRetryBackoff = time.Millisecond
+	firestoreMaxRetryBackoff = 2 * time.Millisecond
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "first try", errs: []error{nil}, wantAttempts: 1, wantErr: false},
+		{name: "transient then ok", errs: []error{status.Error(codes.Unavailable, ""), nil}, wantAttempts: 2, wantErr: false},
+		{name: "fail fast", errs: []error{status.Error(codes.InvalidArgument, "")}, wantAttempts: 1, wantErr: true},
+		{name: "out of attempts", errs: []error{status.Error(codes.Aborted, ""), status.Error(codes.Aborted, ""), status.Error(codes.Aborted, "")}, wantAttempts: 3, wantErr: true},
+	}
+	for _, tc := range tests {
+		attempts := 0
+		err := withFirestoreRetry(context.Background(), func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("%s: attempt %d has no deadline", tc.name, attempts)
+			}
+			err := tc.errs[attempts]
+			attempts++
+			return err
+		})
+		if attempts != tc.wantAttempts {
+			t.Errorf("%s: withFirestoreRetry() made %d attempts, want: %d", tc.name, attempts, tc.wantAttempts)
+		}
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: withFirestoreRetry() = %v, wantErr: %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// writes left in a sink channel at shutdown are picked up rather than dropped
+func TestDrainFirestoreWrites(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	writes := make(chan FirestoreWriteV1, 3)
+	writes <- FirestoreWriteV1{ref: c.Doc("report_data/a")}
+	writes <- FirestoreWriteV1{ref: c.Doc("report_data/b")}
+	drained := drainFirestoreWrites(writes)
+	if len(drained) != 2 || drained[0].ref.ID != "a" || drained[1].ref.ID != "b" {
+		t.Errorf("drainFirestoreWrites() = %v, want a and b in order", drained)
+	}
+	if len(drainFirestoreWrites(writes)) != 0 {
+		t.Errorf("drainFirestoreWrites() of an empty channel returned writes")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Firestore documents max out at 1 MiB, leave ourselves some headroom
+const fleetSnapshotMaxBytes int = 900 * 1024
+
+// Compact latest position and status of a vehicle within its account's fleet snapshot
+type FleetSnapshotVehicleV1 struct {
+	LatLng          *latlng.LatLng `firestore:"latLng,omitempty"`
+	Heading         float64        `firestore:"heading,omitempty"`
+	Speed           float64        `firestore:"speed"`
+	IsLowBattery    bool           `firestore:"isLowBatteryVoltage,omitempty"`
+	LastReportType  string         `firestore:"type,omitempty"`
+	ReportTimestamp time.Time      `firestore:"reportTimestamp,omitempty"`
+}
+
+// One shard of an account's fleet snapshot at /account/{id}/fleet_snapshot/{shard}.
+// Clients read shardCount from shard 0 and listen to shards 0..shardCount-1.
+type FirestoreFleetSnapshotV1 struct {
+	Shard             int                               `firestore:"shard"`
+	ShardCount        int                               `firestore:"shardCount"`
+	Vehicles          map[string]FleetSnapshotVehicleV1 `firestore:"vehicles"`          // cwDeviceWebId:vehicle
+	SnapshotTimestamp time.Time                         `firestore:"snapshotTimestamp"` // when the snapshot was taken, older ones never replace it
+	SchemaVersion     int                               `firestore:"schemaVersion"`
+	FirestoreUpdate   time.Time                         `firestore:"fsUpdateTimestamp,serverTimestamp"`
+}
+
+// in-memory fleet of every account, written to Firestore at most every FLEET_SNAPSHOT_INTERVAL
+type FleetSnapshotTracker struct {
+	mu       sync.Mutex
+	accounts map[string]*fleetSnapshotAccount // cwAccountId:fleet
+}
+
+type fleetSnapshotAccount struct {
+	vehicles   map[string]FleetSnapshotVehicleV1 // cwDeviceWebId:vehicle
+	dirty      bool                              // changed since our last write
+	seeded     bool                              // existing shards have been read back from Firestore
+	shards     int                               // shards written last time
+	changed    map[string]bool                   // cwDeviceWebId:updated since our last write
+	assignment map[string]int                    // cwDeviceWebId:shard it was last written in
+}
+
+// create a firestore reference location for one shard of an account's fleet snapshot
+func fleetSnapshotReference(c *firestore.Client, cwAccountId string, shard int) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("fleet_snapshot").Doc(strconv.Itoa(shard))
+}
+
+// record a vehicle's new latest state, it's written with the account's next snapshot
+func (t *FleetSnapshotTracker) update(cwAccountId string, cwDeviceWebId string, latest FirestoreVehicleLatestV1) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	account := t.account(cwAccountId)
+	account.vehicles[cwDeviceWebId] = FleetSnapshotVehicleV1{
+		LatLng:          latest.LatLng,
+		Heading:         latest.Heading,
+		Speed:           latest.Speed,
+		IsLowBattery:    latest.IsLowBattery,
+		LastReportType:  latest.LastReportType,
+		ReportTimestamp: latest.ReportTimestamp,
+	}
+	account.changed[cwDeviceWebId] = true
+	account.dirty = true
+}
+
+// fetch or create an account's fleet, t.mu must be held
+func (t *FleetSnapshotTracker) account(cwAccountId string) *fleetSnapshotAccount {
+	if t.accounts == nil {
+		t.accounts = make(map[string]*fleetSnapshotAccount)
+	}
+	account, ok := t.accounts[cwAccountId]
+	if !ok {
+		account = &fleetSnapshotAccount{
+			vehicles:   make(map[string]FleetSnapshotVehicleV1),
+			changed:    make(map[string]bool),
+			assignment: make(map[string]int),
+		}
+		t.accounts[cwAccountId] = account
+	}
+	return account
+}
+
+// write every account that changed since the last tick
+func fleetSnapshotWriter(ctx context.Context, c *firestore.Client) {
+	ticker := time.NewTicker(fleetSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fleetSnapshots.flush(ctx, c)
+		}
+	}
+}
+
+func (t *FleetSnapshotTracker) flush(ctx context.Context, c *firestore.Client) {
+	t.mu.Lock()
+	var dirty []string
+	for cwAccountId, account := range t.accounts {
+		if account.dirty {
+			dirty = append(dirty, cwAccountId)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, cwAccountId := range dirty {
+		t.mu.Lock()
+		seeded := t.accounts[cwAccountId].seeded
+		t.mu.Unlock()
+		if !seeded {
+			// vehicles we haven't heard from since boot are still in the stored snapshot
+			t.seed(ctx, c, cwAccountId)
+		}
+
+		t.mu.Lock()
+		records := t.accounts[cwAccountId].shardWrites(now())
+		t.mu.Unlock()
+
+		// flushes reach Firestore through the sink like everything else, so an older snapshot
+		// could commit after a newer one; the guard keeps the newer shard
+		for _, record := range records {
+			guard := &FirestoreWriteGuardV1{field: "snapshotTimestamp", at: record.SnapshotTimestamp}
+			queueFirestoreWrite(ctx, FirestoreWriteV1{ref: fleetSnapshotReference(c, cwAccountId, record.Shard), data: record, guard: guard})
+		}
+		log.Debugf("Fleet snapshot for account %s written, %d shards changed", cwAccountId, len(records))
+	}
+}
+
+// the shards of an account's snapshot that changed since our last write, taken at a point in time.
+// A shard changed when one of its vehicles was updated or it holds different vehicles than before;
+// when the number of shards changes every shard is written so they agree on shardCount.
+// t.mu must be held.
+func (a *fleetSnapshotAccount) shardWrites(at time.Time) []FirestoreFleetSnapshotV1 {
+	shards := fleetSnapshotShards(a.vehicles)
+	members := make(map[int]int) // shard:vehicles written in it last time
+	for _, shard := range a.assignment {
+		members[shard]++
+	}
+	var records []FirestoreFleetSnapshotV1
+	assignment := make(map[string]int, len(a.vehicles))
+	for i, vehicles := range shards {
+		changed := len(shards) != a.shards || members[i] != len(vehicles)
+		for webId := range vehicles {
+			if shard, ok := a.assignment[webId]; !ok || shard != i || a.changed[webId] {
+				changed = true
+			}
+			assignment[webId] = i
+		}
+		if changed {
+			records = append(records, FirestoreFleetSnapshotV1{Shard: i, ShardCount: len(shards), Vehicles: vehicles, SnapshotTimestamp: at, SchemaVersion: schemaVersionV1})
+		}
+	}
+	// the fleet shrank into fewer shards, empty the ones clients should no longer read
+	for i := len(shards); i < a.shards; i++ {
+		records = append(records, FirestoreFleetSnapshotV1{Shard: i, ShardCount: len(shards), Vehicles: map[string]FleetSnapshotVehicleV1{}, SnapshotTimestamp: at, SchemaVersion: schemaVersionV1})
+	}
+	a.shards = len(shards)
+	a.assignment = assignment
+	a.changed = make(map[string]bool)
+	a.dirty = false
+	return records
+}
+
+// merge an account's stored snapshot shards into our in-memory fleet, newer entries win
+func (t *FleetSnapshotTracker) seed(ctx context.Context, c *firestore.Client, cwAccountId string) {
+	readCtx, cancel := context.WithTimeout(ctx, firestoreWriteTimeout)
+	defer cancel()
+	docs, err := c.Collection("account").Doc(cwAccountId).Collection("fleet_snapshot").Documents(readCtx).GetAll()
+	if err != nil {
+		log.Warnf("Unable to read fleet snapshot for account %s, it will only hold vehicles seen since boot: %v", cwAccountId, err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	account := t.account(cwAccountId)
+	for _, doc := range docs {
+		stored := FirestoreFleetSnapshotV1{}
+		if err := doc.DataTo(&stored); err != nil {
+			log.Warnf("Unable to decode fleet snapshot shard %s: %v", doc.Ref.Path, err)
+			continue
+		}
+		for webId, v := range stored.Vehicles {
+			if current, ok := account.vehicles[webId]; !ok || v.ReportTimestamp.After(current.ReportTimestamp) {
+				account.vehicles[webId] = v
+			}
+		}
+		if stored.Shard+1 > account.shards {
+			account.shards = stored.Shard + 1
+		}
+	}
+	account.seeded = true
+}
+
+// split a fleet into as few shards as fit under fleetSnapshotMaxBytes each,
+// always at least one so clients have a shard 0 to read shardCount from
+func fleetSnapshotShards(vehicles map[string]FleetSnapshotVehicleV1) []map[string]FleetSnapshotVehicleV1 {
+	webIds := make([]string, 0, len(vehicles))
+	for webId := range vehicles {
+		webIds = append(webIds, webId)
+	}
+	sort.Strings(webIds)
+
+	// document name, shard, shardCount, vehicles, snapshotTimestamp and fsUpdateTimestamp fields
+	const shardOverhead = 32 + 100 + (6 + 8) + (11 + 8) + (9) + (18 + 8) + (18 + 8)
+	shards := []map[string]FleetSnapshotVehicleV1{{}}
+	size := shardOverhead
+	for _, webId := range webIds {
+		entry := fleetSnapshotEntrySize(webId, vehicles[webId])
+		if size+entry > fleetSnapshotMaxBytes && len(shards[len(shards)-1]) > 0 {
+			shards = append(shards, map[string]FleetSnapshotVehicleV1{})
+			size = shardOverhead
+		}
+		shards[len(shards)-1][webId] = vehicles[webId]
+		size += entry
+	}
+	return shards
+}
+
+// estimated storage size of a vehicle entry using Firestore's size rules:
+// strings are their UTF-8 length + 1, numbers and timestamps 8, geopoints 16, booleans 1
+func fleetSnapshotEntrySize(webId string, v FleetSnapshotVehicleV1) int {
+	size := len(webId) + 1
+	size += len("latLng") + 1 + 16
+	size += len("heading") + 1 + 8
+	size += len("speed") + 1 + 8
+	size += len("isLowBatteryVoltage") + 1 + 1
+	size += len("type") + 1 + len(v.LastReportType) + 1
+	size += len("reportTimestamp") + 1 + 8
+	return size
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// large fleets need to be split so no shard goes over Firestore's document size limit
+func TestFleetSnapshotShards(t *testing.T) {
+	tests := []struct {
+		name       string
+		vehicles   int
+		wantShards int
+	}{
+		{name: "empty fleet", vehicles: 0, wantShards: 1},
+		{name: "small fleet", vehicles: 250, wantShards: 1},
+		{name: "huge fleet", vehicles: 20000, wantShards: 3},
+	}
+	for _, tc := range tests {
+		vehicles := make(map[string]FleetSnapshotVehicleV1)
+		for i := 0; i < tc.vehicles; i++ {
+			vehicles[fmt.Sprintf("%d", 100000+i)] = FleetSnapshotVehicleV1{LastReportType: "trip_report"}
+		}
+		shards := fleetSnapshotShards(vehicles)
+		if len(shards) != tc.wantShards {
+			t.Errorf("%s: fleetSnapshotShards() = %d shards, want: %d", tc.name, len(shards), tc.wantShards)
+		}
+		total := 0
+		for i, shard := range shards {
+			size := 0
+			for webId, v := range shard {
+				size += fleetSnapshotEntrySize(webId, v)
+			}
+			if size > fleetSnapshotMaxBytes {
+				t.Errorf("%s: shard %d is %d bytes, over the %d byte limit", tc.name, i, size, fleetSnapshotMaxBytes)
+			}
+			total += len(shard)
+		}
+		if total != tc.vehicles {
+			t.Errorf("%s: fleetSnapshotShards() holds %d vehicles, want: %d", tc.name, total, tc.vehicles)
+		}
+	}
+}
+
+// only shards holding updated vehicles, or different vehicles than last time, are written again
+func TestFleetSnapshotShardWrites(t *testing.T) {
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	tracker := FleetSnapshotTracker{}
+	for i := 0; i < 20000; i++ {
+		tracker.update("1001", fmt.Sprintf("%d", 100000+i), FirestoreVehicleLatestV1{LastReportType: "trip_report", ReportTimestamp: at})
+	}
+	account := tracker.account("1001")
+	if records := account.shardWrites(at); len(records) != 3 {
+		t.Fatalf("first shardWrites() = %d shards, want all 3", len(records))
+	}
+	if records := account.shardWrites(at.Add(time.Second)); len(records) != 0 {
+		t.Errorf("shardWrites() with nothing updated = %d shards, want: 0", len(records))
+	}
+
+	// a vehicle in the last shard reports
+	tracker.update("1001", "119999", FirestoreVehicleLatestV1{LastReportType: "status", ReportTimestamp: at.Add(time.Minute)})
+	records := account.shardWrites(at.Add(2 * time.Second))
+	if len(records) != 1 || records[0].Shard != 2 || records[0].ShardCount != 3 {
+		t.Fatalf("shardWrites() after one update = %+v, want only shard 2", records)
+	}
+	if !records[0].SnapshotTimestamp.Equal(at.Add(2 * time.Second)) {
+		t.Errorf("snapshotTimestamp = %v, want: %v", records[0].SnapshotTimestamp, at.Add(2*time.Second))
+	}
+	if records[0].Vehicles["119999"].LastReportType != "status" {
+		t.Errorf("shard 2 vehicle 119999 = %+v, want the status update", records[0].Vehicles["119999"])
+	}
+
+	// the fleet shrinks to one shard, every shard is written with the new count
+	for webId := range account.vehicles {
+		if webId != "100000" {
+			delete(account.vehicles, webId)
+		}
+	}
+	records = account.shardWrites(at.Add(3 * time.Second))
+	if len(records) != 3 || records[0].ShardCount != 1 || len(records[2].Vehicles) != 0 {
+		t.Errorf("shardWrites() after shrinking = %d shards, want 3 with shardCount 1 and the last emptied", len(records))
+	}
+}
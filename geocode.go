@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/list"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Addresses for stop, parking and trip_report positions and trip endpoints come from the place
+// nearest to them (within GEOCODE_MAX_DISTANCE) in a dataset loaded from GEOCODE_DATASET at boot.
+// Nothing is sent to an outside service. Places are bucketed in a grid of geocodeCellDegrees
+// cells, and answers are kept in an LRU cache keyed by the position's 8 character geohash.
+type ReverseGeocoder struct {
+	cells       map[[2]int][]geocodePlace
+	maxDistance float64 // meters
+
+	mu        sync.Mutex
+	cacheSize int
+	lru       *list.List               // most recently used first
+	cache     map[string]*list.Element // geohash:element holding a geocodeCacheEntry
+}
+
+// a place in the geocoding dataset
+type geocodePlace struct {
+	latLng *latlng.LatLng
+	street string
+	city   string
+	region string
+}
+
+type geocodeCacheEntry struct {
+	geohash string
+	address string
+}
+
+// transponder report dataTypes whose position we look up an address for
+var geocodedDataTypes = map[string]bool{
+	"stopped":     true,
+	"parking":     true,
+	"trip_report": true,
+}
+
+// grid cell size of the spatial index, about 1.1km of latitude
+const geocodeCellDegrees float64 = 0.01
+
+// positions within a cache entry's geohash share its answer, 8 characters is about 38m x 19m
+const geocodeCachePrecision int = 8
+
+// read a geocoding dataset in one of the supported formats: csv, a header row naming latitude,
+// longitude, street, city and region columns (street, city and region are optional), or
+// geonames, a GeoNames tab separated dump where places are cities and regions are admin1 codes
+func loadReverseGeocoder(path string, format string, maxDistance float64, cacheSize int) (*ReverseGeocoder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var places []geocodePlace
+	switch format {
+	case "csv":
+		places, err = readGeocodeCsv(f)
+	case "geonames":
+		places, err = readGeoNames(f)
+	default:
+		return nil, fmt.Errorf("unsupported dataset format %q, supported: csv, geonames", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	if len(places) == 0 {
+		return nil, fmt.Errorf("%s has no places", path)
+	}
+	return newReverseGeocoder(places, maxDistance, cacheSize), nil
+}
+
+func readGeocodeCsv(r io.Reader) ([]geocodePlace, error) {
+	rows := csv.NewReader(r)
+	rows.FieldsPerRecord = -1
+	header, err := rows.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	latCol, latOk := columns["latitude"]
+	lngCol, lngOk := columns["longitude"]
+	if !latOk || !lngOk {
+		return nil, fmt.Errorf("header needs latitude and longitude columns, got %v", header)
+	}
+	column := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ``
+	}
+	var places []geocodePlace
+	for line := 2; ; line++ {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return places, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, ok := newGeocodePlace(column(row, header[latCol]), column(row, header[lngCol]))
+		if !ok {
+			return nil, fmt.Errorf("line %d: bad position %v", line, row)
+		}
+		p.street, p.city, p.region = column(row, "street"), column(row, "city"), column(row, "region")
+		places = append(places, p)
+	}
+}
+
+// GeoNames dump columns: geonameid, name, asciiname, alternatenames, latitude, longitude,
+// feature class, feature code, country code, cc2, admin1 code, ...
+func readGeoNames(r io.Reader) ([]geocodePlace, error) {
+	rows := csv.NewReader(r)
+	rows.Comma = '\t'
+	rows.LazyQuotes = true
+	rows.FieldsPerRecord = -1
+	var places []geocodePlace
+	for line := 1; ; line++ {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return places, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 11 {
+			return nil, fmt.Errorf("line %d: %d columns, want at least 11", line, len(row))
+		}
+		p, ok := newGeocodePlace(row[4], row[5])
+		if !ok {
+			return nil, fmt.Errorf("line %d: bad position %s,%s", line, row[4], row[5])
+		}
+		p.city = row[1]
+		p.region = row[10]
+		if row[8] != "" {
+			p.region = strings.TrimPrefix(row[10]+", "+row[8], ", ")
+		}
+		places = append(places, p)
+	}
+}
+
+func newGeocodePlace(lat string, lng string) (geocodePlace, bool) {
+	latitude, latErr := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	longitude, lngErr := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+	if latErr != nil || lngErr != nil || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return geocodePlace{}, false
+	}
+	return geocodePlace{latLng: &latlng.LatLng{Latitude: latitude, Longitude: longitude}}, true
+}
+
+func newReverseGeocoder(places []geocodePlace, maxDistance float64, cacheSize int) *ReverseGeocoder {
+	g := &ReverseGeocoder{
+		cells:       make(map[[2]int][]geocodePlace),
+		maxDistance: maxDistance,
+		cacheSize:   cacheSize,
+		lru:         list.New(),
+		cache:       make(map[string]*list.Element),
+	}
+	for _, p := range places {
+		cell := geocodeCell(p.latLng.Latitude, p.latLng.Longitude)
+		g.cells[cell] = append(g.cells[cell], p)
+	}
+	return g
+}
+
+func geocodeCell(lat float64, lng float64) [2]int {
+	return [2]int{int(math.Floor(lat / geocodeCellDegrees)), int(math.Floor(lng / geocodeCellDegrees))}
+}
+
+// the place nearest to a position, no further than maxDistance
+func (g *ReverseGeocoder) nearest(p *latlng.LatLng) (nearest geocodePlace, ok bool) {
+	// every cell a place within maxDistance could be in, longitude degrees shrink away from the equator
+	latCells := int(math.Ceil(g.maxDistance / metersPerDegree / geocodeCellDegrees))
+	lngCells := latCells
+	if cos := math.Cos(p.Latitude * math.Pi / 180); cos > 0.01 {
+		lngCells = int(math.Ceil(g.maxDistance / (metersPerDegree * cos) / geocodeCellDegrees))
+	}
+	center := geocodeCell(p.Latitude, p.Longitude)
+	best := g.maxDistance
+	for dLat := -latCells; dLat <= latCells; dLat++ {
+		for dLng := -lngCells; dLng <= lngCells; dLng++ {
+			for _, place := range g.cells[[2]int{center[0] + dLat, center[1] + dLng}] {
+				if d := haversineMeters(p, place.latLng); d <= best {
+					best, nearest, ok = d, place, true
+				}
+			}
+		}
+	}
+	return nearest, ok
+}
+
+// "street, city, region", leaving out whatever the place doesn't have
+func (p geocodePlace) address() string {
+	var parts []string
+	for _, part := range []string{p.street, p.city, p.region} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// the address of a position, empty when no place is close enough
+func (g *ReverseGeocoder) address(p *latlng.LatLng) string {
+	if g == nil || p == nil {
+		return ``
+	}
+	hash := encodeGeohash(p.Latitude, p.Longitude, geocodeCachePrecision)
+	g.mu.Lock()
+	if e, ok := g.cache[hash]; ok {
+		g.lru.MoveToFront(e)
+		g.mu.Unlock()
+		return e.Value.(geocodeCacheEntry).address
+	}
+	g.mu.Unlock()
+
+	address := ``
+	if place, ok := g.nearest(p); ok {
+		address = place.address()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.cache[hash]; !ok && g.cacheSize > 0 {
+		g.cache[hash] = g.lru.PushFront(geocodeCacheEntry{geohash: hash, address: address})
+		if g.lru.Len() > g.cacheSize {
+			oldest := g.lru.Back()
+			g.lru.Remove(oldest)
+			delete(g.cache, oldest.Value.(geocodeCacheEntry).geohash)
+		}
+	}
+	return address
+}
+
+// fill in the address of a stop, parking or trip_report position
+func geocodeReport(record *FirestoreTransponderReportV1) {
+	if reverseGeocoder == nil || !geocodedDataTypes[record.Type] || record.LatLng == nil || record.Address != "" {
+		return
+	}
+	record.Address = reverseGeocoder.address(record.LatLng)
+}
+
+// fill in the addresses of a trip's endpoints
+func geocodeTrip(trip *FirestoreTripV1) {
+	if reverseGeocoder == nil {
+		return
+	}
+	trip.StartAddress = reverseGeocoder.address(trip.StartLatLng)
+	trip.EndAddress = reverseGeocoder.address(trip.EndLatLng)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func testReverseGeocoder(t *testing.T, maxDistance float64, cacheSize int) *ReverseGeocoder {
+	g, err := loadReverseGeocoder(filepath.Join("testdata", "geocode", "places.csv"), "csv", maxDistance, cacheSize)
+	if err != nil {
+		t.Fatalf("loadReverseGeocoder() error: %v", err)
+	}
+	return g
+}
+
+// positions get the address of the nearest place within GEOCODE_MAX_DISTANCE
+func TestReverseGeocoderAddress(t *testing.T) {
+	g := testReverseGeocoder(t, 1000, 100)
+	tests := []struct {
+		name string
+		at   *latlng.LatLng
+		want string
+	}{
+		{"city hall", &latlng.LatLng{Latitude: 37.7790, Longitude: -122.4190}, "1 Dr Carlton B Goodlett Pl, San Francisco, CA"},
+		{"ferry building", &latlng.LatLng{Latitude: 37.7950, Longitude: -122.3945}, "1 Ferry Building, San Francisco, CA"},
+		{"across a cell edge", &latlng.LatLng{Latitude: 37.7995, Longitude: -122.2701}, "1 Frank H Ogawa Plaza, Oakland, CA"},
+		{"no street", &latlng.LatLng{Latitude: 37.3380, Longitude: -121.8860}, "San Jose, CA"},
+		{"too far", &latlng.LatLng{Latitude: 37.5000, Longitude: -122.2000}, ""},
+		{"no position", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := g.address(tt.at); got != tt.want {
+			t.Errorf("%s: address() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	var none *ReverseGeocoder
+	if got := none.address(tests[0].at); got != "" {
+		t.Errorf("nil geocoder address() = %q", got)
+	}
+}
+
+// the cache keeps the most recently used answers, misses included
+func TestReverseGeocoderCache(t *testing.T) {
+	g := testReverseGeocoder(t, 1000, 2)
+	cityHall := &latlng.LatLng{Latitude: 37.7790, Longitude: -122.4190}
+	ferry := &latlng.LatLng{Latitude: 37.7950, Longitude: -122.3945}
+	nowhere := &latlng.LatLng{Latitude: 37.5000, Longitude: -122.2000}
+	g.address(cityHall)
+	g.address(ferry)
+	g.address(cityHall)
+	g.address(nowhere) // evicts ferry, the least recently used
+	if g.lru.Len() != 2 {
+		t.Fatalf("cache holds %d answers, want 2", g.lru.Len())
+	}
+	for at, want := range map[*latlng.LatLng]bool{cityHall: true, ferry: false, nowhere: true} {
+		if _, ok := g.cache[encodeGeohash(at.Latitude, at.Longitude, geocodeCachePrecision)]; ok != want {
+			t.Errorf("%v cached = %v, want %v", at, ok, want)
+		}
+	}
+	// cached answers are served without the index
+	g.cells = nil
+	if got := g.address(cityHall); !strings.HasPrefix(got, "1 Dr Carlton B Goodlett Pl") {
+		t.Errorf("cached address() = %q", got)
+	}
+}
+
+// GeoNames dumps give city, admin1 code and country
+func TestReadGeoNames(t *testing.T) {
+	g, err := loadReverseGeocoder(filepath.Join("testdata", "geocode", "cities.tsv"), "geonames", 5000, 10)
+	if err != nil {
+		t.Fatalf("loadReverseGeocoder() error: %v", err)
+	}
+	if got := g.address(&latlng.LatLng{Latitude: 37.8000, Longitude: -122.2750}); got != "Oakland, CA, US" {
+		t.Errorf("address() = %q, want Oakland, CA, US", got)
+	}
+	if _, err := loadReverseGeocoder(filepath.Join("testdata", "geocode", "cities.tsv"), "shapefile", 5000, 10); err == nil {
+		t.Errorf("loadReverseGeocoder() accepted an unknown format")
+	}
+	if _, err := loadReverseGeocoder(filepath.Join("testdata", "geocode", "cities.tsv"), "csv", 5000, 10); err == nil {
+		t.Errorf("loadReverseGeocoder() read a GeoNames dump as csv")
+	}
+}
+
+// only stops, parking and trip reports are geocoded, and only when a dataset is loaded
+func TestGeocodeReport(t *testing.T) {
+	defer func(g *ReverseGeocoder) { reverseGeocoder = g }(reverseGeocoder)
+	at := &latlng.LatLng{Latitude: 37.7790, Longitude: -122.4190}
+	reverseGeocoder = nil
+	record := FirestoreTransponderReportV1{Type: "parking", LatLng: at}
+	geocodeReport(&record)
+	if record.Address != "" {
+		t.Errorf("geocoded %q without a dataset", record.Address)
+	}
+
+	reverseGeocoder = testReverseGeocoder(t, 1000, 100)
+	for dataType, want := range map[string]bool{"stopped": true, "parking": true, "trip_report": true, "status": false, "hard_braking": false} {
+		record := FirestoreTransponderReportV1{Type: dataType, LatLng: at}
+		geocodeReport(&record)
+		if (record.Address != "") != want {
+			t.Errorf("%s report address = %q", dataType, record.Address)
+		}
+	}
+	trip := FirestoreTripV1{StartLatLng: at, EndLatLng: &latlng.LatLng{Latitude: 37.8044, Longitude: -122.2712}}
+	geocodeTrip(&trip)
+	if !strings.Contains(trip.StartAddress, "San Francisco") || !strings.Contains(trip.EndAddress, "Oakland") {
+		t.Errorf("trip addresses = %q, %q", trip.StartAddress, trip.EndAddress)
+	}
+}
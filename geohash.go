@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Firestore can't range query a GeoPoint, so every positioned record also carries its geohash.
+// The full precision hash in g10 supports range queries at any precision (see geohashQueries),
+// the shorter ones are there for equality and "in" queries on a whole area.
+type GeohashesV1 struct {
+	G4  string `firestore:"g4"`  // ~39km x 19km cells
+	G6  string `firestore:"g6"`  // ~1.2km x 0.6km cells
+	G8  string `firestore:"g8"`  // ~38m x 19m cells
+	G10 string `firestore:"g10"` // ~1.2m x 0.6m cells
+}
+
+// field holding a record's full precision geohash, for geohashQueries
+const geohashField string = "geohash.g10"
+
+const geohashBase32 string = "0123456789bcdefghjkmnpqrstuvwxyz"
+const geohashMaxPrecision int = 10
+
+// meters per degree of latitude
+const metersPerDegree float64 = 111320
+
+// geohashes of a position at every precision we store, nil for records without one
+func geohashes(g *latlng.LatLng) *GeohashesV1 {
+	if g == nil {
+		return nil
+	}
+	full := encodeGeohash(g.Latitude, g.Longitude, geohashMaxPrecision)
+	return &GeohashesV1{G4: full[:4], G6: full[:6], G8: full[:8], G10: full}
+}
+
+// standard base32 geohash of a position, interleaving longitude and latitude bits
+func encodeGeohash(lat float64, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(hash) < precision {
+		var r *[2]float64
+		v := lat
+		if even {
+			r, v = &lngRange, lng
+		} else {
+			r = &latRange
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// height and width in degrees of a geohash cell
+func geohashCellDegrees(precision int) (lat float64, lng float64) {
+	bits := 5 * precision
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lngBits))
+}
+
+// A [start, end) range of geohashes, every hash with the given prefix
+type GeohashRangeV1 struct {
+	start string
+	end   string
+}
+
+// geohash ranges covering every point within radiusMeters of a center: the cell holding the
+// center and its 8 neighbours, at the finest precision whose cells are at least radiusMeters
+// across. Results are boxes, so callers still need to drop matches further than radiusMeters.
+func geohashQueryRanges(lat float64, lng float64, radiusMeters float64) []GeohashRangeV1 {
+	precision := 0
+	for p := geohashMaxPrecision; p >= 1; p-- {
+		latDeg, lngDeg := geohashCellDegrees(p)
+		height := latDeg * metersPerDegree
+		width := lngDeg * metersPerDegree * math.Cos(lat*math.Pi/180)
+		if math.Min(height, width) >= radiusMeters {
+			precision = p
+			break
+		}
+	}
+	if precision == 0 {
+		// bigger than the coarsest cells, everything is a candidate
+		return []GeohashRangeV1{{start: "", end: "~"}}
+	}
+
+	latDeg, lngDeg := geohashCellDegrees(precision)
+	seen := make(map[string]bool)
+	for _, dLat := range []float64{-latDeg, 0, latDeg} {
+		for _, dLng := range []float64{-lngDeg, 0, lngDeg} {
+			cellLat := math.Max(-90, math.Min(90, lat+dLat))
+			cellLng := math.Mod(lng+dLng+540, 360) - 180 // wrap across the antimeridian
+			seen[encodeGeohash(cellLat, cellLng, precision)] = true
+		}
+	}
+	ranges := make([]GeohashRangeV1, 0, len(seen))
+	for prefix := range seen {
+		// '~' sorts after every base32 character
+		ranges = append(ranges, GeohashRangeV1{start: prefix, end: prefix + "~"})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	return ranges
+}
+
+// turn a center and radius into one range query per geohash range on top of base,
+// ex geohashQueries(c.CollectionGroup("state"), 41.41, -70.58, 5000)
+func geohashQueries(base firestore.Query, lat float64, lng float64, radiusMeters float64) []firestore.Query {
+	var queries []firestore.Query
+	for _, r := range geohashQueryRanges(lat, lng, radiusMeters) {
+		queries = append(queries, base.Where(geohashField, ">=", r.start).Where(geohashField, "<", r.end).OrderBy(geohashField, firestore.Asc))
+	}
+	return queries
+}
+
+// run geohashQueries and keep the documents whose latLngField is really within radiusMeters,
+// ex "vehicles near here": nearbyDocuments(ctx, c.CollectionGroup("state"), "latLng", 41.41, -70.58, 5000)
+func nearbyDocuments(ctx context.Context, base firestore.Query, latLngField string, lat float64, lng float64, radiusMeters float64) ([]*firestore.DocumentSnapshot, error) {
+	center := &latlng.LatLng{Latitude: lat, Longitude: lng}
+	var nearby []*firestore.DocumentSnapshot
+	seen := make(map[string]bool)
+	for _, q := range geohashQueries(base, lat, lng, radiusMeters) {
+		docs, err := q.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			v, err := doc.DataAt(latLngField)
+			if err != nil || seen[doc.Ref.Path] {
+				continue
+			}
+			if g, ok := v.(*latlng.LatLng); ok && haversineMeters(center, g) <= radiusMeters {
+				seen[doc.Ref.Path] = true
+				nearby = append(nearby, doc)
+			}
+		}
+	}
+	return nearby, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		lat, lng  float64
+		precision int
+		want      string
+	}{
+		{lat: 57.64911, lng: 10.40744, precision: 11, want: "u4pruydqqvj"},
+		{lat: 42.6, lng: -5.6, precision: 5, want: "ezs42"},
+		{lat: -25.382708, lng: -49.265506, precision: 8, want: "6gkzwgjz"},
+		{lat: 0, lng: 0, precision: 1, want: "s"},
+	}
+	for _, tc := range tests {
+		if got := encodeGeohash(tc.lat, tc.lng, tc.precision); got != tc.want {
+			t.Errorf("encodeGeohash(%v, %v, %d) = %s, want: %s", tc.lat, tc.lng, tc.precision, got, tc.want)
+		}
+	}
+	g := geohashes(&latlng.LatLng{Latitude: 57.64911, Longitude: 10.40744})
+	if g.G4 != "u4pr" || g.G6 != "u4pruy" || g.G8 != "u4pruydq" || g.G10 != "u4pruydqqv" {
+		t.Errorf("geohashes() = %+v, want prefixes of u4pruydqqv", g)
+	}
+	if geohashes(nil) != nil {
+		t.Errorf("geohashes(nil) != nil")
+	}
+}
+
+// every point within the radius has to land in one of the ranges
+func TestGeohashQueryRanges(t *testing.T) {
+	centers := []struct{ lat, lng float64 }{
+		{lat: 41.418956, lng: -70.587768},
+		{lat: -33.8688, lng: 151.2093},
+		{lat: 12.5, lng: 179.999}, // next to the antimeridian
+	}
+	for _, center := range centers {
+		for _, radius := range []float64{50, 1000, 25000} {
+			ranges := geohashQueryRanges(center.lat, center.lng, radius)
+			if len(ranges) == 0 || len(ranges) > 9 {
+				t.Fatalf("geohashQueryRanges(%v, %v, %v) = %d ranges, want 1-9", center.lat, center.lng, radius, len(ranges))
+			}
+			// walk the circle's edge
+			for deg := 0; deg < 360; deg += 15 {
+				bearing := float64(deg) * math.Pi / 180
+				dLat := radius * 0.99 * math.Cos(bearing) / metersPerDegree
+				dLng := radius * 0.99 * math.Sin(bearing) / (metersPerDegree * math.Cos(center.lat*math.Pi/180))
+				lng := math.Mod(center.lng+dLng+540, 360) - 180
+				hash := encodeGeohash(center.lat+dLat, lng, geohashMaxPrecision)
+				covered := false
+				for _, r := range ranges {
+					if hash >= r.start && hash < r.end && strings.HasPrefix(hash, r.start) {
+						covered = true
+					}
+				}
+				if !covered {
+					t.Errorf("geohashQueryRanges(%v, %v, %v) doesn't cover %s at bearing %d", center.lat, center.lng, radius, hash, deg)
+				}
+			}
+		}
+	}
+	if ranges := geohashQueryRanges(0, 0, 10000000); len(ranges) != 1 || ranges[0].start != "" {
+		t.Errorf("geohashQueryRanges() of a huge radius = %v, want one range covering everything", ranges)
+	}
+}
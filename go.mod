@@ -8,5 +8,7 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/joonix/log v0.0.0-20200409080653-9c1d2ceb5f1d
 	github.com/sirupsen/logrus v1.8.0
+	google.golang.org/api v0.36.0
 	google.golang.org/genproto v0.0.0-20201203001206-6486ece9c497
+	google.golang.org/grpc v1.33.2
 )
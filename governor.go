@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// how often the governor hands writes that are due on to the batch writers
+const firestoreGovernorTick time.Duration = 100 * time.Millisecond
+
+// Sits between queueFirestoreWrite and the batch writers. Firestore sustains about one write per
+// second to a single document, so writes to a document are held until FIRESTORE_DOC_WRITE_INTERVAL
+// has passed since its last write, and coalesced with whatever else arrives for it in the meantime.
+// All writes together are kept under FIRESTORE_MAX_WRITE_RATE writes per second.
+type FirestoreWriteGovernor struct {
+	pending     map[string][]FirestoreWriteV1 // document path:writes waiting, in the order they must be applied
+	order       []string                      // document paths with pending writes, oldest first
+	lastRelease map[string]time.Time          // document path:last time a write to it was released
+	tokens      float64                       // writes we may release right now under the global rate
+	lastRefill  time.Time
+}
+
+func newFirestoreWriteGovernor(at time.Time) *FirestoreWriteGovernor {
+	return &FirestoreWriteGovernor{
+		pending:     make(map[string][]FirestoreWriteV1),
+		lastRelease: make(map[string]time.Time),
+		tokens:      float64(firestoreMaxWriteRate),
+		lastRefill:  at,
+	}
+}
+
+// queue a write, folding it into writes already waiting on the same document where
+// the end result is the same. Returns the number of writes it made redundant.
+func (g *FirestoreWriteGovernor) add(w FirestoreWriteV1) int {
+	path := w.ref.Path
+	waiting, ok := g.pending[path]
+	if !ok {
+		g.pending[path] = []FirestoreWriteV1{w}
+		g.order = append(g.order, path)
+		return 0
+	}
+	last := waiting[len(waiting)-1]
+	if olderGuardedWrite(w, last) {
+		// ordered writes that show up late don't get to replace newer ones
+		return 1
+	}
+	if len(w.opts) == 0 {
+		// a full Set replaces the document, nothing queued before it matters
+		g.pending[path] = []FirestoreWriteV1{w}
+		return len(waiting)
+	}
+	if merged, ok := mergeFirestoreWrites(last, w); ok {
+		waiting[len(waiting)-1] = merged
+		return 1
+	}
+	g.pending[path] = append(waiting, w)
+	return 0
+}
+
+// writes due for release at a point in time, respecting the per-document and global limits
+func (g *FirestoreWriteGovernor) ready(at time.Time) []FirestoreWriteV1 {
+	unlimited := firestoreMaxWriteRate <= 0
+	if !unlimited {
+		g.tokens += at.Sub(g.lastRefill).Seconds() * float64(firestoreMaxWriteRate)
+		if g.tokens > float64(firestoreMaxWriteRate) {
+			g.tokens = float64(firestoreMaxWriteRate)
+		}
+	}
+	g.lastRefill = at
+
+	var released []FirestoreWriteV1
+	remaining := g.order[:0]
+	for i, path := range g.order {
+		if !unlimited && g.tokens < 1 {
+			remaining = append(remaining, g.order[i:]...)
+			break
+		}
+		if last, ok := g.lastRelease[path]; ok && at.Sub(last) < firestoreDocWriteInterval {
+			remaining = append(remaining, path)
+			continue
+		}
+		waiting := g.pending[path]
+		released = append(released, waiting[0])
+		g.lastRelease[path] = at
+		g.tokens--
+		if len(waiting) > 1 {
+			g.pending[path] = waiting[1:]
+			remaining = append(remaining, path)
+		} else {
+			delete(g.pending, path)
+		}
+	}
+	g.order = remaining
+
+	// documents that haven't been written to for a while are free to write again
+	for path, last := range g.lastRelease {
+		if _, waiting := g.pending[path]; !waiting && at.Sub(last) >= firestoreDocWriteInterval {
+			delete(g.lastRelease, path)
+		}
+	}
+	return released
+}
+
+// everything still waiting, regardless of limits, for a final flush at shutdown
+func (g *FirestoreWriteGovernor) drain() []FirestoreWriteV1 {
+	var writes []FirestoreWriteV1
+	for _, path := range g.order {
+		writes = append(writes, g.pending[path]...)
+		delete(g.pending, path)
+	}
+	g.order = g.order[:0]
+	return writes
+}
+
+// number of writes waiting
+func (g *FirestoreWriteGovernor) size() int {
+	n := 0
+	for _, waiting := range g.pending {
+		n += len(waiting)
+	}
+	return n
+}
+
+// two MergeAll writes of plain maps to the same document can become one, as long as
+// a top-level field they share isn't a map (MergeAll merges nested maps field by field)
+func mergeFirestoreWrites(first FirestoreWriteV1, second FirestoreWriteV1) (FirestoreWriteV1, bool) {
+	if !mergeAllWrite(first) || !mergeAllWrite(second) || first.guard != nil || second.guard != nil {
+		return first, false
+	}
+	a, aOk := first.data.(map[string]interface{})
+	b, bOk := second.data.(map[string]interface{})
+	if !aOk || !bOk {
+		return first, false
+	}
+	merged := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		if prev, shared := merged[k]; shared {
+			if _, nested := prev.(map[string]interface{}); nested {
+				return first, false
+			}
+			if _, nested := v.(map[string]interface{}); nested {
+				return first, false
+			}
+		}
+		merged[k] = v
+	}
+	return FirestoreWriteV1{ref: second.ref, data: merged, opts: second.opts}, true
+}
+
+// whether a write is ordered by the same field as one already waiting, and older than it
+func olderGuardedWrite(w FirestoreWriteV1, waiting FirestoreWriteV1) bool {
+	if w.guard == nil || waiting.guard == nil || w.guard.create || waiting.guard.create {
+		return false
+	}
+	return w.guard.field == waiting.guard.field && w.guard.at.Before(waiting.guard.at)
+}
+
+func mergeAllWrite(w FirestoreWriteV1) bool {
+	// SetOption values aren't comparable with ==
+	return len(w.opts) == 1 && reflect.DeepEqual(w.opts[0], firestore.MergeAll)
+}
+
+// batch writer a document's writes go to, always the same one so they commit in order
+func firestoreBatchWriterFor(path string, writers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(writers))
+}
+
+// hand writes to a batch writer without waiting on it, returning the ones it had no room for
+func handOffFirestoreWrites(writer chan<- FirestoreWriteV1, writes []FirestoreWriteV1) []FirestoreWriteV1 {
+	for i, w := range writes {
+		select {
+		case writer <- w:
+		default:
+			return writes[i:]
+		}
+	}
+	return nil
+}
+
+// run the governor for as long as we're running, handing due writes to the batch writers.
+// A batch writer that's busy committing or retrying doesn't hold up the others or our intake,
+// its writes wait in a backlog of their own until it has room.
+func firestoreWriteGovernor(ctx context.Context, c *firestore.Client) {
+	defer firestoreSinkDone.Done()
+	g := newFirestoreWriteGovernor(now())
+	ticker := time.NewTicker(firestoreGovernorTick)
+	defer ticker.Stop()
+	backlogs := make([][]FirestoreWriteV1, len(firestoreGovernedWrites)) // per batch writer, in release order
+	backlogged := func() int {
+		n := 0
+		for _, backlog := range backlogs {
+			n += len(backlog)
+		}
+		return n
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// producers that were mid hand-off still count
+			for _, w := range drainFirestoreWrites(firestoreWrites) {
+				g.add(w)
+			}
+			var unsent []FirestoreWriteV1
+			for _, backlog := range backlogs {
+				unsent = append(unsent, backlog...)
+			}
+			// what we already handed a batch writer was released before our backlog,
+			// it has to land first or a document's writes could commit out of order
+			firestoreBatchWritersDone.Wait()
+			governorShutdownFlush(c, append(unsent, g.drain()...))
+			return
+		case w := <-firestoreWrites:
+			coalesced := g.add(w)
+			fmmetrics.recordGovernedWrite(coalesced, g.size()+backlogged())
+		case <-ticker.C:
+			for _, w := range g.ready(now()) {
+				i := firestoreBatchWriterFor(w.ref.Path, len(backlogs))
+				backlogs[i] = append(backlogs[i], w)
+			}
+			for i := range backlogs {
+				backlogs[i] = handOffFirestoreWrites(firestoreGovernedWrites[i], backlogs[i])
+			}
+		}
+	}
+}
+
+// the batch writers have made their final flushes, commit what's left ourselves
+func governorShutdownFlush(c *firestore.Client, writes []FirestoreWriteV1) {
+	if len(writes) == 0 {
+		return
+	}
+	log.Infof("Firestore write governor flushing %d writes at shutdown", len(writes))
+	flushCtx, cancel := context.WithTimeout(context.Background(), firestoreShutdownTimeout)
+	defer cancel()
+	// a document is written at most once per batch, later writes to it go in a later batch
+	var batch []FirestoreWriteV1
+	paths := make(map[string]bool)
+	for _, w := range writes {
+		if len(batch) >= firestoreBatchSize || paths[w.ref.Path] {
+			commitFirestoreBatch(flushCtx, c, batch)
+			batch = nil
+			paths = make(map[string]bool)
+		}
+		batch = append(batch, w)
+		paths[w.ref.Path] = true
+	}
+	commitFirestoreBatch(flushCtx, c, batch)
+}
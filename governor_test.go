@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestFirestoreWriteGovernor(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	firestoreDocWriteInterval = time.Second
+	firestoreMaxWriteRate = 0
+	start := time.Date(2021, 2, 17, 15, 0, 0, 0, time.UTC)
+	latest := c.Doc("account/12/vehicle/34/state/latest")
+	live := c.Doc("live_request/abc")
+	report := c.Doc("account/12/vehicle/34/report_data/xyz")
+
+	g := newFirestoreWriteGovernor(start)
+	g.add(FirestoreWriteV1{ref: latest, data: FirestoreVehicleLatestV1{Speed: 1}})
+	g.add(FirestoreWriteV1{ref: report, data: FirestoreTransponderReportV1{}})
+	released := g.ready(start)
+	if len(released) != 2 {
+		t.Fatalf("ready() = %d writes, want: 2", len(released))
+	}
+
+	// the latest state is written again within a second, only the newest survives
+	if n := g.add(FirestoreWriteV1{ref: latest, data: FirestoreVehicleLatestV1{Speed: 2}}); n != 0 {
+		t.Errorf("add() of a first pending write coalesced %d writes, want: 0", n)
+	}
+	if n := g.add(FirestoreWriteV1{ref: latest, data: FirestoreVehicleLatestV1{Speed: 3}}); n != 1 {
+		t.Errorf("add() of a replacing write coalesced %d writes, want: 1", n)
+	}
+	if released := g.ready(start.Add(500 * time.Millisecond)); len(released) != 0 {
+		t.Errorf("ready() within the document interval = %d writes, want: 0", len(released))
+	}
+	released = g.ready(start.Add(time.Second))
+	if len(released) != 1 || released[0].data.(FirestoreVehicleLatestV1).Speed != 3 {
+		t.Errorf("ready() after the document interval = %v, want the newest latest state", released)
+	}
+
+	// merge writes of plain maps fold together, nested maps stay apart
+	merge := []firestore.SetOption{firestore.MergeAll}
+	g.add(FirestoreWriteV1{ref: live, data: map[string]interface{}{"a": 1, "b": 1}, opts: merge})
+	if n := g.add(FirestoreWriteV1{ref: live, data: map[string]interface{}{"b": 2, "c": 2}, opts: merge}); n != 1 {
+		t.Errorf("add() of a mergeable write coalesced %d writes, want: 1", n)
+	}
+	if n := g.add(FirestoreWriteV1{ref: live, data: map[string]interface{}{"c": map[string]interface{}{"d": 1}}, opts: merge}); n != 0 {
+		t.Errorf("add() of a nested map merge coalesced %d writes, want: 0", n)
+	}
+	released = g.ready(start.Add(2 * time.Second))
+	want := map[string]interface{}{"a": 1, "b": 2, "c": 2}
+	if len(released) != 1 || len(released[0].data.(map[string]interface{})) != len(want) {
+		t.Fatalf("ready() = %v, want one merged write %v", released, want)
+	}
+	for k, v := range want {
+		if got := released[0].data.(map[string]interface{})[k]; got != v {
+			t.Errorf("merged write %s = %v, want: %v", k, got, v)
+		}
+	}
+	if g.size() != 1 {
+		t.Errorf("size() = %d, want the nested merge still waiting", g.size())
+	}
+	if drained := g.drain(); len(drained) != 1 || g.size() != 0 {
+		t.Errorf("drain() = %d writes leaving %d, want: 1 leaving 0", len(drained), g.size())
+	}
+}
+
+func TestFirestoreWriteGovernorRate(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	firestoreDocWriteInterval = time.Second
+	firestoreMaxWriteRate = 10
+	start := time.Date(2021, 2, 17, 15, 0, 0, 0, time.UTC)
+	g := newFirestoreWriteGovernor(start)
+	for i := 0; i < 25; i++ {
+		g.add(FirestoreWriteV1{ref: c.Collection("report_data").NewDoc(), data: FirestoreTransponderReportV1{}})
+	}
+	if released := g.ready(start); len(released) != 10 {
+		t.Errorf("ready() with a full bucket = %d writes, want: 10", len(released))
+	}
+	if released := g.ready(start.Add(500 * time.Millisecond)); len(released) != 5 {
+		t.Errorf("ready() half a second later = %d writes, want: 5", len(released))
+	}
+}
+
+// ordered writes that arrive late don't replace newer ones waiting on the same document
+func TestFirestoreWriteGovernorGuard(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	firestoreDocWriteInterval = time.Second
+	firestoreMaxWriteRate = 0
+	start := time.Date(2021, 2, 17, 15, 0, 0, 0, time.UTC)
+	latest := c.Doc("account/12/vehicle/34/state/latest")
+	guarded := func(speed float64, at time.Time) FirestoreWriteV1 {
+		return FirestoreWriteV1{ref: latest, data: FirestoreVehicleLatestV1{Speed: speed}, guard: &FirestoreWriteGuardV1{field: "reportTimestamp", at: at}}
+	}
+
+	g := newFirestoreWriteGovernor(start)
+	g.add(guarded(1, start.Add(2*time.Second)))
+	if n := g.add(guarded(2, start.Add(time.Second))); n != 1 {
+		t.Errorf("add() of an older guarded write coalesced %d writes, want: 1", n)
+	}
+	if n := g.add(guarded(3, start.Add(3*time.Second))); n != 1 {
+		t.Errorf("add() of a newer guarded write coalesced %d writes, want: 1", n)
+	}
+	released := g.ready(start)
+	if len(released) != 1 || released[0].data.(FirestoreVehicleLatestV1).Speed != 3 || released[0].guard == nil {
+		t.Errorf("ready() = %v, want the newest guarded write", released)
+	}
+
+	// guarded merges keep their own guard
+	merge := []firestore.SetOption{firestore.MergeAll}
+	a := FirestoreWriteV1{ref: latest, data: map[string]interface{}{"a": 1}, opts: merge, guard: &FirestoreWriteGuardV1{create: true}}
+	b := FirestoreWriteV1{ref: latest, data: map[string]interface{}{"b": 1}, opts: merge}
+	if _, ok := mergeFirestoreWrites(a, b); ok {
+		t.Errorf("mergeFirestoreWrites() folded a guarded write")
+	}
+	if (&FirestoreWriteGuardV1{create: true}).stale(nil) {
+		t.Errorf("stale() of a missing document = true, want: false")
+	}
+}
+
+// a document always goes to the same batch writer, and a full writer doesn't block the hand-off
+func TestFirestoreBatchWriterHandOff(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	path := c.Doc("account/12/vehicle/34/state/latest").Path
+	writer := firestoreBatchWriterFor(path, 2)
+	for i := 0; i < 10; i++ {
+		if got := firestoreBatchWriterFor(path, 2); got != writer {
+			t.Fatalf("firestoreBatchWriterFor(%s) = %d, then %d", path, writer, got)
+		}
+	}
+	used := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		used[firestoreBatchWriterFor(c.Collection("report_data").NewDoc().Path, 2)] = true
+	}
+	if len(used) != 2 {
+		t.Errorf("50 documents went to %d batch writers, want both used", len(used))
+	}
+
+	ch := make(chan FirestoreWriteV1, 2)
+	writes := []FirestoreWriteV1{{ref: c.Doc("report_data/a")}, {ref: c.Doc("report_data/b")}, {ref: c.Doc("report_data/c")}}
+	left := handOffFirestoreWrites(ch, writes)
+	if len(ch) != 2 || len(left) != 1 || left[0].ref.ID != "c" {
+		t.Errorf("handOffFirestoreWrites() into room for 2 left %v, want only c", left)
+	}
+	if left := handOffFirestoreWrites(ch, left); len(left) != 1 {
+		t.Errorf("handOffFirestoreWrites() into a full writer took a write")
+	}
+}
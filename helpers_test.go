@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// a Firestore client that never dials out, good for building document references
+func testOfflineFirestoreClient(t *testing.T) *firestore.Client {
+	c, err := firestore.NewClient(context.Background(), "test-project",
+		option.WithoutAuthentication(), option.WithGRPCDialOption(grpc.WithInsecure()))
+	if err != nil {
+		t.Fatalf("firestore.NewClient() = %v", err)
+	}
+	return c
+}
+
+// swap the sink's intake for a buffered channel, so tests can look at what was queued
+func testQueuedFirestoreWrites(t *testing.T) chan FirestoreWriteV1 {
+	prev := firestoreWrites
+	firestoreWrites = make(chan FirestoreWriteV1, 100)
+	t.Cleanup(func() { firestoreWrites = prev })
+	return firestoreWrites
+}
+
+// an ACTIVE ELD record header made in transponder 519372, recorded when it happened
+func testEldHeader(id string, at time.Time, dataType string) EldRecordHeaderV1 {
+	return EldRecordHeaderV1{
+		RecordId:            id,
+		RecordStatus:        "ACTIVE",
+		RecordTimestamp:     at,
+		EventStartTimestamp: at,
+		TransponderId:       519372,
+		Type:                dataType,
+	}
+}
+
+// a navigation record, for tests to fill in what they look at
+func testEldNavigation(id string, at time.Time) FirestoreEldReportV1 {
+	return FirestoreEldReportV1{EldRecordHeaderV1: testEldHeader(id, at, "navigation")}
+}
+
+// a duty status record
+func testDutyStatus(id string, at time.Time, status string) FirestoreEldDutyStatusV1 {
+	return FirestoreEldDutyStatusV1{EldRecordHeaderV1: testEldHeader(id, at, "duty_status"), DutyStatus: status}
+}
+
+// point the Navajo id maps at test accounts and devices for the rest of a test
+func testNavajoReferenceIds(t *testing.T, accounts map[string]string, devices map[string]string) {
+	navajoReferenceIds.mutex.Lock()
+	prevAccounts, prevDevices := navajoReferenceIds.clAccountIdMap, navajoReferenceIds.clDeviceIdMap
+	navajoReferenceIds.clAccountIdMap, navajoReferenceIds.clDeviceIdMap = accounts, devices
+	navajoReferenceIds.mutex.Unlock()
+	t.Cleanup(func() {
+		navajoReferenceIds.mutex.Lock()
+		navajoReferenceIds.clAccountIdMap, navajoReferenceIds.clDeviceIdMap = prevAccounts, prevDevices
+		navajoReferenceIds.mutex.Unlock()
+	})
+}
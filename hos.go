@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// US property-carrying hours-of-service limits (49 CFR 395.3)
+const hosDriveLimit time.Duration = 11 * time.Hour  // driving per shift
+const hosWindowLimit time.Duration = 14 * time.Hour // on-duty window per shift
+const hosCycleLimit time.Duration = 70 * time.Hour  // on-duty per 8 day cycle
+const hosCycleDays time.Duration = 8 * 24 * time.Hour
+const hosShiftReset time.Duration = 10 * time.Hour   // consecutive off-duty time starting a new shift
+const hosCycleRestart time.Duration = 34 * time.Hour // consecutive off-duty time restarting the cycle
+
+// duty statuses the clocks know about
+const hosOffDuty string = "OFF_DUTY"
+const hosSleeperBerth string = "SLEEPER_BERTH"
+const hosDriving string = "DRIVING"
+const hosOnDuty string = "ON_DUTY"
+
+// A driver's hours-of-service clocks as of their newest duty status record, kept at
+// /account/{id}/driver/{userId}/state/hos. Clocks are in milliseconds and stop at
+// computedTimestamp, clients tick them down from there using dutyStatus.
+type FirestoreHosStateV1 struct {
+	UserId            float64   `firestore:"userId,omitempty"`
+	Username          string    `firestore:"userName,omitempty"`
+	DutyStatus        string    `firestore:"dutyStatus"`
+	DutyStatusSince   time.Time `firestore:"dutyStatusSince"`
+	RemainingDrive    float64   `firestore:"remainingDrive"`  // driving left before the 11 hour, 14 hour or 70 hour limit
+	RemainingWindow   float64   `firestore:"remainingWindow"` // time left in the 14 hour on-duty window
+	RemainingCycle    float64   `firestore:"remainingCycle"`  // on-duty time left in the 70 hour/8 day cycle
+	DriveUsed         float64   `firestore:"driveUsed"`
+	CycleUsed         float64   `firestore:"cycleUsed"`
+	ShiftStart        time.Time `firestore:"shiftStartTimestamp,omitempty"` // first on-duty time after 10 hours off, zero when off a full shift reset
+	CycleRestart      time.Time `firestore:"cycleRestartTimestamp,omitempty"`
+	LastRecordId      string    `firestore:"lastRecordId,omitempty"`
+	ComputedTimestamp time.Time `firestore:"computedTimestamp"`
+	SchemaVersion     int       `firestore:"schemaVersion"`
+	FirestoreUpdate   time.Time `firestore:"fsUpdateTimestamp,serverTimestamp"`
+}
+
+// a duty status change in a driver's log
+type hosEvent struct {
+	recordId string
+	at       time.Time
+	status   string
+}
+
+// a driver's recent duty status changes, keyed by recordId so edits replace what they edit
+type hosLog struct {
+	userId   float64
+	username string
+	events   map[string]hosEvent
+}
+
+// in-memory duty status log of every driver
+type HosTracker struct {
+	mu      sync.Mutex
+	drivers map[string]*hosLog // "cwAccountId/clUserId":log
+}
+
+// create a firestore reference location for a driver's HOS state
+func hosStateReference(c *firestore.Client, cwAccountId string, clUserId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("driver").Doc(clUserId).Collection("state").Doc("hos")
+}
+
+// map the duty statuses ELDs send onto the four the clocks count,
+// personal conveyance is off duty and yard moves are on duty
+func hosDutyStatus(s string) (string, bool) {
+	switch strings.ToUpper(s) {
+	case "OFF_DUTY", "OFF", "PERSONAL_CONVEYANCE", "PC":
+		return hosOffDuty, true
+	case "SLEEPER_BERTH", "SB", "SLEEPER":
+		return hosSleeperBerth, true
+	case "DRIVING", "D":
+		return hosDriving, true
+	case "ON_DUTY", "ON_DUTY_NOT_DRIVING", "ON", "YARD_MOVES", "YARD_MOVE", "YM":
+		return hosOnDuty, true
+	}
+	return "", false
+}
+
+// when a duty status record happened, its event start or failing that when it was recorded
+func hosRecordTime(record FirestoreEldDutyStatusV1) time.Time {
+	if !record.EventStartTimestamp.IsZero() {
+		return record.EventStartTimestamp
+	}
+	return record.RecordTimestamp
+}
+
+// fold a duty status record into the driver's log and recompute their clocks. Edited
+// records replace the record with the same recordId, records no longer ACTIVE leave the log.
+// The first record of a driver since boot seeds their log with the duty status records read
+// returns, which covers the cycle up to it; when read fails there's no state to write.
+func (t *HosTracker) observe(cwAccountId string, clUserId string, record FirestoreEldDutyStatusV1, read func(at time.Time) ([]FirestoreEldDutyStatusV1, error)) (FirestoreHosStateV1, bool) {
+	at := hosRecordTime(record)
+	_, ok := hosDutyStatus(record.DutyStatus)
+	inactive := record.RecordStatus != "" && !strings.EqualFold(record.RecordStatus, "ACTIVE")
+	if at.IsZero() || (!ok && !inactive) {
+		log.Debugf("HosTracker: ignoring duty status record %s (%q) without a usable time or status", record.RecordId, record.DutyStatus)
+		return FirestoreHosStateV1{}, false
+	}
+	key := cwAccountId + "/" + clUserId
+
+	var stored []FirestoreEldDutyStatusV1
+	err := seedTracker(&t.mu,
+		func() bool { _, known := t.drivers[key]; return known },
+		func() (err error) {
+			if read != nil {
+				stored, err = read(at)
+			}
+			return err
+		},
+		func() {
+			if t.drivers == nil {
+				t.drivers = make(map[string]*hosLog)
+			}
+			l := &hosLog{events: make(map[string]hosEvent)}
+			for _, r := range stored {
+				l.fold(r)
+			}
+			t.drivers[key] = l
+		})
+	if err != nil {
+		log.Warnf("HosTracker: unable to read duty status records of driver %s, not computing clocks from this record alone: %v", key, err)
+		return FirestoreHosStateV1{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.drivers[key]
+	l.fold(record)
+	events := l.prune()
+	if len(events) == 0 {
+		return FirestoreHosStateV1{}, false
+	}
+	// clocks stop at the newest thing we know about
+	computedAt := events[len(events)-1].at
+	if record.RecordTimestamp.After(computedAt) {
+		computedAt = record.RecordTimestamp
+	}
+	state := computeHos(events, computedAt)
+	state.UserId = l.userId
+	state.Username = l.username
+	return state, true
+}
+
+// take a duty status record into the log, replacing or removing the record it edits
+func (l *hosLog) fold(record FirestoreEldDutyStatusV1) {
+	at := hosRecordTime(record)
+	status, ok := hosDutyStatus(record.DutyStatus)
+	inactive := record.RecordStatus != "" && !strings.EqualFold(record.RecordStatus, "ACTIVE")
+	if at.IsZero() || (!ok && !inactive) {
+		return
+	}
+	recordId := record.RecordId
+	if recordId == "" {
+		recordId = at.Format(time.RFC3339Nano)
+	}
+	if record.UserId != 0 {
+		l.userId = record.UserId
+	}
+	if record.Username != "" {
+		l.username = record.Username
+	}
+	if inactive {
+		delete(l.events, recordId)
+	} else {
+		l.events[recordId] = hosEvent{recordId: recordId, at: at, status: status}
+	}
+}
+
+// drop events too old to matter to any clock, returning what's left in time order.
+// The newest event from before the cutoff stays, it's the status the window opens in.
+func (l *hosLog) prune() []hosEvent {
+	events := make([]hosEvent, 0, len(l.events))
+	for _, e := range l.events {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+	if len(events) == 0 {
+		return events
+	}
+	cutoff := events[len(events)-1].at.Add(-hosCycleDays - hosCycleRestart)
+	first := sort.Search(len(events), func(i int) bool { return events[i].at.After(cutoff) })
+	if first > 1 {
+		for _, e := range events[:first-1] {
+			delete(l.events, e.recordId)
+		}
+		events = events[first-1:]
+	}
+	return events
+}
+
+// run the 11/14/70 hour clocks over duty status changes (in time order) up to at
+func computeHos(events []hosEvent, at time.Time) (s FirestoreHosStateV1) {
+	var offRun, drive time.Duration
+	var shiftStart, cycleRestart time.Time
+	for i, e := range events {
+		end := at
+		if i+1 < len(events) {
+			end = events[i+1].at
+		}
+		if end.Before(e.at) {
+			end = e.at
+		}
+		d := end.Sub(e.at)
+		if e.status == hosOffDuty || e.status == hosSleeperBerth {
+			offRun += d
+			if offRun >= hosShiftReset {
+				shiftStart = time.Time{}
+				drive = 0
+			}
+			if offRun >= hosCycleRestart {
+				cycleRestart = end
+			}
+		} else {
+			offRun = 0
+			if shiftStart.IsZero() {
+				shiftStart = e.at
+			}
+			if e.status == hosDriving {
+				drive += d
+			}
+		}
+	}
+
+	// on-duty time in the last 8 days, not counting anything before a 34 hour restart
+	from := at.Add(-hosCycleDays)
+	if cycleRestart.After(from) {
+		from = cycleRestart
+	}
+	var cycle time.Duration
+	for i, e := range events {
+		if e.status == hosOffDuty || e.status == hosSleeperBerth {
+			continue
+		}
+		start, end := e.at, at
+		if i+1 < len(events) {
+			end = events[i+1].at
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			cycle += end.Sub(start)
+		}
+	}
+
+	window := hosWindowLimit
+	if !shiftStart.IsZero() {
+		window = hosWindowLimit - at.Sub(shiftStart)
+	}
+	remainingCycle := hosCycleLimit - cycle
+	remainingDrive := hosDriveLimit - drive
+	if window < remainingDrive {
+		remainingDrive = window
+	}
+	if remainingCycle < remainingDrive {
+		remainingDrive = remainingCycle
+	}
+
+	current := events[len(events)-1]
+	s.DutyStatus = current.status
+	s.DutyStatusSince = current.at
+	// a status repeated by consecutive records started with the first of them
+	for i := len(events) - 2; i >= 0 && events[i].status == current.status; i-- {
+		s.DutyStatusSince = events[i].at
+	}
+	s.RemainingDrive = hosMillis(remainingDrive)
+	s.RemainingWindow = hosMillis(window)
+	s.RemainingCycle = hosMillis(remainingCycle)
+	s.DriveUsed = hosMillis(drive)
+	s.CycleUsed = hosMillis(cycle)
+	s.ShiftStart = shiftStart
+	s.CycleRestart = cycleRestart
+	s.LastRecordId = current.recordId
+	s.ComputedTimestamp = at
+	s.SchemaVersion = schemaVersionV1
+	return s
+}
+
+// a clock in milliseconds, never below zero
+func hosMillis(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d / time.Millisecond)
+}
+
+// a driver's stored duty status records that count toward clocks as of at: the last 8 days and
+// 34 hours of them, and the newest one before that, the status the cycle opens in
+func readHosRecords(ctx context.Context, c *firestore.Client, r *EldReportDataStreamV1, at time.Time) ([]FirestoreEldDutyStatusV1, error) {
+	cutoff := at.Add(-hosCycleDays - hosCycleRestart)
+	dutyStatus := r.firestoreReference(c).Where("type", "==", "duty_status")
+	queries := []firestore.Query{
+		dutyStatus.Where("eventStartTimestamp", "<", cutoff).OrderBy("eventStartTimestamp", firestore.Desc).Limit(1),
+		dutyStatus.Where("eventStartTimestamp", ">=", cutoff),
+	}
+	var records []FirestoreEldDutyStatusV1
+	for _, q := range queries {
+		var docs []*firestore.DocumentSnapshot
+		err := withFirestoreRetry(ctx, func(attemptCtx context.Context) (err error) {
+			docs, err = q.Documents(attemptCtx).GetAll()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			record := FirestoreEldDutyStatusV1{}
+			if err := doc.DataTo(&record); err != nil {
+				log.Warnf("HosTracker: skipping undecodable duty status record %s: %v", doc.Ref.Path, err)
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// recompute and write a driver's HOS state from a duty status record
+func writeHosState(ctx context.Context, c *firestore.Client, r *EldReportDataStreamV1, record FirestoreEldDutyStatusV1) {
+	read := func(at time.Time) ([]FirestoreEldDutyStatusV1, error) {
+		return readHosRecords(ctx, c, r, at)
+	}
+	state, ok := hosStates.observe(r.cwAccountId, r.clUserId, record, read)
+	if !ok {
+		return
+	}
+	log.Debugf("HOS state for driver %s/%s: %s, %.0fms drive left", r.cwAccountId, r.clUserId, state.DutyStatus, state.RemainingDrive)
+	// a recompute that reaches Firestore late mustn't replace a newer one
+	guard := &FirestoreWriteGuardV1{field: "computedTimestamp", at: state.ComputedTimestamp}
+	queueFirestoreWrite(ctx, FirestoreWriteV1{ref: hosStateReference(c, r.cwAccountId, r.clUserId), data: state, guard: guard})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func hours(h float64) float64 {
+	return h * float64(time.Hour/time.Millisecond)
+}
+
+// the 11 and 14 hour clocks run from the start of a shift, 10 hours off starts a new one
+func TestHosShiftClocks(t *testing.T) {
+	var tracker HosTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	tracker.observe("1001", "3344", testDutyStatus("a", start, "ON_DUTY"), nil)
+	tracker.observe("1001", "3344", testDutyStatus("b", start.Add(time.Hour), "DRIVING"), nil)
+	state, ok := tracker.observe("1001", "3344", testDutyStatus("c", start.Add(6*time.Hour), "OFF_DUTY"), nil)
+	if !ok {
+		t.Fatalf("observe() = false, want: true")
+	}
+	if state.DutyStatus != hosOffDuty || !state.DutyStatusSince.Equal(start.Add(6*time.Hour)) {
+		t.Errorf("duty status = %s since %v", state.DutyStatus, state.DutyStatusSince)
+	}
+	if state.DriveUsed != hours(5) || state.RemainingWindow != hours(8) || state.RemainingDrive != hours(6) {
+		t.Errorf("clocks = drive used %v, window %v, drive %v, want: 5h, 8h, 6h", state.DriveUsed, state.RemainingWindow, state.RemainingDrive)
+	}
+	if state.CycleUsed != hours(6) || state.RemainingCycle != hours(64) {
+		t.Errorf("cycle = used %v, remaining %v, want: 6h, 64h", state.CycleUsed, state.RemainingCycle)
+	}
+
+	// 10 hours off, a new shift begins
+	state, _ = tracker.observe("1001", "3344", testDutyStatus("d", start.Add(16*time.Hour), "DRIVING"), nil)
+	if state.DriveUsed != 0 || state.RemainingDrive != hosMillis(hosDriveLimit) || !state.ShiftStart.Equal(start.Add(16*time.Hour)) {
+		t.Errorf("after a shift reset: drive used %v, remaining %v, shift start %v", state.DriveUsed, state.RemainingDrive, state.ShiftStart)
+	}
+
+	// the 14 hour window runs out before the 11 hours of driving does
+	tracker.observe("1001", "3344", testDutyStatus("e", start.Add(17*time.Hour), "ON_DUTY"), nil)
+	state, _ = tracker.observe("1001", "3344", testDutyStatus("f", start.Add(29*time.Hour), "DRIVING"), nil)
+	if state.RemainingWindow != hours(1) || state.RemainingDrive != hours(1) {
+		t.Errorf("late in the window: window %v, drive %v, want: 1h, 1h", state.RemainingWindow, state.RemainingDrive)
+	}
+}
+
+// the 70 hour cycle counts 8 days of on-duty time unless 34 hours off restarts it
+func TestHosCycle(t *testing.T) {
+	var tracker HosTracker
+	start := time.Date(2021, 2, 1, 6, 0, 0, 0, time.UTC)
+	var state FirestoreHosStateV1
+	for day := 0; day < 6; day++ {
+		at := start.Add(time.Duration(day) * 24 * time.Hour)
+		tracker.observe("1001", "3344", testDutyStatus(at.Format("d0102"), at, "DRIVING"), nil)
+		state, _ = tracker.observe("1001", "3344", testDutyStatus(at.Format("o0102"), at.Add(11*time.Hour), "OFF_DUTY"), nil)
+	}
+	if state.CycleUsed != hours(66) || state.RemainingCycle != hours(4) || state.RemainingDrive != 0 {
+		t.Errorf("after 6 long days: cycle used %v, remaining %v, drive %v, want: 66h, 4h, 0", state.CycleUsed, state.RemainingCycle, state.RemainingDrive)
+	}
+
+	restart := start.Add(5*24*time.Hour + 11*time.Hour + 34*time.Hour)
+	state, _ = tracker.observe("1001", "3344", testDutyStatus("after", restart, "ON_DUTY"), nil)
+	if state.CycleUsed != 0 || state.RemainingCycle != hosMillis(hosCycleLimit) || !state.CycleRestart.Equal(restart) {
+		t.Errorf("after a 34 hour restart: cycle used %v, remaining %v, restart %v", state.CycleUsed, state.RemainingCycle, state.CycleRestart)
+	}
+}
+
+// edits replace the record they edit, inactivated records stop counting
+func TestHosEdits(t *testing.T) {
+	var tracker HosTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	tracker.observe("1001", "3344", testDutyStatus("a", start, "DRIVING"), nil)
+	state, _ := tracker.observe("1001", "3344", testDutyStatus("b", start.Add(4*time.Hour), "ON_DUTY"), nil)
+	if state.DriveUsed != hours(4) {
+		t.Fatalf("drive used = %v, want: 4h", state.DriveUsed)
+	}
+	// the driver edits their first record to on duty
+	state, _ = tracker.observe("1001", "3344", testDutyStatus("a", start, "ON_DUTY_NOT_DRIVING"), nil)
+	if state.DriveUsed != 0 || state.DutyStatusSince != start {
+		t.Errorf("after an edit: drive used %v, on duty since %v, want: 0, %v", state.DriveUsed, state.DutyStatusSince, start)
+	}
+	inactive := testDutyStatus("b", start.Add(4*time.Hour), "ON_DUTY")
+	inactive.RecordStatus = "INACTIVE_CHANGED"
+	state, _ = tracker.observe("1001", "3344", inactive, nil)
+	if state.LastRecordId != "a" {
+		t.Errorf("after inactivating b: last record %s, want: a", state.LastRecordId)
+	}
+	if _, ok := tracker.observe("1001", "3344", testDutyStatus("c", start.Add(5*time.Hour), "LUNCH"), nil); ok {
+		t.Errorf("observe() of an unknown duty status = true, want: false")
+	}
+}
+
+// a driver's first record after a restart picks up their stored records, a failed read writes nothing
+func TestHosSeed(t *testing.T) {
+	var tracker HosTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	failing := func(at time.Time) ([]FirestoreEldDutyStatusV1, error) {
+		return nil, errors.New("unavailable")
+	}
+	if _, ok := tracker.observe("1001", "3344", testDutyStatus("c", start.Add(5*time.Hour), "ON_DUTY"), failing); ok {
+		t.Fatalf("observe() with a failed read = true, want: false")
+	}
+
+	var readAt time.Time
+	stored := func(at time.Time) ([]FirestoreEldDutyStatusV1, error) {
+		readAt = at
+		return []FirestoreEldDutyStatusV1{
+			testDutyStatus("a", start, "DRIVING"),
+			testDutyStatus("b", start.Add(3*time.Hour), "ON_DUTY"),
+		}, nil
+	}
+	state, ok := tracker.observe("1001", "3344", testDutyStatus("c", start.Add(5*time.Hour), "ON_DUTY"), stored)
+	if !ok {
+		t.Fatalf("observe() = false, want: true")
+	}
+	if readAt != start.Add(5*time.Hour) {
+		t.Errorf("stored records read as of %v, want: %v", readAt, start.Add(5*time.Hour))
+	}
+	if state.DriveUsed != hours(3) || state.ShiftStart != start {
+		t.Errorf("seeded: drive used %v, shift start %v, want: 3h, %v", state.DriveUsed, state.ShiftStart, start)
+	}
+	// the driver is known now, later records don't read again
+	state, _ = tracker.observe("1001", "3344", testDutyStatus("d", start.Add(6*time.Hour), "DRIVING"), failing)
+	if state.DutyStatus != hosDriving || state.DriveUsed != hours(3) {
+		t.Errorf("after seeding: %s with %v driven, want: %s with 3h", state.DutyStatus, state.DriveUsed, hosDriving)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Clients interested in live data for a set of transponders write a document to
+// /live_request/{id}. Firestream answers each one with a streamTurndownTime, after
+// which the transponders drop back to INACTIVE_RATE unless the client renews its request.
+const liveRequestCollection string = "live_request"
+
+// A client's live data request as we understand it
+type LiveRequestV1 struct {
+	clientId     string
+	transponders []string  // CL API transponder ids (serials)
+	turndown     time.Time // when this request stops counting as active
+}
+
+// tracks which transponders have active viewers, and when we last wrote
+// status data for transponders that don't
+type LiveViewerTracker struct {
+	mu        sync.Mutex
+	requests  map[string]LiveRequestV1 // live_request document id:request
+	lastWrite map[string]time.Time     // transponderId:last throttled status write
+}
+
+// is anybody watching this transponder right now? Requests past their turndown are forgotten,
+// a client renewing one comes back through the listener
+func (t *LiveViewerTracker) watched(transponderId string, at time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for docId, req := range t.requests {
+		if !at.Before(req.turndown) {
+			delete(t.requests, docId)
+			continue
+		}
+		for _, tId := range req.transponders {
+			if tId == transponderId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decide if a report should be written to Firestore. Only status reports are throttled,
+// events (parking, hard_braking, ...) are always written. Status reports for transponders
+// nobody is watching are written at most once every INACTIVE_RATE.
+func (t *LiveViewerTracker) fullRate(transponderId string, dataType string) bool {
+	if inactiveRate <= 0 || dataType != "status" {
+		return true
+	}
+	at := now()
+	if t.watched(transponderId, at) {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastWrite == nil {
+		t.lastWrite = make(map[string]time.Time)
+	}
+	if last, ok := t.lastWrite[transponderId]; ok && at.Sub(last) < inactiveRate {
+		return false
+	}
+	t.lastWrite[transponderId] = at
+	return true
+}
+
+// record or replace a client's live request
+func (t *LiveViewerTracker) set(docId string, req LiveRequestV1) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.requests == nil {
+		t.requests = make(map[string]LiveRequestV1)
+	}
+	t.requests[docId] = req
+}
+
+// forget a client's live request
+func (t *LiveViewerTracker) remove(docId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.requests, docId)
+}
+
+// a request is valid for TURNDOWN_TIME after the client last touched clientRequestTime.
+// Firestore only keeps microseconds so we truncate to avoid answering our own echo forever.
+func liveRequestTurndown(clientRequestTime time.Time) time.Time {
+	return clientRequestTime.Add(turndownTime).UTC().Truncate(time.Microsecond)
+}
+
+// listen to client live requests for as long as we're running, restarting the
+// listener if Firestore drops it
+func liveRequestListener(ctx context.Context, c *firestore.Client) {
+	for {
+		err := listenLiveRequests(ctx, c)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			log.Errorf("liveRequestListener(): snapshot listener stopped, restarting: %v", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func listenLiveRequests(ctx context.Context, c *firestore.Client) error {
+	it := c.Collection(liveRequestCollection).Snapshots(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if err != nil {
+			return err
+		}
+		for _, change := range snap.Changes {
+			if change.Kind == firestore.DocumentRemoved {
+				liveViewers.remove(change.Doc.Ref.ID)
+				continue
+			}
+			handleLiveRequest(ctx, change.Doc)
+		}
+	}
+}
+
+// track a client's live request and answer it with our turndown time
+func handleLiveRequest(ctx context.Context, doc *firestore.DocumentSnapshot) {
+	data := doc.Data()
+	requestTime, ok := data["clientRequestTime"].(time.Time)
+	if !ok {
+		log.Warnf("handleLiveRequest(): %s has no clientRequestTime, ignoring", doc.Ref.Path)
+		liveViewers.remove(doc.Ref.ID)
+		return
+	}
+	req := LiveRequestV1{turndown: liveRequestTurndown(requestTime)}
+	req.clientId, _ = data["clientId"].(string)
+	transponders, _ := data["transponders"].([]interface{})
+	for _, t := range transponders {
+		switch id := t.(type) {
+		case int64:
+			req.transponders = append(req.transponders, fmt.Sprintf("%d", id))
+		case float64:
+			req.transponders = append(req.transponders, fmt.Sprintf("%.0f", id))
+		case string:
+			req.transponders = append(req.transponders, id)
+		}
+	}
+	if !now().Before(req.turndown) {
+		// client went away, nothing to answer
+		liveViewers.remove(doc.Ref.ID)
+		return
+	}
+	liveViewers.set(doc.Ref.ID, req)
+	log.Debugf("Live request %s from client %q for %d transponders until %v", doc.Ref.ID, req.clientId, len(req.transponders), req.turndown)
+
+	// only answer when our answer changes, our own write comes back through the listener
+	answered, _ := data["streamTurndownTime"].(time.Time)
+	firestreamOK, _ := data["firestreamOK"].(bool)
+	if firestreamOK && answered.Equal(req.turndown) {
+		return
+	}
+	answer := map[string]interface{}{
+		"streamTurndownTime": req.turndown,
+		"firestreamOK":       true,
+	}
+	queueFirestoreWrite(ctx, FirestoreWriteV1{ref: doc.Ref, data: answer, opts: []firestore.SetOption{firestore.MergeAll}})
+}
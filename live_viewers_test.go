@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLiveViewerTrackerFullRate(t *testing.T) {
+	rate, turndown := inactiveRate, turndownTime
+	t.Cleanup(func() { inactiveRate, turndownTime = rate, turndown })
+	inactiveRate = time.Hour
+	turndownTime = 5 * time.Minute
+	tracker := LiveViewerTracker{}
+	tracker.set("client-a", LiveRequestV1{transponders: []string{"519372"}, turndown: liveRequestTurndown(now())})
+	tracker.set("client-b", LiveRequestV1{transponders: []string{"519521"}, turndown: liveRequestTurndown(now().Add(-time.Hour))})
+
+	tests := []struct {
+		name          string
+		transponderId string
+		dataType      string
+		want          bool
+	}{
+		{name: "watched status", transponderId: "519372", dataType: "status", want: true},
+		{name: "watched status again", transponderId: "519372", dataType: "status", want: true},
+		{name: "unwatched first status", transponderId: "519000", dataType: "status", want: true},
+		{name: "unwatched status within INACTIVE_RATE", transponderId: "519000", dataType: "status", want: false},
+		{name: "unwatched event", transponderId: "519000", dataType: "hard_braking", want: true},
+		{name: "expired request first status", transponderId: "519521", dataType: "status", want: true},
+		{name: "expired request status within INACTIVE_RATE", transponderId: "519521", dataType: "status", want: false},
+	}
+	for _, tc := range tests {
+		if got := tracker.fullRate(tc.transponderId, tc.dataType); got != tc.want {
+			t.Errorf("%s: fullRate(%s, %s) = %t, want: %t", tc.name, tc.transponderId, tc.dataType, got, tc.want)
+		}
+	}
+
+	if _, ok := tracker.requests["client-b"]; ok {
+		t.Errorf("expired request kept after its turndown")
+	}
+
+	tracker.remove("client-a")
+	if tracker.watched("519372", now()) {
+		t.Errorf("watched() after request removal = true, want: false")
+	}
+
+	inactiveRate = 0 // throttling turned off
+	if !tracker.fullRate("519000", "status") {
+		t.Errorf("fullRate() with INACTIVE_RATE unset = false, want: true")
+	}
+}
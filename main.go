@@ -27,6 +27,36 @@ var navajoAuthConf NavajoAuthConfig
 // global var including CL API Ids -> Cartwheel Ids mapping
 var navajoReferenceIds NavajoAccountData
 
+// global var tracking the latest known state of each vehicle
+var vehicleStates VehicleStateTracker
+
+// global var holding every account's fleet snapshot
+var fleetSnapshots FleetSnapshotTracker
+
+// global var stitching each vehicle's reports into trips
+var trips TripTracker
+
+// global var holding each driver's duty status log for hours-of-service clocks
+var hosStates HosTracker
+
+// global var tracking ELD malfunction and diagnostic state of drivers and vehicles
+var eldHealthStates EldHealthTracker
+
+// global var grouping driverless ELD records into unidentified driving segments
+var unidentifiedDriving UnidentifiedDrivingTracker
+
+// global var holding each driver's daily ELD distance rollups
+var driverDailies DriverDailyTracker
+
+// global var merging video reports into their video events while footage uploads
+var videoEvents VideoEventTracker
+
+// global var linking video events and the hard events they were recorded around
+var videoLinks VideoLinkTracker
+
+// global var tracking which transponders clients are watching live
+var liveViewers LiveViewerTracker
+
 // global channels
 var navajoUpdater chan bool
 var shutdownFirestreamImmediately chan bool
@@ -34,11 +64,40 @@ var firestoreAssembly chan ReportDataStreamV1
 var transponderReportsV1 chan TransponderReportDataStreamV1
 var videoReportsV1 chan VideoReportDataStreamV1
 var eldReportsV1 chan EldReportDataStreamV1
+var firestoreWrites chan FirestoreWriteV1
+var firestoreGovernedWrites []chan FirestoreWriteV1 // one per batch writer, a document's writes always go to the same one
 
 // global tuner knobs
 var maxJSONParseErrors float64
-var navajoRebuildTimer time.Duration // triggers navajo id mapping
-var websocketTimeout time.Duration   // triggers websocket reset if no data within duration
+var navajoRebuildTimer time.Duration        // triggers navajo id mapping
+var websocketTimeout time.Duration          // triggers websocket reset if no data within duration
+var firestoreBatchSize int                  // max writes per Firestore WriteBatch
+var firestoreBatchInterval time.Duration    // partial Firestore batches are committed this often
+var firestoreMetricsInterval time.Duration  // Firestore sink throughput is logged this often
+var firestoreWriteTimeout time.Duration     // deadline for each individual Firestore write attempt
+var firestoreWriteAttempts int              // attempts made on transient Firestore errors before giving up
+var firestoreRetryBackoff time.Duration     // initial wait between Firestore write attempts
+var firestoreMaxRetryBackoff time.Duration  // cap on the wait between Firestore write attempts
+var firestoreDeadLetterFile string          // writes that failed for good are appended here as JSON lines
+var firestoreDocWriteInterval time.Duration // least time between two writes to the same document
+var firestoreMaxWriteRate int               // most writes per second across all documents, 0 is unlimited
+var inactiveRate time.Duration              // status write rate for transponders without live viewers, 0 disables throttling
+var turndownTime time.Duration              // how long a client live request stays active after clientRequestTime
+var retentionPolicy RetentionPolicyV1       // how long report_data documents are kept
+var retentionBatchSize int                  // report_data documents read per retention batch
+var retentionBatchInterval time.Duration    // pause between retention batches
+var retentionInterval time.Duration         // background retention runs this often, 0 disables it
+var fleetSnapshotInterval time.Duration     // account fleet snapshots are written at most this often
+var tripGapTimeout time.Duration            // an open trip finalizes after this long without reports
+var tripMaxPoints int                       // most positions kept in a trip's polyline
+var eldDailyLocation *time.Location         // time zone driver daily rollup days are in
+var videoUploadStallTimeout time.Duration   // footage uploads are flagged stalled after this long without a new chunk
+var videoUrlExpiration time.Duration        // how long footage signed URLs are valid
+var videoLinkWindow time.Duration           // video and hard events this close together are linked
+var footageUrlSigner *FootageUrlSigner      // signs footage URLs, nil when we have no service account key
+var reverseGeocoder *ReverseGeocoder        // addresses for positions, nil when GEOCODE_DATASET isn't set
+var transponderSchemaVersions []int         // schema versions transponder reports are written in
+var eldRecordTypes map[string]bool          // ELD record dataTypes written to Firestore
 
 // GCP project config
 var gcpProjectId string
@@ -55,6 +114,11 @@ func init() {
 }
 
 func main() {
+	// subcommands (prune, ...) do their job and exit instead of streaming
+	if len(os.Args) > 1 {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+
 	// get configs from environment
 	err := parseEnvConfigs()
 	if err != nil {
@@ -99,6 +163,89 @@ func main() {
 		time.Sleep(2 * time.Second)
 	}
 
+	// launch firestore sink, report writers below hand their records off to these
+	for _, writes := range firestoreGovernedWrites {
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Batch Writer clients at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		firestoreSinkDone.Add(1)
+		firestoreBatchWritersDone.Add(1)
+		go firestoreBatchWriterV1(ctx, c, writes)
+	}
+	{
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Write Governor client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		firestoreSinkDone.Add(1)
+		go firestoreWriteGovernor(ctx, c)
+	}
+	go firestoreMetricsReporter(ctx)
+
+	// resource conservation, listen for client live requests when throttling is turned on
+	if inactiveRate > 0 {
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Live Request client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		go liveRequestListener(ctx, c)
+	}
+
+	// account fleet snapshots
+	{
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Fleet Snapshot client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		go fleetSnapshotWriter(ctx, c)
+	}
+
+	// finalize trips for vehicles that went quiet
+	{
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Trip client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		firestoreSinkDone.Add(1)
+		go tripGapSweeper(ctx, c)
+	}
+
+	// flag footage uploads that stopped moving
+	{
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Video Event client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		go videoStallSweeper(ctx, c)
+	}
+
+	// answer client requests for fresh footage URLs
+	{
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Footage URL client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		go footageUrlRequestListener(ctx, c)
+	}
+
+	// background report_data retention
+	if retentionInterval > 0 {
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore Retention client at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
+		go retentionScheduler(ctx, c)
+	}
+
 	// launch assembly pipeline router
 	go firestoreAssemblyRouter(ctx)
 	// launch event report_data assembler workers
@@ -110,23 +257,22 @@ func main() {
 		}
 		go transponderReportWriterV1(ctx, c)
 	}
-	/*
-		// launch video data assemblers
-		for i := 0; i < 2; i++ {
-			c, err := createFirestoreClient(ctx)
-			if err != nil {
-				log.Errorln("ERROR FATAL: Unable to create firestore Video Data clients at Firestream init!")
-				shutdownFirestreamImmediately <- true
-			}
-			go videoReportWriterV1(ctx, c)
-		}*/
-	// launch eld data assemblers
+	// launch video data assemblers
 	for i := 0; i < 2; i++ {
 		c, err := createFirestoreClient(ctx)
 		if err != nil {
 			log.Errorln("ERROR FATAL: Unable to create firestore Video Data clients at Firestream init!")
 			shutdownFirestreamImmediately <- true
 		}
+		go videoReportWriterV1(ctx, c)
+	}
+	// launch eld data assemblers
+	for i := 0; i < 2; i++ {
+		c, err := createFirestoreClient(ctx)
+		if err != nil {
+			log.Errorln("ERROR FATAL: Unable to create firestore ELD Data clients at Firestream init!")
+			shutdownFirestreamImmediately <- true
+		}
 		go eldReportWriterV1(ctx, c)
 	}
 
@@ -138,6 +284,10 @@ func main() {
 		select {
 		case <-ctx.Done():
 			log.Debugln("main(): context.Done() received")
+			// batch writers flush first, then the governor, each within firestoreShutdownTimeout
+			if !waitFirestoreSink(3 * firestoreShutdownTimeout) {
+				log.Errorln("Firestore sink didn't finish flushing before shutdown, some writes may be lost")
+			}
 			time.Sleep(200 * time.Millisecond) // allow any final metrics tasks to finish
 			log.Exit(0)
 		}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	gabs "github.com/Jeffail/gabs/v2"
 	log "github.com/sirupsen/logrus"
@@ -36,6 +38,105 @@ type FirebaseMetrics struct {
 	hardBrakingWrites float64    // tally of total hard_braking records written to firestore
 	videoEventWrites  float64    // tally of total video event records written to firestore
 	stopWrites        float64    // tally of total stop records written to firestore
+	failedWrites      float64    // tally of documents Firestore refused to write
+	batchCommits      float64    // tally of WriteBatch commits attempted
+	batchFailures     float64    // tally of WriteBatch commits that returned an error
+	batchedWrites     float64    // tally of writes sent to Firestore inside a WriteBatch
+	maxBatchSize      float64    // largest WriteBatch committed
+	commitLatency     float64    // sum of WriteBatch commit latencies in ms. commitLatency / batchCommits = avg latency
+	maxCommitLatency  float64    // slowest WriteBatch commit in ms
+	governedWrites    float64    // tally of writes queued through the write governor
+	coalescedWrites   float64    // tally of queued writes made redundant by a later write to the same document
+	governorPending   float64    // writes waiting in the governor as of the last queued write
+	maxGovernorWait   float64    // most writes ever waiting in the governor
+}
+
+// record the outcome of a WriteBatch commit
+func (m *FirebaseMetrics) recordBatchCommit(size int, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms := float64(latency) / float64(time.Millisecond)
+	m.batchCommits++
+	m.commitLatency += ms
+	if ms > m.maxCommitLatency {
+		m.maxCommitLatency = ms
+	}
+	if float64(size) > m.maxBatchSize {
+		m.maxBatchSize = float64(size)
+	}
+	if err != nil {
+		m.batchFailures++
+		return
+	}
+	m.batchedWrites += float64(size)
+	m.written += float64(size)
+}
+
+// record a write queued through the write governor
+func (m *FirebaseMetrics) recordGovernedWrite(coalesced int, pending int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.governedWrites++
+	m.coalescedWrites += float64(coalesced)
+	m.governorPending = float64(pending)
+	if m.governorPending > m.maxGovernorWait {
+		m.maxGovernorWait = m.governorPending
+	}
+}
+
+// record a single document written outside of a WriteBatch
+func (m *FirebaseMetrics) recordWrite() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written++
+}
+
+// record a single document Firestore refused to write
+func (m *FirebaseMetrics) recordFailedWrite() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failedWrites++
+}
+
+// periodically log Firestore sink throughput
+func firestoreMetricsReporter(ctx context.Context) {
+	ticker := time.NewTicker(firestoreMetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logFirestoreMetrics()
+		}
+	}
+}
+
+func logFirestoreMetrics() {
+	fmmetrics.mu.Lock()
+	defer fmmetrics.mu.Unlock()
+	var avgBatch, avgLatency float64
+	if committed := fmmetrics.batchCommits - fmmetrics.batchFailures; committed > 0 {
+		avgBatch = fmmetrics.batchedWrites / committed
+	}
+	if fmmetrics.batchCommits > 0 {
+		avgLatency = fmmetrics.commitLatency / fmmetrics.batchCommits
+	}
+	log.WithFields(log.Fields{
+		"writers":          fmmetrics.writers,
+		"written":          fmmetrics.written,
+		"failedWrites":     fmmetrics.failedWrites,
+		"batchCommits":     fmmetrics.batchCommits,
+		"batchFailures":    fmmetrics.batchFailures,
+		"avgBatchSize":     avgBatch,
+		"maxBatchSize":     fmmetrics.maxBatchSize,
+		"avgCommitLatency": avgLatency,
+		"maxCommitLatency": fmmetrics.maxCommitLatency,
+		"governedWrites":   fmmetrics.governedWrites,
+		"coalescedWrites":  fmmetrics.coalescedWrites,
+		"governorPending":  fmmetrics.governorPending,
+		"maxGovernorWait":  fmmetrics.maxGovernorWait,
+	}).Infof("Firestore sink metrics")
 }
 
 func finalizeMetrics() {
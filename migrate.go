@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A rewrite of existing documents from one schema version to another. Every document in
+// collectionGroup is handed to convert, which returns the write to make or false to skip it.
+type SchemaMigrationV1 struct {
+	collectionGroup string
+	convert         func(doc *firestore.DocumentSnapshot) (FirestoreWriteV1, bool, error)
+}
+
+// migrations we know how to run, keyed by "from>to"
+var schemaMigrations = map[string]SchemaMigrationV1{
+	"0>1": {collectionGroup: "report_data", convert: migrateReportDataV0ToV1},
+	"1>2": {collectionGroup: "report_data", convert: migrateTransponderReportV1ToV2},
+	"2>1": {collectionGroup: reportDataV2Collection, convert: migrateTransponderReportV2ToV1},
+}
+
+// counts from a migration run
+type SchemaMigrationResultV1 struct {
+	scanned  int // documents read
+	migrated int // documents written (or that would be, on a dry-run)
+	skipped  int // documents already migrated or not covered by the migration
+}
+
+// Where an interrupted migration got to, kept at /firestream/migration/cursor/{from}_to_{to}
+type SchemaMigrationCursorV1 struct {
+	Path     string    `firestore:"path"`
+	Scanned  int       `firestore:"scanned"`
+	Migrated int       `firestore:"migrated"`
+	Skipped  int       `firestore:"skipped"`
+	Updated  time.Time `firestore:"updated"`
+}
+
+func schemaMigrationCursorReference(c *firestore.Client, from int, to int) *firestore.DocumentRef {
+	return c.Collection("firestream").Doc("migration").Collection("cursor").Doc(fmt.Sprintf("%d_to_%d", from, to))
+}
+
+// unversioned report_data documents get stamped as V1 in place
+func migrateReportDataV0ToV1(doc *firestore.DocumentSnapshot) (FirestoreWriteV1, bool, error) {
+	if _, err := doc.DataAt("schemaVersion"); err == nil {
+		return FirestoreWriteV1{}, false, nil
+	}
+	data := map[string]interface{}{"schemaVersion": schemaVersionV1}
+	return FirestoreWriteV1{ref: doc.Ref, data: data, opts: []firestore.SetOption{firestore.MergeAll}}, true, nil
+}
+
+// V1 transponder reports are copied into their report_data_v2 sibling, ELD reports under drivers are left alone
+func migrateTransponderReportV1ToV2(doc *firestore.DocumentSnapshot) (FirestoreWriteV1, bool, error) {
+	owner := doc.Ref.Parent.Parent
+	if owner == nil || owner.Parent == nil || owner.Parent.ID != "vehicle" {
+		return FirestoreWriteV1{}, false, nil
+	}
+	if v, err := doc.DataAt("schemaVersion"); err == nil && v != int64(schemaVersionV1) {
+		return FirestoreWriteV1{}, false, nil
+	}
+	v1 := FirestoreTransponderReportV1{}
+	if err := doc.DataTo(&v1); err != nil {
+		return FirestoreWriteV1{}, false, err
+	}
+	return FirestoreWriteV1{ref: reportDataV2Reference(doc.Ref), data: transponderReportV1ToV2(v1)}, true, nil
+}
+
+// V2 transponder reports are copied back into their report_data sibling
+func migrateTransponderReportV2ToV1(doc *firestore.DocumentSnapshot) (FirestoreWriteV1, bool, error) {
+	v2 := FirestoreTransponderReportV2{}
+	if err := doc.DataTo(&v2); err != nil {
+		return FirestoreWriteV1{}, false, err
+	}
+	if doc.Ref.Parent.Parent == nil {
+		return FirestoreWriteV1{}, false, nil
+	}
+	ref := doc.Ref.Parent.Parent.Collection("report_data").Doc(doc.Ref.ID)
+	return FirestoreWriteV1{ref: ref, data: transponderReportV2ToV1(v2)}, true, nil
+}
+
+// rewrite every document covered by a migration in pages of batchSize, checkpointing
+// after each page so an interrupted run resumes where it left off
+func migrateSchema(ctx context.Context, c *firestore.Client, from int, to int, batchSize int, interval time.Duration, dryRun bool) (result SchemaMigrationResultV1, err error) {
+	migration, ok := schemaMigrations[fmt.Sprintf("%d>%d", from, to)]
+	if !ok {
+		return result, fmt.Errorf("no migration from schema version %d to %d", from, to)
+	}
+	cursorRef := schemaMigrationCursorReference(c, from, to)
+	base := c.CollectionGroup(migration.collectionGroup).OrderBy(firestore.DocumentID, firestore.Asc)
+
+	q := base.Limit(batchSize)
+	if !dryRun {
+		q, result, err = resumeSchemaMigration(ctx, c, cursorRef, base, batchSize)
+		if err != nil {
+			return result, err
+		}
+	}
+	for {
+		docs, err := q.Documents(ctx).GetAll()
+		if err != nil {
+			return result, err
+		}
+		if len(docs) == 0 {
+			break
+		}
+		var writes []FirestoreWriteV1
+		for _, doc := range docs {
+			result.scanned++
+			w, ok, err := migration.convert(doc)
+			if err != nil {
+				log.Warnf("Migration %d>%d: unable to convert %s, skipping: %v", from, to, doc.Ref.Path, err)
+			}
+			if !ok {
+				result.skipped++
+				continue
+			}
+			writes = append(writes, w)
+		}
+		result.migrated += len(writes)
+		last := docs[len(docs)-1]
+		if !dryRun {
+			cursor := SchemaMigrationCursorV1{
+				Path:     reportDataRelativePath(last.Ref),
+				Scanned:  result.scanned,
+				Migrated: result.migrated,
+				Skipped:  result.skipped,
+				Updated:  now(),
+			}
+			if err := commitSchemaMigrationBatch(ctx, c, writes, cursorRef, cursor); err != nil {
+				return result, err
+			}
+		}
+		log.Infof("Migration %d>%d: scanned:%d migrated:%d skipped:%d dryRun:%t", from, to, result.scanned, result.migrated, result.skipped, dryRun)
+		if len(docs) < batchSize {
+			break
+		}
+		q = base.StartAfter(last).Limit(batchSize)
+		// rate limit ourselves so a migration doesn't compete with live writes
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	if !dryRun {
+		// finished, a later run of the same migration starts over
+		err = withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+			_, err := cursorRef.Delete(attemptCtx)
+			return err
+		})
+	}
+	return result, err
+}
+
+// pick up a previous run's cursor and counts, if there is one
+func resumeSchemaMigration(ctx context.Context, c *firestore.Client, cursorRef *firestore.DocumentRef, base firestore.Query, batchSize int) (firestore.Query, SchemaMigrationResultV1, error) {
+	q := base.Limit(batchSize)
+	result := SchemaMigrationResultV1{}
+	snap, err := cursorRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return q, result, nil
+	} else if err != nil {
+		return q, result, err
+	}
+	cursor := SchemaMigrationCursorV1{}
+	if err := snap.DataTo(&cursor); err != nil {
+		return q, result, err
+	}
+	// collection group cursors need a snapshot for the document name, if the cursor
+	// document is gone we start over, migrations are safe to repeat
+	last, err := c.Doc(cursor.Path).Get(ctx)
+	if err != nil {
+		log.Warnf("Migration cursor %s points at %s which can't be read, starting over: %v", cursorRef.ID, cursor.Path, err)
+		return q, result, nil
+	}
+	log.Infof("Migration resuming %s after %s", cursorRef.ID, cursor.Path)
+	result = SchemaMigrationResultV1{scanned: cursor.Scanned, migrated: cursor.Migrated, skipped: cursor.Skipped}
+	return base.StartAfter(last).Limit(batchSize), result, nil
+}
+
+// write a page of migrated documents and move our cursor past them in the same commit
+func commitSchemaMigrationBatch(ctx context.Context, c *firestore.Client, writes []FirestoreWriteV1, cursorRef *firestore.DocumentRef, cursor SchemaMigrationCursorV1) error {
+	return withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+		batch := c.Batch()
+		for _, w := range writes {
+			batch.Set(w.ref, w.data, w.opts...)
+		}
+		batch.Set(cursorRef, cursor)
+		_, err := batch.Commit(attemptCtx)
+		return err
+	})
+}
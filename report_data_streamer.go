@@ -40,10 +40,11 @@ func (r *ReportDataStreamV1) eldReportDataStreamV1() (vr EldReportDataStreamV1)
 // and use specific embedded types for our json *gabs.Container, giving us
 // methods specific to the kind of report data we are looking for
 type TransponderReportDataStreamV1 struct {
-	reportType     string
-	reportDataType string
-	cwAccountId    string
-	cwDeviceWebId  string
+	reportType      string
+	reportDataType  string
+	clTransponderId string
+	cwAccountId     string
+	cwDeviceWebId   string
 	TransponderReportDataV1
 }
 type EldReportDataStreamV1 struct {
@@ -93,18 +94,33 @@ func firestoreAssemblyRouter(ctx context.Context) {
 			case rds.reportType == "REPORT_DATA":
 				log.Debugf("firestoreAssemblyRouter() pushing into transponderReportsV1 channel")
 				transponderReportsV1 <- rds.transponderReportDataStreamV1()
-			//case rds.reportType == "video_upload": // Disabled for now https://track.carmasys.com:8343/browse/FIRE-2
-			//log.Debugf("firestoreAssemblyRouter() pushing into videoReportsV1 channel")
-			//videoReportsV1 <- rds.videoReportDataStreamV1()
 			case rds.reportType == "ELD_RECORD":
 				log.Debugf("firestoreAssemblyRouter() pushing into eldReportsV1 channel")
 				eldReportsV1 <- rds.eldReportDataStreamV1()
+			case videoReportPacket(rds):
+				log.Debugf("firestoreAssemblyRouter() pushing into videoReportsV1 channel")
+				videoReportsV1 <- rds.videoReportDataStreamV1()
 			default:
-				// do not process other report types for now but log them for visibility
-				log.Infof("Assembly router received an unhandled (type:dataType) (%s:%s) report: %s", rds.reportType, rds.reportDataType, rds.json.String())
+				// do not process other report types for now but make sure they're noticed
+				log.Warnf("Assembly router received an unhandled (type:dataType) (%s:%s) report: %s", rds.reportType, rds.reportDataType, rds.json.String())
 			}
 		}
 	}
 }
 
+// No captured video packet has shown which "type" tag VIDEO_EVENT_TYPE reports arrive with,
+// only the event itself (README). Rather than depend on the tag, a packet carrying the sample's
+// videoEventId is a video report, under its data object or unwrapped; "video_upload" (the tag
+// this router used to match) and "VIDEO_EVENT" are taken as well.
+func videoReportPacket(rds ReportDataStreamV1) bool {
+	if rds.reportType == "VIDEO_EVENT" || rds.reportType == "video_upload" {
+		return true
+	}
+	if _, ok := rds.json.Path("data.videoEventId").Data().(string); ok {
+		return true
+	}
+	_, ok := rds.json.Path("videoEventId").Data().(string)
+	return ok
+}
+
 // Pub/sub message router, ...
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	gabs "github.com/Jeffail/gabs/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How long report_data documents are kept, per dataType, with per-account overrides.
+// A retention of zero means documents of that dataType are kept forever.
+type RetentionPolicyV1 struct {
+	dataTypes map[string]time.Duration            // dataType:retention
+	accounts  map[string]map[string]time.Duration // cwAccountId:dataType:retention
+}
+
+// retention used when no RETENTION_POLICY_FILE is given
+func defaultRetentionPolicy() RetentionPolicyV1 {
+	return RetentionPolicyV1{
+		dataTypes: map[string]time.Duration{
+			"status":      7 * 24 * time.Hour,
+			"trip_report": 90 * 24 * time.Hour,
+		},
+		accounts: make(map[string]map[string]time.Duration),
+	}
+}
+
+// load a retention policy from a JSON file shaped like:
+// {"dataTypes": {"status": "168h"}, "accounts": {"1234": {"status": "720h"}}}
+func loadRetentionPolicy(path string) (p RetentionPolicyV1, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	json, err := gabs.ParseJSON(raw)
+	if err != nil {
+		return p, err
+	}
+	p.dataTypes, err = retentionDurations(json.Path("dataTypes"))
+	if err != nil {
+		return p, err
+	}
+	p.accounts = make(map[string]map[string]time.Duration)
+	for accountId, child := range json.Path("accounts").ChildrenMap() {
+		p.accounts[accountId], err = retentionDurations(child)
+		if err != nil {
+			return p, fmt.Errorf("account %s: %v", accountId, err)
+		}
+	}
+	return p, nil
+}
+
+// parse a {"dataType": "duration"} JSON object
+func retentionDurations(json *gabs.Container) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for dataType, child := range json.ChildrenMap() {
+		v, ok := child.Data().(string)
+		if !ok {
+			return nil, fmt.Errorf("retention for %s isn't a duration string", dataType)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("retention for %s: invalid duration %q", dataType, v)
+		}
+		durations[dataType] = d
+	}
+	return durations, nil
+}
+
+// retention for a dataType within an account, false if it's kept forever
+func (p *RetentionPolicyV1) retention(cwAccountId string, dataType string) (time.Duration, bool) {
+	d, ok := p.accounts[cwAccountId][dataType]
+	if !ok {
+		d, ok = p.dataTypes[dataType]
+	}
+	return d, ok && d > 0
+}
+
+// every dataType something may be pruned for, with the shortest retention any account uses
+func (p *RetentionPolicyV1) shortestRetentions() map[string]time.Duration {
+	shortest := make(map[string]time.Duration)
+	consider := func(dataType string, d time.Duration) {
+		if d <= 0 {
+			return
+		}
+		if s, ok := shortest[dataType]; !ok || d < s {
+			shortest[dataType] = d
+		}
+	}
+	for dataType, d := range p.dataTypes {
+		consider(dataType, d)
+	}
+	for _, overrides := range p.accounts {
+		for dataType, d := range overrides {
+			consider(dataType, d)
+		}
+	}
+	return shortest
+}
+
+// Documents are aged by when they were reported rather than when Firestore stored them:
+// transponder reports carry reportTimestamp, ELD records recordTimestamp. fsCreateTimestamp is
+// stamped again every time a replay upserts a document, so it can't tell us how old one is.
+var retentionAgeFields = []string{"reportTimestamp", "recordTimestamp"}
+
+// counts from a pruning run for a single dataType
+type RetentionResultV1 struct {
+	collection string // collection group pruned, report_data, eld_versions, video_link or report_data_v2
+	dataType   string
+	ageField   string // timestamp field documents were aged by
+	scanned    int    // documents older than the shortest retention for the dataType
+	expired    int    // documents past their account's retention (deleted unless dry-run)
+	kept       int    // documents an account override kept around
+}
+
+// run pruning for every dataType in our retention policy, in report_data, ELD record
+// eld_versions, hard event video_link, and report_data_v2 when V2 documents are being written
+func pruneReportData(ctx context.Context, c *firestore.Client, dryRun bool) ([]RetentionResultV1, error) {
+	collections := []string{"report_data", eldRecordVersionsCollection, videoLinkCollection}
+	if writesSchemaVersion(schemaVersionV2) {
+		collections = append(collections, reportDataV2Collection)
+	}
+	var results []RetentionResultV1
+	for _, collection := range collections {
+		for dataType, shortest := range retentionPolicy.shortestRetentions() {
+			// a document only carries one of the age fields, so each is visited by exactly one pass
+			for _, ageField := range retentionAgeFields {
+				result, err := pruneReportDataType(ctx, c, collection, dataType, ageField, now().Add(-shortest), dryRun)
+				results = append(results, result)
+				if err != nil {
+					return results, err
+				}
+				log.Infof("Retention %s %s by %s: scanned:%d expired:%d kept:%d dryRun:%t", collection, dataType, ageField, result.scanned, result.expired, result.kept, dryRun)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Where the last pruning run for a dataType got to, kept at /firestream/retention/cursor/{dataType}@{ageField}
+// (report_data) or /firestream/retention/cursor/{collection}:{dataType}@{ageField} (eld_versions, video_link, report_data_v2)
+type RetentionCursorV1 struct {
+	Timestamp time.Time `firestore:"timestamp"` // age field of the last document looked at
+	Path      string    `firestore:"path"`
+	Updated   time.Time `firestore:"updated"`
+}
+
+func retentionCursorReference(c *firestore.Client, collection string, dataType string, ageField string) *firestore.DocumentRef {
+	id := dataType + "@" + ageField
+	if collection != "report_data" {
+		id = collection + ":" + id
+	}
+	return c.Collection("firestream").Doc("retention").Collection("cursor").Doc(id)
+}
+
+// walk every document of a dataType in a report_data collection group whose ageField is before
+// cutoff, oldest first, deleting the ones past their account's retention in rate-limited batches
+func pruneReportDataType(ctx context.Context, c *firestore.Client, collection string, dataType string, ageField string, cutoff time.Time, dryRun bool) (result RetentionResultV1, err error) {
+	result.collection = collection
+	result.dataType = dataType
+	result.ageField = ageField
+	cursorRef := retentionCursorReference(c, collection, dataType, ageField)
+	base := c.CollectionGroup(collection).
+		Where("type", "==", dataType).
+		Where(ageField, "<", cutoff).
+		OrderBy(ageField, firestore.Asc)
+
+	// resume from where an interrupted run left off
+	q := base.Limit(retentionBatchSize)
+	if !dryRun {
+		q, err = resumeRetentionCursor(ctx, c, cursorRef, base)
+		if err != nil {
+			return result, err
+		}
+	}
+	for {
+		docs, err := q.Documents(ctx).GetAll()
+		if err != nil {
+			return result, err
+		}
+		if len(docs) == 0 {
+			break
+		}
+		var expired []*firestore.DocumentRef
+		for _, doc := range docs {
+			result.scanned++
+			if reportDataExpired(doc, ageField) {
+				expired = append(expired, doc.Ref)
+			} else {
+				result.kept++
+			}
+		}
+		result.expired += len(expired)
+		last := docs[len(docs)-1]
+		if !dryRun {
+			if err := deleteRetentionBatch(ctx, c, expired, cursorRef, last, ageField); err != nil {
+				return result, err
+			}
+		}
+		if len(docs) < retentionBatchSize {
+			break
+		}
+		q = base.StartAfter(last).Limit(retentionBatchSize)
+		// rate limit ourselves so pruning doesn't compete with live writes
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(retentionBatchInterval):
+		}
+	}
+	if !dryRun {
+		// finished a full pass, the next run starts from the oldest document again
+		err = withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+			_, err := cursorRef.Delete(attemptCtx)
+			return err
+		})
+	}
+	return result, err
+}
+
+// pick up a previous run's cursor, if there is one
+func resumeRetentionCursor(ctx context.Context, c *firestore.Client, cursorRef *firestore.DocumentRef, base firestore.Query) (firestore.Query, error) {
+	q := base.Limit(retentionBatchSize)
+	snap, err := cursorRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return q, nil
+	} else if err != nil {
+		return q, err
+	}
+	cursor := RetentionCursorV1{}
+	if err := snap.DataTo(&cursor); err != nil {
+		return q, err
+	}
+	log.Infof("Retention resuming %s from %s (%v)", cursorRef.ID, cursor.Path, cursor.Timestamp)
+	// collection group cursors need a snapshot for the document name, if the cursor
+	// document has since been deleted starting at its timestamp is close enough
+	last, err := c.Doc(cursor.Path).Get(ctx)
+	if err == nil {
+		return base.StartAfter(last).Limit(retentionBatchSize), nil
+	}
+	return base.StartAt(cursor.Timestamp).Limit(retentionBatchSize), nil
+}
+
+// delete a batch of expired documents and move our cursor past them in the same commit
+func deleteRetentionBatch(ctx context.Context, c *firestore.Client, expired []*firestore.DocumentRef, cursorRef *firestore.DocumentRef, last *firestore.DocumentSnapshot, ageField string) error {
+	lastTs, _ := last.DataAt(ageField)
+	cursor := RetentionCursorV1{Path: reportDataRelativePath(last.Ref), Updated: now()}
+	cursor.Timestamp, _ = lastTs.(time.Time)
+	return withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+		batch := c.Batch()
+		for _, ref := range expired {
+			batch.Delete(ref)
+		}
+		batch.Set(cursorRef, cursor)
+		_, err := batch.Commit(attemptCtx)
+		return err
+	})
+}
+
+// is a report_data document past the retention of the account that owns it?
+func reportDataExpired(doc *firestore.DocumentSnapshot, ageField string) bool {
+	cwAccountId, ok := reportDataAccountId(doc.Ref)
+	if !ok {
+		return false // not one of ours, leave it be
+	}
+	dataType, _ := doc.DataAt("type")
+	dt, _ := dataType.(string)
+	retention, ok := retentionPolicy.retention(cwAccountId, dt)
+	if !ok {
+		return false
+	}
+	age, _ := doc.DataAt(ageField)
+	ageTs, ok := age.(time.Time)
+	return ok && ageTs.Before(now().Add(-retention))
+}
+
+// account id owning /account/{id}/{vehicle|driver}/{id}/report_data/{id}, one of its
+// /eld_versions/{id} or /video_link/{id} documents, or an unidentified driving record at
+// /account/{id}/vehicle/{id}/unidentified_driving/{segmentId}/report_data/{id}
+func reportDataAccountId(ref *firestore.DocumentRef) (string, bool) {
+	reportData := ref.Parent
+	if reportData != nil && (reportData.ID == eldRecordVersionsCollection || reportData.ID == videoLinkCollection) && reportData.Parent != nil {
+		reportData = reportData.Parent.Parent
+	}
+	if reportData == nil || reportData.Parent == nil {
+		return ``, false
+	}
+	owner := reportData.Parent
+	if segments := owner.Parent; segments != nil && segments.ID == unidentifiedDrivingCollection && segments.Parent != nil {
+		if segments.Parent.Parent == nil || segments.Parent.Parent.ID != "vehicle" {
+			return ``, false
+		}
+		owner = segments.Parent
+	}
+	owners := owner.Parent
+	if owners == nil || (owners.ID != "vehicle" && owners.ID != "driver") || owners.Parent == nil {
+		return ``, false
+	}
+	account := owners.Parent
+	if account.Parent == nil || account.Parent.ID != "account" || account.Parent.Parent != nil {
+		return ``, false
+	}
+	return account.ID, true
+}
+
+// document path relative to the database root, suitable for firestore.Client.Doc()
+func reportDataRelativePath(ref *firestore.DocumentRef) string {
+	path := ref.ID
+	for coll := ref.Parent; coll != nil; {
+		path = coll.ID + "/" + path
+		if coll.Parent == nil {
+			break
+		}
+		path = coll.Parent.ID + "/" + path
+		coll = coll.Parent.Parent
+	}
+	return path
+}
+
+// run pruning every RETENTION_INTERVAL for as long as we're running
+func retentionScheduler(ctx context.Context, c *firestore.Client) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Infof("Scheduled report_data retention run starting...")
+			if _, err := pruneReportData(ctx, c, false); err != nil && !errors.Is(err, context.Canceled) {
+				log.Errorf("Scheduled report_data retention run failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadRetentionPolicy(t *testing.T) {
+	p, err := loadRetentionPolicy("testdata/retention_policy.json")
+	if err != nil {
+		t.Fatalf("loadRetentionPolicy() = %v", err)
+	}
+	tests := []struct {
+		account  string
+		dataType string
+		want     time.Duration
+		wantOk   bool
+	}{
+		{account: "1", dataType: "status", want: 168 * time.Hour, wantOk: true},
+		{account: "1234", dataType: "status", want: 24 * time.Hour, wantOk: true},
+		{account: "1234", dataType: "trip_report", want: 2160 * time.Hour, wantOk: true},
+		{account: "5678", dataType: "trip_report", wantOk: false}, // kept forever by override
+		{account: "1", dataType: "navigation", wantOk: false},     // kept forever by default
+		{account: "1234", dataType: "navigation", want: 720 * time.Hour, wantOk: true},
+		{account: "1", dataType: "parking", wantOk: false}, // not in policy
+	}
+	for _, tc := range tests {
+		got, ok := p.retention(tc.account, tc.dataType)
+		if ok != tc.wantOk || (ok && got != tc.want) {
+			t.Errorf("retention(%s, %s) = %v, %t, want: %v, %t", tc.account, tc.dataType, got, ok, tc.want, tc.wantOk)
+		}
+	}
+	shortest := p.shortestRetentions()
+	want := map[string]time.Duration{"status": 24 * time.Hour, "trip_report": 2160 * time.Hour, "navigation": 720 * time.Hour}
+	if len(shortest) != len(want) {
+		t.Errorf("shortestRetentions() = %v, want: %v", shortest, want)
+	}
+	for dataType, d := range want {
+		if shortest[dataType] != d {
+			t.Errorf("shortestRetentions()[%s] = %v, want: %v", dataType, shortest[dataType], d)
+		}
+	}
+}
+
+func TestReportDataAccountId(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	defer c.Close()
+	tests := []struct {
+		path   string
+		want   string
+		wantOk bool
+	}{
+		{path: "account/12/vehicle/34/report_data/abc", want: "12", wantOk: true},
+		{path: "account/12/driver/56/report_data/abc", want: "12", wantOk: true},
+		{path: "account/12/driver/56/report_data/abc/eld_versions/0001613576740322-ef01", want: "12", wantOk: true},
+		{path: "account/12/driver/56/eld_versions/abc", wantOk: false},
+		{path: "account/12/vehicle/34/report_data/abc/video_link/4ad20507", want: "12", wantOk: true},
+		{path: "account/12/vehicle/34/unidentified_driving/5eg/report_data/abc", want: "12", wantOk: true},
+		{path: "account/12/driver/56/unidentified_driving/5eg/report_data/abc", wantOk: false},
+		{path: "account/12/vehicle/34/unidentified_driving/5eg/report_data/abc/eld_versions/0001613576740322-ef01", want: "12", wantOk: true},
+		{path: "account/12/trailer/34/report_data/abc", wantOk: false},
+		{path: "fleet/12/vehicle/34/report_data/abc", wantOk: false},
+		{path: "org/1/account/12/vehicle/34/report_data/abc", wantOk: false},
+	}
+	for _, tc := range tests {
+		ref := c.Doc(tc.path)
+		got, ok := reportDataAccountId(ref)
+		if ok != tc.wantOk || got != tc.want {
+			t.Errorf("reportDataAccountId(%s) = %s, %t, want: %s, %t", tc.path, got, ok, tc.want, tc.wantOk)
+		}
+		if rel := reportDataRelativePath(ref); rel != tc.path {
+			t.Errorf("reportDataRelativePath(%s) = %s", tc.path, rel)
+		}
+	}
+}
+
+// each age field keeps its own cursor, so the passes over a dataType don't resume each other
+func TestRetentionCursorReference(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	defer c.Close()
+	tests := []struct {
+		collection string
+		ageField   string
+		want       string
+	}{
+		{collection: "report_data", ageField: "reportTimestamp", want: "firestream/retention/cursor/status@reportTimestamp"},
+		{collection: "report_data", ageField: "recordTimestamp", want: "firestream/retention/cursor/status@recordTimestamp"},
+		{collection: reportDataV2Collection, ageField: "reportTimestamp", want: "firestream/retention/cursor/" + reportDataV2Collection + ":status@reportTimestamp"},
+	}
+	for _, tc := range tests {
+		ref := retentionCursorReference(c, tc.collection, "status", tc.ageField)
+		if got := reportDataRelativePath(ref); got != tc.want {
+			t.Errorf("retentionCursorReference(%s, status, %s) = %s, want: %s", tc.collection, tc.ageField, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Every document we write carries a schemaVersion so clients can tell layouts apart.
+// Documents written before versioning have no schemaVersion and are V1 in all but name,
+// `firestream migrate -from 0 -to 1` stamps them.
+const schemaVersionV1 int = 1
+const schemaVersionV2 int = 2
+
+// V2 transponder reports live next to report_data in report_data_v2, with the same document id
+const reportDataV2Collection string = "report_data_v2"
+
+// V2 transponder report, V1 fields grouped the way the CL API stream sends them
+type FirestoreTransponderReportV2 struct {
+	Serial            float64                 `firestore:"serial,omitempty"`
+	Type              string                  `firestore:"type"` // this is the "dataType" field of a streaming packet
+	ReportTimestamp   time.Time               `firestore:"reportTimestamp,omitempty"`
+	Event             TransponderEventV2      `firestore:"event"`
+	Location          *TransponderLocationV2  `firestore:"location,omitempty"` // omitted for reports without a position
+	Geohash           *GeohashesV1            `firestore:"geohash,omitempty"`  // omitted along with location
+	Parameters        TransponderParametersV2 `firestore:"parameters"`
+	GeoTags           []GeoTagV1              `firestore:"geoTags,omitempty"`
+	Functions         *TransponderFunctionsV1 `firestore:"functions,omitempty"`
+	SchemaVersion     int                     `firestore:"schemaVersion"`
+	FirestoreCreation time.Time               `firestore:"fsCreateTimestamp,serverTimestamp"` // if zero, Firestore sets this on their end
+}
+type TransponderEventV2 struct {
+	ConfigId   float64   `firestore:"configId,omitempty"`
+	EventStart time.Time `firestore:"eventStart,omitempty"`
+	Duration   float64   `firestore:"duration,omitempty"`
+	InProgress bool      `firestore:"inProgress"`
+}
+type TransponderLocationV2 struct {
+	LatLng         *latlng.LatLng `firestore:"latLng"`
+	Accuracy       float64        `firestore:"accuracy,omitempty"`
+	Heading        float64        `firestore:"heading,omitempty"`
+	Address        string         `firestore:"address,omitempty"`
+	DotOrientation string         `firestore:"dotOrientation,omitempty"`
+}
+type TransponderParametersV2 struct {
+	BatteryVoltage     float64 `firestore:"batteryVoltage,omitempty"`
+	CellSignalStrength float64 `firestore:"cellSignalStrength,omitempty"`
+	IsLowBattery       bool    `firestore:"isLowBatteryVoltage"`
+	Odometer           float64 `firestore:"odometer,omitempty"`
+	Speed              float64 `firestore:"speed"`
+	SpeedLimit         float64 `firestore:"speedLimit,omitempty"`
+}
+
+// V2 sibling of a V1 report_data document reference
+func reportDataV2Reference(ref *firestore.DocumentRef) *firestore.DocumentRef {
+	return ref.Parent.Parent.Collection(reportDataV2Collection).Doc(ref.ID)
+}
+
+// regroup a V1 transponder report into the V2 layout
+func transponderReportV1ToV2(v1 FirestoreTransponderReportV1) FirestoreTransponderReportV2 {
+	v2 := FirestoreTransponderReportV2{
+		Serial:          v1.Serial,
+		Type:            v1.Type,
+		ReportTimestamp: v1.ReportTimestamp,
+		Event: TransponderEventV2{
+			ConfigId:   v1.ConfigId,
+			EventStart: v1.EventStart,
+			Duration:   v1.Duration,
+			InProgress: v1.InProgress,
+		},
+		Parameters: TransponderParametersV2{
+			BatteryVoltage:     v1.BatteryVoltage,
+			CellSignalStrength: v1.CellSignalStrength,
+			IsLowBattery:       v1.IsLowBattery,
+			Odometer:           v1.Odometer,
+			Speed:              v1.Speed,
+			SpeedLimit:         v1.SpeedLimit,
+		},
+		Geohash:           v1.Geohash,
+		GeoTags:           v1.GeoTags,
+		Functions:         v1.Functions,
+		SchemaVersion:     schemaVersionV2,
+		FirestoreCreation: v1.FirestoreCreation,
+	}
+	if v1.LatLng != nil {
+		v2.Location = &TransponderLocationV2{
+			LatLng:         v1.LatLng,
+			Accuracy:       v1.LocationAccuracy,
+			Heading:        v1.Heading,
+			Address:        v1.Address,
+			DotOrientation: v1.DotOrientation,
+		}
+	}
+	return v2
+}
+
+// flatten a V2 transponder report back into the V1 layout
+func transponderReportV2ToV1(v2 FirestoreTransponderReportV2) FirestoreTransponderReportV1 {
+	v1 := FirestoreTransponderReportV1{
+		Serial:             v2.Serial,
+		Type:               v2.Type,
+		ReportTimestamp:    v2.ReportTimestamp,
+		ConfigId:           v2.Event.ConfigId,
+		EventStart:         v2.Event.EventStart,
+		Duration:           v2.Event.Duration,
+		InProgress:         v2.Event.InProgress,
+		BatteryVoltage:     v2.Parameters.BatteryVoltage,
+		CellSignalStrength: v2.Parameters.CellSignalStrength,
+		IsLowBattery:       v2.Parameters.IsLowBattery,
+		Odometer:           v2.Parameters.Odometer,
+		Speed:              v2.Parameters.Speed,
+		SpeedLimit:         v2.Parameters.SpeedLimit,
+		Geohash:            v2.Geohash,
+		GeoTags:            v2.GeoTags,
+		Functions:          v2.Functions,
+		SchemaVersion:      schemaVersionV1,
+		FirestoreCreation:  v2.FirestoreCreation,
+	}
+	if v2.Location != nil {
+		v1.LatLng = v2.Location.LatLng
+		v1.LocationAccuracy = v2.Location.Accuracy
+		v1.Heading = v2.Location.Heading
+		v1.Address = v2.Location.Address
+		v1.DotOrientation = v2.Location.DotOrientation
+	}
+	return v1
+}
+
+// parse a comma separated list of transponder report schema versions to write, ex "1,2"
+func parseSchemaVersions(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	var versions []int
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || (v != schemaVersionV1 && v != schemaVersionV2) {
+			return nil, fmt.Errorf("unsupported schema version %q", field)
+		}
+		if !seen[v] {
+			seen[v] = true
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// are we writing transponder reports in this schema version?
+func writesSchemaVersion(v int) bool {
+	for _, w := range transponderSchemaVersions {
+		if w == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func TestParseSchemaVersions(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "1", want: []int{1}},
+		{in: "2, 1", want: []int{1, 2}},
+		{in: "1,1", want: []int{1}},
+		{in: "3", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "v2", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseSchemaVersions(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseSchemaVersions(%q) error = %v, wantErr: %t", tc.in, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSchemaVersions(%q) = %v, want: %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// migrating a report to V2 and back must not lose anything
+func TestTransponderReportV2RoundTrip(t *testing.T) {
+	ts := time.Date(2021, 2, 17, 15, 53, 48, 453000000, time.UTC)
+	reports := []FirestoreTransponderReportV1{
+		{
+			ConfigId: 473119, Duration: 488131, EventStart: ts.Add(-time.Minute), InProgress: true,
+			LocationAccuracy: 1.243, Heading: 284.9672, Address: "1 Main St", DotOrientation: "N",
+			LatLng:         &latlng.LatLng{Latitude: 41.4189561, Longitude: -70.5877681},
+			Geohash:        geohashes(&latlng.LatLng{Latitude: 41.4189561, Longitude: -70.5877681}),
+			BatteryVoltage: 12.369361, CellSignalStrength: -51, IsLowBattery: true, Odometer: 12000,
+			Speed: 12.5, SpeedLimit: 30, ReportTimestamp: ts, Serial: 519372, Type: "parking",
+			SchemaVersion: schemaVersionV1,
+			GeoTags:       []GeoTagV1{{GeoZoneId: 7, TagName: "yard", TagSource: "account", Timestamp: ts}},
+		},
+		{ReportTimestamp: ts, Serial: 519372, Type: "status", BatteryVoltage: 12.1, SchemaVersion: schemaVersionV1},
+		{
+			ReportTimestamp: ts, Serial: 519372, Type: "status", SchemaVersion: schemaVersionV1,
+			Functions: &TransponderFunctionsV1{Average: map[string]float64{"batteryVoltage": 12.37}, Integrate: map[string]float64{"speed": 3.04}},
+		},
+	}
+	for _, v1 := range reports {
+		v2 := transponderReportV1ToV2(v1)
+		if v2.SchemaVersion != schemaVersionV2 {
+			t.Errorf("transponderReportV1ToV2(%s).SchemaVersion = %d, want: %d", v1.Type, v2.SchemaVersion, schemaVersionV2)
+		}
+		if (v1.LatLng == nil) != (v2.Location == nil) {
+			t.Errorf("transponderReportV1ToV2(%s).Location = %v, want it present only with a position", v1.Type, v2.Location)
+		}
+		if back := transponderReportV2ToV1(v2); !reflect.DeepEqual(back, v1) {
+			t.Errorf("transponderReportV2ToV1(transponderReportV1ToV2(%s)) = %+v, want: %+v", v1.Type, back, v1)
+		}
+	}
+}
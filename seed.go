@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Trackers keep their state in memory and pick up where Firestore left off the first time they
+// see a key. known says whether the key is in memory already and keep stores what read fetched,
+// both are called with mu held. read runs without it, Firestore reads are slow. Nothing is kept
+// when read fails, so the caller can skip its write rather than overwrite what's stored with
+// state that only knows about this boot.
+func seedTracker(mu *sync.Mutex, known func() bool, read func() error, keep func()) error {
+	mu.Lock()
+	seeded := known()
+	mu.Unlock()
+	if seeded {
+		return nil
+	}
+	if err := read(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !known() {
+		keep()
+	}
+	return nil
+}
+
+// read a document a tracker seeds from into v, found is false when it doesn't exist
+func readSeedDocument(ctx context.Context, ref *firestore.DocumentRef, v interface{}) (found bool, err error) {
+	var snap *firestore.DocumentSnapshot
+	err = withFirestoreRetry(ctx, func(attemptCtx context.Context) error {
+		s, getErr := ref.Get(attemptCtx)
+		snap = s
+		return getErr
+	})
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, snap.DataTo(v)
+}
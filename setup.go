@@ -15,6 +15,33 @@ var DefaultmaxHugeDifferentialSetting float64 = 60000
 var DefaultmaxJSONParseErrors float64 = 100
 var DefaultNavajoIdMapRebuildTimer time.Duration = (120 * time.Second)
 var DefaultWebsocketTimeout time.Duration = (20 * time.Second)
+var DefaultFirestoreBatchSize int = 100
+var DefaultFirestoreBatchInterval time.Duration = (1 * time.Second)
+var DefaultFirestoreMetricsInterval time.Duration = (60 * time.Second)
+var DefaultFirestoreWriteTimeout time.Duration = (10 * time.Second)
+var DefaultFirestoreWriteAttempts int = 5
+var DefaultFirestoreRetryBackoff time.Duration = (250 * time.Millisecond)
+var DefaultFirestoreMaxRetryBackoff time.Duration = (10 * time.Second)
+var DefaultFirestoreDeadLetterFile string = "/tmp/firestream_deadletter.jsonl"
+var DefaultFirestoreSchemaVersions string = "1"
+var DefaultFirestoreDocWriteInterval time.Duration = (1 * time.Second)
+var DefaultFirestoreMaxWriteRate int = 10000 // Firestore's own per-database write limit
+var DefaultInactiveRate time.Duration = 0    // status reports aren't throttled unless asked for
+var DefaultTurndownTime int = 300000         // milliseconds
+var DefaultRetentionBatchSize int = 200
+var DefaultRetentionBatchInterval time.Duration = (1 * time.Second)
+var DefaultRetentionInterval time.Duration = 0 // retention only runs from the prune subcommand unless asked for
+var DefaultFleetSnapshotInterval time.Duration = (10 * time.Second)
+var DefaultTripGapTimeout time.Duration = (15 * time.Minute)
+var DefaultTripMaxPoints int = 1000
+var DefaultEldDailyTimeZone string = "UTC"
+var DefaultEldRecordTypes string = "navigation" // the only ELD dataType confirmed against the stream
+var DefaultVideoUploadStallTimeout time.Duration = (5 * time.Minute)
+var DefaultVideoUrlExpiration time.Duration = (24 * time.Hour)
+var DefaultVideoLinkWindow time.Duration = (30 * time.Second)
+var DefaultGeocodeFormat string = "csv"
+var DefaultGeocodeMaxDistance int = 1000 // meters
+var DefaultGeocodeCacheSize int = 10000
 
 func parseEnvConfigs() error {
 	// Environment variables in OS are config values
@@ -35,15 +62,23 @@ func parseEnvConfigs() error {
 	// Tunables
 	const envMaxHugeDifferentialSetting string = "METRICS_HUGEDIFFIGNORE"
 	const envMaxJsonParseErrors string = "JSON_ERRORS_BEFORE_RESTART"
-	const envNavajoIdMapRebuildTimer string = "NAVAJO_MAP_REBUILD_TIMER" // ex "30s" for 30 second timer
-	const envWebsocketTimeout string = "WEBSOCKET_TIMEOUT"               // ex "30s"
-
-	// GCP - firestore, ...
+	const envNavajoIdMapRebuildTimer string = "NAVAJO_MAP_REBUILD_TIMER"   // ex "30s" for 30 second timer
+	const envWebsocketTimeout string = "WEBSOCKET_TIMEOUT"                 // ex "30s"
+	const envInactiveRate string = "INACTIVE_RATE"                         // ex "60s", status write rate for unwatched transponders
+	const envTurndownTime string = "TURNDOWN_TIME"                         // milliseconds a client live request stays active
+	const envFleetSnapshotInterval string = "FLEET_SNAPSHOT_INTERVAL"      // ex "10s", debounce for account fleet snapshot writes
+	const envTripGapTimeout string = "TRIP_GAP_TIMEOUT"                    // ex "15m", open trips finalize after this long without reports
+	const envTripMaxPoints string = "TRIP_MAX_POINTS"                      // most positions kept in a trip's polyline
+	const envEldDailyTimeZone string = "ELD_DAILY_TIMEZONE"                // ex "America/New_York", days of driver daily rollups
+	const envEldRecordTypes string = "ELD_RECORD_TYPES"                    // ex "navigation,duty_status", ELD record dataTypes to write
+	const envVideoUploadStallTimeout string = "VIDEO_UPLOAD_STALL_TIMEOUT" // ex "5m", footage uploads without a new chunk for this long are stalled
+	const envVideoUrlExpiration string = "VIDEO_URL_EXPIRATION"            // ex "24h", footage signed URLs are valid this long, "168h" at most
+	const envVideoLinkWindow string = "VIDEO_LINK_WINDOW"                  // ex "30s", video and hard events this close together are linked
+	const envGeocodeDataset string = "GEOCODE_DATASET"                     // path of the places addresses are looked up in, unset disables geocoding
+	const envGeocodeFormat string = "GEOCODE_FORMAT"                       // csv or geonames
+	const envGeocodeMaxDistance string = "GEOCODE_MAX_DISTANCE"            // meters, positions further than this from every place get no address
+	const envGeocodeCacheSize string = "GEOCODE_CACHE_SIZE"                // addresses kept in the LRU cache
 	const envGoogleApplicationCredentials string = "GOOGLE_APPLICATION_CREDENTIALS"
-	const envGoogleProjectId string = "GOOGLE_PROJECT_ID"
-
-	// Default log level is INFO, turn on DEBUG level logging by setting DEBUG=true
-	const envDebugLogLevel string = "DEBUG"
 
 	// cl api oauth
 	authConf.url = os.Getenv(envClApiURL)
@@ -125,6 +160,246 @@ func parseEnvConfigs() error {
 			return errors.New(errMsg)
 		}
 	}
+	var err error
+	inactiveRate, err = lookupEnvDuration(envInactiveRate, DefaultInactiveRate)
+	if err != nil {
+		return err
+	}
+	turndownMillis, err := lookupEnvInt(envTurndownTime, DefaultTurndownTime)
+	if err != nil {
+		return err
+	}
+	if turndownMillis <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be a positive number of milliseconds\n", envTurndownTime)
+		return errors.New(errMsg)
+	}
+	turndownTime = time.Duration(turndownMillis) * time.Millisecond
+	fleetSnapshotInterval, err = lookupEnvDuration(envFleetSnapshotInterval, DefaultFleetSnapshotInterval)
+	if err != nil {
+		return err
+	}
+	if fleetSnapshotInterval <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive\n", envFleetSnapshotInterval)
+		return errors.New(errMsg)
+	}
+	tripGapTimeout, err = lookupEnvDuration(envTripGapTimeout, DefaultTripGapTimeout)
+	if err != nil {
+		return err
+	}
+	if tripGapTimeout <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive\n", envTripGapTimeout)
+		return errors.New(errMsg)
+	}
+	tripMaxPoints, err = lookupEnvInt(envTripMaxPoints, DefaultTripMaxPoints)
+	if err != nil {
+		return err
+	}
+	if tripMaxPoints < 2 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be at least 2\n", envTripMaxPoints)
+		return errors.New(errMsg)
+	}
+	eldDailyTimeZone, eldDailyTimeZoneOk := os.LookupEnv(envEldDailyTimeZone)
+	if !eldDailyTimeZoneOk {
+		// take the default
+		eldDailyTimeZone = DefaultEldDailyTimeZone
+		log.Infof("Using default %s setting of: %v\n", envEldDailyTimeZone, eldDailyTimeZone)
+	} else {
+		log.Infof("Using custom %s setting of: %v\n", envEldDailyTimeZone, eldDailyTimeZone)
+	}
+	eldDailyLocation, err = time.LoadLocation(eldDailyTimeZone)
+	if err != nil {
+		errMsg := fmt.Sprintf("EXIT FATAL: unable to set %s: %v\n", envEldDailyTimeZone, err)
+		return errors.New(errMsg)
+	}
+	recordTypes, recordTypesOk := os.LookupEnv(envEldRecordTypes)
+	if !recordTypesOk {
+		// take the default
+		recordTypes = DefaultEldRecordTypes
+	}
+	eldRecordTypes, err = parseEldRecordTypes(recordTypes)
+	if err != nil {
+		errMsg := fmt.Sprintf("EXIT FATAL: unable to set %s: %v\n", envEldRecordTypes, err)
+		return errors.New(errMsg)
+	}
+	for dataType := range eldRecordTypes {
+		if dataType != "navigation" {
+			log.Warnf("%s turns on %s, an ELD dataType not yet confirmed against the stream\n", envEldRecordTypes, dataType)
+		}
+	}
+	videoUploadStallTimeout, err = lookupEnvDuration(envVideoUploadStallTimeout, DefaultVideoUploadStallTimeout)
+	if err != nil {
+		return err
+	}
+	if videoUploadStallTimeout <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive\n", envVideoUploadStallTimeout)
+		return errors.New(errMsg)
+	}
+	videoUrlExpiration, err = lookupEnvDuration(envVideoUrlExpiration, DefaultVideoUrlExpiration)
+	if err != nil {
+		return err
+	}
+	if videoUrlExpiration <= 0 || videoUrlExpiration > maxSignedUrlExpiration {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive and at most %v\n", envVideoUrlExpiration, maxSignedUrlExpiration)
+		return errors.New(errMsg)
+	}
+	videoLinkWindow, err = lookupEnvDuration(envVideoLinkWindow, DefaultVideoLinkWindow)
+	if err != nil {
+		return err
+	}
+	if videoLinkWindow < 0 || videoLinkWindow > videoLinkMemory {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be between 0 and %v\n", envVideoLinkWindow, videoLinkMemory)
+		return errors.New(errMsg)
+	}
+	// footage URLs are signed with the service account key, without one they're left out
+	signer, signerErr := loadFootageUrlSigner(os.Getenv(envGoogleApplicationCredentials))
+	if signerErr != nil {
+		log.Warnf("Footage signed URLs disabled, unable to load a service account key from %s: %v\n", envGoogleApplicationCredentials, signerErr)
+	}
+	footageUrlSigner = signer
+
+	// addresses come from a local dataset, geocoding is off without one
+	if dataset := os.Getenv(envGeocodeDataset); dataset != "" {
+		format := os.Getenv(envGeocodeFormat)
+		if format == "" {
+			format = DefaultGeocodeFormat
+		}
+		maxDistance, err := lookupEnvInt(envGeocodeMaxDistance, DefaultGeocodeMaxDistance)
+		if err != nil {
+			return err
+		}
+		cacheSize, err := lookupEnvInt(envGeocodeCacheSize, DefaultGeocodeCacheSize)
+		if err != nil {
+			return err
+		}
+		if maxDistance <= 0 || cacheSize < 0 {
+			errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive and %s can't be negative\n", envGeocodeMaxDistance, envGeocodeCacheSize)
+			return errors.New(errMsg)
+		}
+		reverseGeocoder, err = loadReverseGeocoder(dataset, format, float64(maxDistance), cacheSize)
+		if err != nil {
+			errMsg := fmt.Sprintf("EXIT FATAL: unable to load %s: %v\n", envGeocodeDataset, err)
+			return errors.New(errMsg)
+		}
+		log.Infof("Reverse geocoding from %s\n", dataset)
+	}
+
+	// report_data retention
+	err = parseRetentionEnvConfigs()
+	if err != nil {
+		return err
+	}
+
+	// firestore sink, GCP credentials and log level
+	return parseFirestoreEnvConfigs()
+}
+
+// Firestore and GCP config is shared by the streaming service and its subcommands (prune, ...)
+func parseFirestoreEnvConfigs() error {
+	const envFirestoreBatchSize string = "FIRESTORE_BATCH_SIZE"                // max writes per WriteBatch, 500 at most
+	const envFirestoreBatchInterval string = "FIRESTORE_BATCH_INTERVAL"        // ex "1s", flush partial batches this often
+	const envFirestoreMetricsInterval string = "FIRESTORE_METRICS_INTERVAL"    // ex "60s"
+	const envFirestoreWriteTimeout string = "FIRESTORE_WRITE_TIMEOUT"          // ex "10s", deadline for each write attempt
+	const envFirestoreWriteAttempts string = "FIRESTORE_WRITE_ATTEMPTS"        // attempts before a transient error is given up on
+	const envFirestoreRetryBackoff string = "FIRESTORE_RETRY_BACKOFF"          // ex "250ms", doubles after each attempt
+	const envFirestoreMaxRetryBackoff string = "FIRESTORE_MAX_RETRY_BACKOFF"   // ex "10s"
+	const envFirestoreDeadLetterFile string = "FIRESTORE_DEADLETTER_FILE"      // writes Firestore wouldn't take end up here
+	const envFirestoreSchemaVersions string = "FIRESTORE_SCHEMA_VERSIONS"      // ex "1,2", transponder report schema versions to write
+	const envFirestoreDocWriteInterval string = "FIRESTORE_DOC_WRITE_INTERVAL" // ex "1s", writes to one document are coalesced within this
+	const envFirestoreMaxWriteRate string = "FIRESTORE_MAX_WRITE_RATE"         // writes per second across all documents, 0 is unlimited
+
+	// GCP - firestore, ...
+	const envGoogleApplicationCredentials string = "GOOGLE_APPLICATION_CREDENTIALS"
+	const envGoogleProjectId string = "GOOGLE_PROJECT_ID"
+
+	// Default log level is INFO, turn on DEBUG level logging by setting DEBUG=true
+	const envDebugLogLevel string = "DEBUG"
+
+	var err error
+	firestoreBatchSize, err = lookupEnvInt(envFirestoreBatchSize, DefaultFirestoreBatchSize)
+	if err != nil {
+		return err
+	}
+	if firestoreBatchSize < 1 || firestoreBatchSize > firestoreMaxBatchSize {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be between 1 and %d\n", envFirestoreBatchSize, firestoreMaxBatchSize)
+		return errors.New(errMsg)
+	}
+	firestoreBatchInterval, err = lookupEnvDuration(envFirestoreBatchInterval, DefaultFirestoreBatchInterval)
+	if err != nil {
+		return err
+	}
+	if firestoreBatchInterval <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive\n", envFirestoreBatchInterval)
+		return errors.New(errMsg)
+	}
+	firestoreMetricsInterval, err = lookupEnvDuration(envFirestoreMetricsInterval, DefaultFirestoreMetricsInterval)
+	if err != nil {
+		return err
+	}
+	if firestoreMetricsInterval <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive\n", envFirestoreMetricsInterval)
+		return errors.New(errMsg)
+	}
+	firestoreWriteTimeout, err = lookupEnvDuration(envFirestoreWriteTimeout, DefaultFirestoreWriteTimeout)
+	if err != nil {
+		return err
+	}
+	if firestoreWriteTimeout <= 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive\n", envFirestoreWriteTimeout)
+		return errors.New(errMsg)
+	}
+	firestoreWriteAttempts, err = lookupEnvInt(envFirestoreWriteAttempts, DefaultFirestoreWriteAttempts)
+	if err != nil {
+		return err
+	}
+	if firestoreWriteAttempts < 1 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be at least 1\n", envFirestoreWriteAttempts)
+		return errors.New(errMsg)
+	}
+	firestoreRetryBackoff, err = lookupEnvDuration(envFirestoreRetryBackoff, DefaultFirestoreRetryBackoff)
+	if err != nil {
+		return err
+	}
+	firestoreMaxRetryBackoff, err = lookupEnvDuration(envFirestoreMaxRetryBackoff, DefaultFirestoreMaxRetryBackoff)
+	if err != nil {
+		return err
+	}
+	if firestoreRetryBackoff <= 0 || firestoreMaxRetryBackoff < firestoreRetryBackoff {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be positive and no larger than %s\n", envFirestoreRetryBackoff, envFirestoreMaxRetryBackoff)
+		return errors.New(errMsg)
+	}
+	deadLetterFile, deadLetterFileOk := os.LookupEnv(envFirestoreDeadLetterFile)
+	if !deadLetterFileOk {
+		// take the default
+		firestoreDeadLetterFile = DefaultFirestoreDeadLetterFile
+	} else {
+		firestoreDeadLetterFile = deadLetterFile
+	}
+	firestoreDocWriteInterval, err = lookupEnvDuration(envFirestoreDocWriteInterval, DefaultFirestoreDocWriteInterval)
+	if err != nil {
+		return err
+	}
+	if firestoreDocWriteInterval < 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s can't be negative\n", envFirestoreDocWriteInterval)
+		return errors.New(errMsg)
+	}
+	firestoreMaxWriteRate, err = lookupEnvInt(envFirestoreMaxWriteRate, DefaultFirestoreMaxWriteRate)
+	if err != nil {
+		return err
+	}
+	if firestoreMaxWriteRate < 0 {
+		errMsg := fmt.Sprintf("EXIT FATAL: %s can't be negative\n", envFirestoreMaxWriteRate)
+		return errors.New(errMsg)
+	}
+	schemaVersions, schemaVersionsOk := os.LookupEnv(envFirestoreSchemaVersions)
+	if !schemaVersionsOk {
+		// take the default
+		schemaVersions = DefaultFirestoreSchemaVersions
+	}
+	transponderSchemaVersions, err = parseSchemaVersions(schemaVersions)
+	if err != nil {
+		errMsg := fmt.Sprintf("EXIT FATAL: unable to set %s: %v\n", envFirestoreSchemaVersions, err)
+		return errors.New(errMsg)
+	}
 	// GCP - the gcp libraries will auto-config your GCP API access when
 	// run within GCP's cloud environment. This app isn't always somewhere
 	// where auto-detect works, so we enforce that this service key is set to something..
@@ -153,3 +428,75 @@ func parseEnvConfigs() error {
 
 	return nil
 }
+
+// report_data retention config is shared by the streaming service and the prune subcommand
+func parseRetentionEnvConfigs() error {
+	const envRetentionPolicyFile string = "RETENTION_POLICY_FILE"       // JSON retention per dataType, with per-account overrides
+	const envRetentionBatchSize string = "RETENTION_BATCH_SIZE"         // documents read (and at most deleted) per batch
+	const envRetentionBatchInterval string = "RETENTION_BATCH_INTERVAL" // ex "1s", pause between batches
+	const envRetentionInterval string = "RETENTION_INTERVAL"            // ex "24h", run retention in the background this often
+
+	policyFile, policyFileOk := os.LookupEnv(envRetentionPolicyFile)
+	if !policyFileOk {
+		// take the default
+		retentionPolicy = defaultRetentionPolicy()
+	} else {
+		var err error
+		retentionPolicy, err = loadRetentionPolicy(policyFile)
+		if err != nil {
+			errMsg := fmt.Sprintf("EXIT FATAL: unable to load %s from %s: %v\n", envRetentionPolicyFile, policyFile, err)
+			return errors.New(errMsg)
+		}
+	}
+	var err error
+	retentionBatchSize, err = lookupEnvInt(envRetentionBatchSize, DefaultRetentionBatchSize)
+	if err != nil {
+		return err
+	}
+	if retentionBatchSize < 1 || retentionBatchSize > firestoreMaxBatchSize-1 {
+		// one slot in each delete batch is taken by our cursor
+		errMsg := fmt.Sprintf("EXIT FATAL: %s must be between 1 and %d\n", envRetentionBatchSize, firestoreMaxBatchSize-1)
+		return errors.New(errMsg)
+	}
+	retentionBatchInterval, err = lookupEnvDuration(envRetentionBatchInterval, DefaultRetentionBatchInterval)
+	if err != nil {
+		return err
+	}
+	retentionInterval, err = lookupEnvDuration(envRetentionInterval, DefaultRetentionInterval)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// look up an optional time.Duration knob (ex "30s"), falling back to def when unset
+func lookupEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		log.Infof("Using default %s setting of: %v\n", key, def)
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		errMsg := fmt.Sprintf("EXIT FATAL: unable to set %s\n", key)
+		return def, errors.New(errMsg)
+	}
+	log.Infof("Using custom %s setting of: %v\n", key, d)
+	return d, nil
+}
+
+// look up an optional integer knob, falling back to def when unset
+func lookupEnvInt(key string, def int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		log.Infof("Using default %s setting of: %v\n", key, def)
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		errMsg := fmt.Sprintf("EXIT FATAL: unable to set %s\n", key)
+		return def, errors.New(errMsg)
+	}
+	log.Infof("Using custom %s setting of: %v\n", key, i)
+	return i, nil
+}
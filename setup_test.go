@@ -31,3 +31,83 @@ func TestParseEnvConfigs(t *testing.T) {
 	}
 
 }
+
+// Firestore refuses batches over 500 writes, make sure we refuse to start with one
+func TestParseEnvConfigsFirestoreBatchSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "default", value: "", wantErr: false},
+		{name: "custom", value: "250", wantErr: false},
+		{name: "too large", value: "501", wantErr: true},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "not a number", value: "lots", wantErr: true},
+	}
+	TestParseEnvConfigs(t) // populate required environment vars
+	defer os.Unsetenv("FIRESTORE_BATCH_SIZE")
+	for _, tc := range tests {
+		if tc.value == "" {
+			os.Unsetenv("FIRESTORE_BATCH_SIZE")
+		} else {
+			os.Setenv("FIRESTORE_BATCH_SIZE", tc.value)
+		}
+		err := parseEnvConfigs()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: parseEnvConfigs() error = %v, wantErr %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// a live request that turns itself down immediately would silently disable live viewing
+func TestParseEnvConfigsTurndownTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "default", value: "", wantErr: false},
+		{name: "custom", value: "60000", wantErr: false},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "negative", value: "-1000", wantErr: true},
+		{name: "not a number", value: "5m", wantErr: true},
+	}
+	TestParseEnvConfigs(t) // populate required environment vars
+	defer os.Unsetenv("TURNDOWN_TIME")
+	for _, tc := range tests {
+		if tc.value == "" {
+			os.Unsetenv("TURNDOWN_TIME")
+		} else {
+			os.Setenv("TURNDOWN_TIME", tc.value)
+		}
+		err := parseEnvConfigs()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: parseEnvConfigs() error = %v, wantErr %t", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// sink tickers panic on a non-positive interval and a zero timeout fails every commit
+func TestParseEnvConfigsFirestoreDurations(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{key: "FIRESTORE_BATCH_INTERVAL", value: "500ms", wantErr: false},
+		{key: "FIRESTORE_BATCH_INTERVAL", value: "0s", wantErr: true},
+		{key: "FIRESTORE_METRICS_INTERVAL", value: "-1m", wantErr: true},
+		{key: "FIRESTORE_WRITE_TIMEOUT", value: "0s", wantErr: true},
+		{key: "FIRESTORE_WRITE_TIMEOUT", value: "5s", wantErr: false},
+	}
+	TestParseEnvConfigs(t) // populate required environment vars
+	for _, tc := range tests {
+		os.Setenv(tc.key, tc.value)
+		err := parseEnvConfigs()
+		os.Unsetenv(tc.key)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s=%s: parseEnvConfigs() error = %v, wantErr %t", tc.key, tc.value, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Dashcam footage lives in private Cloud Storage buckets the apps can't read, so footage entries
+// carry a V4 signed URL for their privateFilePath, valid for VIDEO_URL_EXPIRATION. URLs are signed
+// locally with the service account key at GOOGLE_APPLICATION_CREDENTIALS.
+const signedUrlHost string = "storage.googleapis.com"
+
+// V4 signed URLs can't be valid for longer than a week
+const maxSignedUrlExpiration time.Duration = 7 * 24 * time.Hour
+
+// Clients that need fresh URLs for a video event's footage write a document to
+// /account/{id}/footage_url_request/{id}, the account's security rules decide who may.
+// Firestream re-signs the footage of that account's video event, updates the event
+// and answers the request with the new URLs.
+const footageUrlRequestCollection string = "footage_url_request"
+
+// signs footage URLs as a service account
+type FootageUrlSigner struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+// the parts of a service account key file we sign with
+type serviceAccountKeyV1 struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// read a service account key file, only service account keys can sign URLs
+func loadFootageUrlSigner(path string) (*FootageUrlSigner, error) {
+	keyFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := serviceAccountKeyV1{}
+	if err := json.Unmarshal(keyFile, &k); err != nil {
+		return nil, err
+	}
+	if k.Type != "service_account" || k.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is a %q credential, not a service account key", path, k.Type)
+	}
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s has no PEM private_key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		// older keys are PKCS#1
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s private_key isn't an RSA key", path)
+	}
+	return &FootageUrlSigner{email: k.ClientEmail, key: key}, nil
+}
+
+// split gs://bucket/object into its bucket and object
+func splitGsPath(gsPath string) (bucket string, object string, ok bool) {
+	if !strings.HasPrefix(gsPath, "gs://") {
+		return ``, ``, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(gsPath, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ``, ``, false
+	}
+	return parts[0], parts[1], true
+}
+
+// percent-encode everything but RFC 3986 unreserved characters, and slashes when asked
+func signedUrlEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// the V4 canonical request and string to sign for a GET of an object, and the URL's query
+func signedUrlRequest(email string, bucket string, object string, at time.Time, expires time.Duration) (canonicalQuery string, stringToSign string, path string) {
+	at = at.UTC()
+	timestamp := at.Format("20060102T150405Z")
+	scope := at.Format("20060102") + "/auto/storage/goog4_request"
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    email + "/" + scope,
+		"X-Goog-Date":          timestamp,
+		"X-Goog-Expires":       fmt.Sprintf("%d", int64(expires/time.Second)),
+		"X-Goog-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, signedUrlEscape(k, false)+"="+signedUrlEscape(query[k], false))
+	}
+	canonicalQuery = strings.Join(params, "&")
+	path = "/" + bucket + "/" + signedUrlEscape(object, true)
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		path,
+		canonicalQuery,
+		"host:" + signedUrlHost + "\n", // canonical headers end with a newline of their own
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign = strings.Join([]string{"GOOG4-RSA-SHA256", timestamp, scope, hex.EncodeToString(hash[:])}, "\n")
+	return canonicalQuery, stringToSign, path
+}
+
+// a V4 signed URL for a gs:// path, valid from at for expires, and when it expires
+func (s *FootageUrlSigner) signedUrl(gsPath string, at time.Time, expires time.Duration) (string, time.Time, error) {
+	bucket, object, ok := splitGsPath(gsPath)
+	if !ok {
+		return ``, time.Time{}, fmt.Errorf("%q isn't a gs://bucket/object path", gsPath)
+	}
+	if expires <= 0 || expires > maxSignedUrlExpiration {
+		return ``, time.Time{}, fmt.Errorf("signed URLs expire after at most %v, not %v", maxSignedUrlExpiration, expires)
+	}
+	canonicalQuery, stringToSign, path := signedUrlRequest(s.email, bucket, object, at, expires)
+	hash := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return ``, time.Time{}, err
+	}
+	url := "https://" + signedUrlHost + path + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature)
+	return url, at.Add(expires).UTC().Truncate(time.Second), nil
+}
+
+// sign every footage entry's privateFilePath, leaving entries we can't sign alone
+func signFootage(footage []VideoReportFootageV1, footageId string, at time.Time) (signed int) {
+	if footageUrlSigner == nil {
+		return 0
+	}
+	for i, f := range footage {
+		if f.FootagePath == "" || (footageId != "" && f.FootageId != footageId) {
+			continue
+		}
+		url, expiration, err := footageUrlSigner.signedUrl(f.FootagePath, at, videoUrlExpiration)
+		if err != nil {
+			log.Warnf("Unable to sign a URL for footage %s: %v", f.FootageId, err)
+			continue
+		}
+		footage[i].SignedUrl = url
+		footage[i].SignedUrlExpiration = expiration
+		signed++
+	}
+	return signed
+}
+
+// listen to footage URL requests for as long as we're running, restarting the
+// listener if Firestore drops it
+func footageUrlRequestListener(ctx context.Context, c *firestore.Client) {
+	for {
+		err := listenFootageUrlRequests(ctx, c)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			log.Errorf("footageUrlRequestListener(): snapshot listener stopped, restarting: %v", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func listenFootageUrlRequests(ctx context.Context, c *firestore.Client) error {
+	it := c.CollectionGroup(footageUrlRequestCollection).Snapshots(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if err != nil {
+			return err
+		}
+		for _, change := range snap.Changes {
+			if change.Kind == firestore.DocumentRemoved {
+				continue
+			}
+			handleFootageUrlRequest(ctx, c, change.Doc)
+		}
+	}
+}
+
+// re-sign a video event's footage (or just footageId's) and answer the request with the new URLs
+func handleFootageUrlRequest(ctx context.Context, c *firestore.Client, doc *firestore.DocumentSnapshot) {
+	data := doc.Data()
+	requestTime, ok := data["clientRequestTime"].(time.Time)
+	if !ok {
+		log.Warnf("handleFootageUrlRequest(): %s has no clientRequestTime, ignoring", doc.Ref.Path)
+		return
+	}
+	// only answer each request once, our own answer comes back through the listener
+	if answered, ok := data["answeredRequestTime"].(time.Time); ok && answered.Equal(requestTime) {
+		return
+	}
+	answer := map[string]interface{}{
+		"answeredRequestTime": requestTime,
+		"firestreamOK":        true,
+	}
+	// a request only reaches video events of the account it was filed under
+	account := doc.Ref.Parent.Parent
+	if account == nil || account.Parent == nil || account.Parent.ID != "account" || account.Parent.Parent != nil {
+		log.Warnf("handleFootageUrlRequest(): %s isn't under an account, ignoring", doc.Ref.Path)
+		return
+	}
+	urls, err := refreshFootageUrls(ctx, c, account.ID, data)
+	if err != nil {
+		log.Warnf("Footage URL request %s: %v", doc.Ref.Path, err)
+		answer["firestreamOK"] = false
+		answer["error"] = err.Error()
+	} else {
+		answer["urls"] = urls
+	}
+	queueFirestoreWrite(ctx, FirestoreWriteV1{ref: doc.Ref, data: answer, opts: []firestore.SetOption{firestore.MergeAll}})
+}
+
+// sign a requested video event of an account again, writing the URLs back into the event. The
+// event goes through the video event tracker like a report would, so the footage written back
+// carries the upload progress of reports still on their way to Firestore.
+func refreshFootageUrls(ctx context.Context, c *firestore.Client, cwAccountId string, request map[string]interface{}) (map[string]interface{}, error) {
+	if footageUrlSigner == nil {
+		return nil, errors.New("footage URL signing is disabled, GOOGLE_APPLICATION_CREDENTIALS isn't a service account key")
+	}
+	vehicleId, _ := request["vehicleId"].(string)
+	videoEventId, _ := request["videoEventId"].(string)
+	footageId, _ := request["footageId"].(string)
+	for _, id := range []string{vehicleId, videoEventId} {
+		if !validFirestoreDocumentId(id) {
+			return nil, errors.New("vehicleId and videoEventId are required")
+		}
+	}
+	ref := videoEventReference(c, cwAccountId, vehicleId, videoEventId)
+	read := func() (event FirestoreVideoReportV1, found bool, err error) {
+		found, err = readSeedDocument(ctx, ref, &event)
+		return event, found, err
+	}
+	w, urls, err := videoEvents.refresh(cwAccountId, vehicleId, videoEventId, footageId, now(), read)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref.Path, err)
+	}
+	writeVideoEvents(ctx, c, []videoEventWrite{w})
+	return urls, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const signedUrlTestEmail = "firestream@test-project.iam.gserviceaccount.com"
+
+// write a throwaway service account key file the way GCP hands them out
+func testServiceAccountKey(t *testing.T, keyType string) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate a test key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the test key: %v", err)
+	}
+	keyFile, _ := json.Marshal(map[string]string{
+		"type":         keyType,
+		"client_email": signedUrlTestEmail,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	path := filepath.Join(t.TempDir(), "firestream.json")
+	if err := ioutil.WriteFile(path, keyFile, 0600); err != nil {
+		t.Fatalf("unable to write the test key: %v", err)
+	}
+	return path, key
+}
+
+// canonical query and path are encoded per the V4 signing spec
+func TestSignedUrlRequest(t *testing.T) {
+	at := time.Date(2021, 2, 20, 22, 0, 5, 0, time.UTC)
+	query, stringToSign, path := signedUrlRequest(signedUrlTestEmail, "dev-carmalinkapi-dashcamfootage", "b042ff/snapshot 0+1.jpg", at, time.Hour)
+
+	wantQuery := "X-Goog-Algorithm=GOOG4-RSA-SHA256" +
+		"&X-Goog-Credential=firestream%40test-project.iam.gserviceaccount.com%2F20210220%2Fauto%2Fstorage%2Fgoog4_request" +
+		"&X-Goog-Date=20210220T220005Z&X-Goog-Expires=3600&X-Goog-SignedHeaders=host"
+	if query != wantQuery {
+		t.Errorf("canonical query =\n%s\nwant\n%s", query, wantQuery)
+	}
+	if want := "/dev-carmalinkapi-dashcamfootage/b042ff/snapshot%200%2B1.jpg"; path != want {
+		t.Errorf("path = %s, want %s", path, want)
+	}
+	canonicalRequest := "GET\n" + path + "\n" + wantQuery + "\nhost:storage.googleapis.com\n\nhost\nUNSIGNED-PAYLOAD"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	want := "GOOG4-RSA-SHA256\n20210220T220005Z\n20210220/auto/storage/goog4_request\n" + hex.EncodeToString(hash[:])
+	if stringToSign != want {
+		t.Errorf("string to sign =\n%s\nwant\n%s", stringToSign, want)
+	}
+}
+
+// signed URLs verify against the service account's public key and carry their expiry
+func TestFootageUrlSigner(t *testing.T) {
+	path, key := testServiceAccountKey(t, "service_account")
+	signer, err := loadFootageUrlSigner(path)
+	if err != nil {
+		t.Fatalf("loadFootageUrlSigner() error: %v", err)
+	}
+	at := time.Date(2021, 2, 20, 22, 0, 5, 0, time.UTC)
+	gsPath := "gs://dev-carmalinkapi-dashcamfootage/b042ff1af6c6ac40a5a125de5885cfc9/snapshot-0-1613858375080"
+	signed, expiration, err := signer.signedUrl(gsPath, at, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("signedUrl() error: %v", err)
+	}
+	if !expiration.Equal(at.Add(24 * time.Hour)) {
+		t.Errorf("expiration = %v, want %v", expiration, at.Add(24*time.Hour))
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("signed URL %q doesn't parse: %v", signed, err)
+	}
+	if u.Host != "storage.googleapis.com" || u.Path != "/dev-carmalinkapi-dashcamfootage/b042ff1af6c6ac40a5a125de5885cfc9/snapshot-0-1613858375080" {
+		t.Errorf("signed URL points at %s%s", u.Host, u.Path)
+	}
+	if u.Query().Get("X-Goog-Expires") != "86400" {
+		t.Errorf("X-Goog-Expires = %s, want 86400", u.Query().Get("X-Goog-Expires"))
+	}
+	signature, err := hex.DecodeString(u.Query().Get("X-Goog-Signature"))
+	if err != nil {
+		t.Fatalf("X-Goog-Signature isn't hex: %v", err)
+	}
+	_, stringToSign, _ := signedUrlRequest(signedUrlTestEmail, "dev-carmalinkapi-dashcamfootage", "b042ff1af6c6ac40a5a125de5885cfc9/snapshot-0-1613858375080", at, 24*time.Hour)
+	hash := sha256.Sum256([]byte(stringToSign))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+	if !strings.HasSuffix(strings.SplitN(signed, "?", 2)[1], "&X-Goog-Signature="+hex.EncodeToString(signature)) {
+		t.Errorf("X-Goog-Signature isn't the last query parameter: %s", signed)
+	}
+
+	if _, _, err := signer.signedUrl(gsPath, at, 8*24*time.Hour); err == nil {
+		t.Errorf("signedUrl() accepted an expiry past a week")
+	}
+	if _, _, err := signer.signedUrl("https://example.com/footage", at, time.Hour); err == nil {
+		t.Errorf("signedUrl() accepted a path that isn't gs://")
+	}
+}
+
+// only service account keys can sign, user credentials leave signing off
+func TestLoadFootageUrlSigner(t *testing.T) {
+	path, _ := testServiceAccountKey(t, "authorized_user")
+	if _, err := loadFootageUrlSigner(path); err == nil {
+		t.Errorf("loadFootageUrlSigner() accepted an authorized_user credential")
+	}
+	if _, err := loadFootageUrlSigner(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("loadFootageUrlSigner() accepted a missing key file")
+	}
+}
+
+// footage entries get a signed URL and expiry for their privateFilePath
+func TestSignFootage(t *testing.T) {
+	path, _ := testServiceAccountKey(t, "service_account")
+	defer func(s *FootageUrlSigner, d time.Duration) { footageUrlSigner, videoUrlExpiration = s, d }(footageUrlSigner, videoUrlExpiration)
+	footageUrlSigner, _ = loadFootageUrlSigner(path)
+	videoUrlExpiration = time.Hour
+	at := time.Date(2021, 2, 20, 22, 0, 5, 0, time.UTC)
+	footage := []VideoReportFootageV1{
+		{FootageId: "cam0", FootagePath: "gs://bucket/cam0.mp4"},
+		{FootageId: "cam1"},
+		{FootageId: "cam2", FootagePath: "gs://bucket/cam2.mp4"},
+	}
+	if signed := signFootage(footage, "", at); signed != 2 {
+		t.Errorf("signFootage() signed %d entries, want 2", signed)
+	}
+	if footage[0].SignedUrl == "" || !footage[0].SignedUrlExpiration.Equal(at.Add(time.Hour)) || footage[1].SignedUrl != "" {
+		t.Errorf("signed footage = %+v", footage)
+	}
+	if signed := signFootage(footage, "cam2", at.Add(time.Minute)); signed != 1 || !footage[0].SignedUrlExpiration.Equal(at.Add(time.Hour)) {
+		t.Errorf("signFootage() for cam2 signed %d entries, cam0 expiration %v", signed, footage[0].SignedUrlExpiration)
+	}
+}
+
+// a refresh signs the event we hold, upload progress not yet stored included
+func TestVideoEventRefresh(t *testing.T) {
+	path, _ := testServiceAccountKey(t, "service_account")
+	defer func(s *FootageUrlSigner, d time.Duration) { footageUrlSigner, videoUrlExpiration = s, d }(footageUrlSigner, videoUrlExpiration)
+	footageUrlSigner, _ = loadFootageUrlSigner(path)
+	videoUrlExpiration = time.Hour
+	tracker := VideoEventTracker{}
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	progress := VideoReportFootageV1{FootageId: "cam0", FootagePath: "gs://bucket/cam0.mp4", UploadStatus: "IN_PROGRESS", LastChunkRxTime: at, BytesRemaining: 2000}
+	tracker.observe("1001", "2002", FirestoreVideoReportV1{VideoEventId: "4ad20507", Footage: []VideoReportFootageV1{progress}}, at, nil)
+
+	stale := func() (FirestoreVideoReportV1, bool, error) {
+		t.Errorf("refresh() read an event it holds")
+		return FirestoreVideoReportV1{}, false, nil
+	}
+	w, urls, err := tracker.refresh("1001", "2002", "4ad20507", "", at.Add(time.Minute), stale)
+	if err != nil || len(urls) != 1 {
+		t.Fatalf("refresh() = %v, %v", urls, err)
+	}
+	footage := w.fields["footage"].([]VideoReportFootageV1)
+	if footage[0].SignedUrl == "" || footage[0].BytesRemaining != 2000 || footage[0].UploadStatus != "IN_PROGRESS" {
+		t.Errorf("refreshed footage = %+v, want it signed with its upload progress", footage[0])
+	}
+
+	missing := func() (FirestoreVideoReportV1, bool, error) { return FirestoreVideoReportV1{}, false, nil }
+	if _, _, err := tracker.refresh("1001", "2002", "unknown", "", at, missing); err == nil {
+		t.Errorf("refresh() of a missing event succeeded")
+	}
+	if len(tracker.events) != 1 {
+		t.Errorf("refresh() of a missing event kept %d events, want: 1", len(tracker.events))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// firestream <subcommand> [flags] runs a one-off maintenance job against Firestore and exits.
+// Only the Firestore/GCP environment is required, no CLAPI or Navajo access.
+func runSubcommand(name string, args []string) int {
+	switch name {
+	case "prune":
+		return pruneCommand(args)
+	case "migrate":
+		return migrateCommand(args)
+	case "eld-output":
+		return eldOutputCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q\n", name)
+		fmt.Fprintf(os.Stderr, "Usage: firestream [prune|migrate|eld-output] [flags]\n")
+		return 2
+	}
+}
+
+// firestream prune [-dry-run]
+func pruneCommand(args []string) int {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "count expired report_data documents without deleting them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	ctx, c, err := subcommandSetup(parseRetentionEnvConfigs)
+	if err != nil {
+		log.Errorln(err)
+		return 1
+	}
+	defer c.Close()
+
+	results, err := pruneReportData(ctx, c, *dryRun)
+	for _, r := range results {
+		fmt.Printf("%s %s by %s: scanned=%d expired=%d kept=%d\n", r.collection, r.dataType, r.ageField, r.scanned, r.expired, r.kept)
+	}
+	if err != nil {
+		log.Errorf("Retention run failed: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// firestream migrate -from 1 -to 2 [-batch-size 200] [-interval 1s] [-dry-run]
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.Int("from", -1, "schema version documents are migrated from (0 for unversioned documents)")
+	to := flags.Int("to", -1, "schema version documents are migrated to")
+	batchSize := flags.Int("batch-size", 200, "documents read (and at most written) per batch, 499 at most")
+	interval := flags.Duration("interval", time.Second, "pause between batches")
+	dryRun := flags.Bool("dry-run", false, "count documents that would be migrated without writing anything")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *batchSize < 1 || *batchSize > firestoreMaxBatchSize-1 {
+		fmt.Fprintf(os.Stderr, "-batch-size must be between 1 and %d\n", firestoreMaxBatchSize-1)
+		return 2
+	}
+	if _, ok := schemaMigrations[fmt.Sprintf("%d>%d", *from, *to)]; !ok {
+		fmt.Fprintf(os.Stderr, "No migration from schema version %d to %d, supported: 0>1, 1>2, 2>1\n", *from, *to)
+		return 2
+	}
+	ctx, c, err := subcommandSetup()
+	if err != nil {
+		log.Errorln(err)
+		return 1
+	}
+	defer c.Close()
+
+	r, err := migrateSchema(ctx, c, *from, *to, *batchSize, *interval, *dryRun)
+	fmt.Printf("%d>%d: scanned=%d migrated=%d skipped=%d\n", *from, *to, r.scanned, r.migrated, r.skipped)
+	if err != nil {
+		log.Errorf("Migration failed: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// firestream eld-output -account 1001 -driver 3344 -from 2021-02-10 -to 2021-02-17 [-timezone America/New_York] [-o file]
+func eldOutputCommand(args []string) int {
+	flags := flag.NewFlagSet("eld-output", flag.ContinueOnError)
+	account := flags.String("account", "", "Cartwheel accountId of the driver")
+	driver := flags.String("driver", "", "CL API userId of the driver")
+	fromDate := flags.String("from", "", "first day of records, YYYY-MM-DD")
+	toDate := flags.String("to", "", "last day of records (inclusive), YYYY-MM-DD")
+	timezone := flags.String("timezone", "UTC", "driver's home terminal time zone, days and event times are in this zone")
+	output := flags.String("o", "", "file to write, stdout if not set")
+	h := EldOutputHeaderV1{}
+	flags.StringVar(&h.DriverLastName, "last-name", "", "driver's last name")
+	flags.StringVar(&h.DriverFirstName, "first-name", "", "driver's first name")
+	flags.StringVar(&h.LicenseState, "license-state", "", "driver's license issuing state")
+	flags.StringVar(&h.LicenseNumber, "license-number", "", "driver's license number")
+	flags.StringVar(&h.CarrierName, "carrier-name", "", "motor carrier's name")
+	flags.StringVar(&h.RegistrationId, "eld-registration-id", "", "ELD registration id")
+	flags.StringVar(&h.EldIdentifier, "eld-identifier", "", "ELD identifier")
+	flags.StringVar(&h.Comment, "comment", "", "output file comment")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *account == "" || *driver == "" {
+		fmt.Fprintf(os.Stderr, "-account and -driver are required\n")
+		return 2
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unknown -timezone %q: %v\n", *timezone, err)
+		return 2
+	}
+	from, fromErr := time.ParseInLocation("2006-01-02", *fromDate, loc)
+	to, toErr := time.ParseInLocation("2006-01-02", *toDate, loc)
+	if fromErr != nil || toErr != nil || to.Before(from) {
+		fmt.Fprintf(os.Stderr, "-from and -to must be YYYY-MM-DD days, -from no later than -to\n")
+		return 2
+	}
+	h.Location = loc
+	h.Generated = now()
+	ctx, c, err := subcommandSetup()
+	if err != nil {
+		log.Errorln(err)
+		return 1
+	}
+	defer c.Close()
+
+	records, username, err := loadEldOutputRecords(ctx, c, *account, *driver, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		log.Errorf("Unable to read ELD records: %v", err)
+		return 1
+	}
+	unidentified, err := loadEldOutputUnidentified(ctx, c, *account, records, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		log.Errorf("Unable to read unidentified driving: %v", err)
+		return 1
+	}
+	w := os.Stdout
+	if *output != "" {
+		w, err = os.Create(*output)
+		if err != nil {
+			log.Errorf("Unable to create %s: %v", *output, err)
+			return 1
+		}
+		defer w.Close()
+	}
+	if err := writeEldOutputFile(w, h, username, records, unidentified); err != nil {
+		log.Errorf("Unable to write ELD output file: %v", err)
+		return 1
+	}
+	log.Infof("Wrote %d ELD records for driver %s/%s", len(records), *account, *driver)
+	return 0
+}
+
+// parse Firestore config plus whatever else a subcommand needs, and hand back a client
+// and a context that is cancelled on ctrl+c
+func subcommandSetup(parsers ...func() error) (context.Context, *firestore.Client, error) {
+	if err := parseFirestoreEnvConfigs(); err != nil {
+		return nil, nil, err
+	}
+	for _, parse := range parsers {
+		if err := parse(); err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go setupCloseHandler(cancel)
+	c, err := createFirestoreClient(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return ctx, c, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
 	"time"
@@ -28,9 +29,6 @@ func transponderReportWriterV1(ctx context.Context, c *firestore.Client) {
 				break // unable to validate the packet, drop it and move on
 			}
 
-			// build firestore reference
-			ref := rds.firestoreReference(c)
-
 			// marshall our report data streaming record into a firestore status record
 			record, err := rds.firestoreRecord()
 			if err != nil {
@@ -38,12 +36,46 @@ func transponderReportWriterV1(ctx context.Context, c *firestore.Client) {
 				break // don't try to write incomplete packet to Firestore
 			}
 
-			// check result
-			result, err := ref.NewDoc().Set(ctx, record)
-			if err != nil {
-				log.Errorf("Firestore write error: %v", err)
-			} else {
-				log.Debugf("Firestore write result: %v", result)
+			// every report counts towards the vehicle's trip, even ones we throttle below
+			writeTrips(ctx, c, trips.observe(rds.cwAccountId, rds.cwDeviceWebId, record, readTripState(ctx, c, rds.cwAccountId, rds.cwDeviceWebId)))
+
+			// status reports for transponders nobody is watching are throttled to INACTIVE_RATE
+			if !liveViewers.fullRate(rds.clTransponderId, rds.reportDataType) {
+				log.Debugf("transponderReportWriterV1() throttling %s report for unwatched transponder %s", rds.reportDataType, rds.clTransponderId)
+				break
+			}
+
+			// stops, parking and trip reports get the address of where they happened
+			geocodeReport(&record)
+
+			// build firestore reference, the document id is derived from the report itself
+			// so replays after a checkpoint resume overwrite rather than duplicate
+			ref := rds.firestoreDocument(c)
+
+			// hand off to the Firestore sink to be batched, in every schema version we're asked to write
+			var written []*firestore.DocumentRef
+			if writesSchemaVersion(schemaVersionV1) {
+				queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: record})
+				written = append(written, ref)
+			}
+			if writesSchemaVersion(schemaVersionV2) {
+				queueFirestoreWrite(ctx, FirestoreWriteV1{ref: reportDataV2Reference(ref), data: transponderReportV1ToV2(record)})
+				written = append(written, reportDataV2Reference(ref))
+			}
+			// hard events link up with dashcam video recorded around them
+			if tripHardEventTypes[record.Type] {
+				at := record.EventStart
+				if at.IsZero() {
+					at = record.ReportTimestamp
+				}
+				safety := linkSafetyEvent{refs: written, dataType: record.Type, at: at, reported: record.ReportTimestamp, seen: now()}
+				writeVideoLinks(ctx, videoLinks.observeSafety(rds.cwAccountId+"/"+rds.cwDeviceWebId, safety))
+			}
+			// move the vehicle's latest state forward if this report is newer,
+			// and carry it into the account's fleet snapshot
+			latest, advanced := vehicleStates.update(ctx, c, &rds, record)
+			if advanced {
+				fleetSnapshots.update(rds.cwAccountId, rds.cwDeviceWebId, latest)
 			}
 			// go back to waiting for a new report to enter channel
 		}
@@ -59,6 +91,32 @@ func (r *TransponderReportDataStreamV1) firestoreReference(c *firestore.Client)
 	return ref
 }
 
+// document reference for a V1 transponder report, falls back to a random id
+// when the report doesn't carry enough identity to derive one
+func (r *TransponderReportDataStreamV1) firestoreDocument(c *firestore.Client) *firestore.DocumentRef {
+	id, ok := r.documentId()
+	if !ok {
+		log.Debugf("TransponderReportDataStreamV1: no stable identity for %s:%s report, using generated document id", r.reportType, r.reportDataType)
+		return r.firestoreReference(c).NewDoc()
+	}
+	return r.firestoreReference(c).Doc(id)
+}
+
+// derive a deterministic document id from the report's stable identity:
+// serial, dataType, configId, eventStart and reportTimestamp
+func (r *TransponderReportDataStreamV1) documentId() (id string, ok bool) {
+	serial, serialOk := r.json.Path("data.serial").Data().(float64)
+	reportTimestamp, tsOk := r.json.Path("data.reportTimestamp").Data().(float64)
+	if !serialOk || !tsOk {
+		return ``, false
+	}
+	// configId and eventStart aren't sent with every report, an empty slot is still stable
+	configId, _ := r.reportConfigId()
+	eventStart, _ := r.json.Path("data.eventStart").Data().(float64)
+	identity := fmt.Sprintf("%.0f|%s|%.0f|%.0f|%.0f", serial, r.reportDataType, configId, eventStart, reportTimestamp)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(identity))), true
+}
+
 // validate/populate all items needed for an actionable TransponderReportDataStreamV1 type
 func (r *TransponderReportDataStreamV1) build() (ok bool) {
 	// transponder reports require a transponderId and accountId
@@ -76,6 +134,7 @@ func (r *TransponderReportDataStreamV1) build() (ok bool) {
 		log.Warnf("TransponderReportDataStreamV1.build(): Unable to obtain cartwheel accountId or web id from in-memory mapping (transponderId): %v\n", transponderId)
 		return false
 	}
+	r.clTransponderId = transponderId
 	return true
 }
 
@@ -296,6 +355,34 @@ func (r *TransponderReportDataStreamV1) reportGeoTags() (t []GeoTagV1, ok bool)
 	return t, true
 }
 
+// parse streaming report JSON packet for a numeric parameter
+func (r *TransponderReportDataStreamV1) reportParameter(key string) (float64, bool) {
+	p, ok := r.json.Path("data.parameters." + key).Data().(float64)
+	return p, ok
+}
+
+// parse streaming report JSON packet for the functions block
+// data.functions{average:{batteryVoltage:...}, integrate:{speed:...}}
+func (r *TransponderReportDataStreamV1) reportFunctions() (f *TransponderFunctionsV1, ok bool) {
+	function := func(name string) map[string]float64 {
+		var values map[string]float64
+		for parameter, child := range r.json.Path("data.functions." + name).ChildrenMap() {
+			if v, ok := child.Data().(float64); ok {
+				if values == nil {
+					values = make(map[string]float64)
+				}
+				values[parameter] = v
+			}
+		}
+		return values
+	}
+	f = &TransponderFunctionsV1{Average: function("average"), Integrate: function("integrate")}
+	if f.Average == nil && f.Integrate == nil {
+		return nil, false
+	}
+	return f, true
+}
+
 // determine if the ReportDataStreamV1 packet we received is "valid"
 func (r *TransponderReportDataStreamV1) validDataType() (ok bool) {
 	dt := r.reportDataType
@@ -341,6 +428,7 @@ func (r *TransponderReportDataStreamV1) firestoreRecord() (fbRecord FirestoreTra
 		reportGeoObj, ok := r.reportGeoObj()
 		if ok {
 			fbRecord.LatLng = reportGeoObj
+			fbRecord.Geohash = geohashes(reportGeoObj)
 		}
 		reportBattVolt, ok := r.reportBatteryVoltage()
 		if ok {
@@ -378,8 +466,13 @@ func (r *TransponderReportDataStreamV1) firestoreRecord() (fbRecord FirestoreTra
 		if ok {
 			fbRecord.Serial = serial
 		}
+		functions, ok := r.reportFunctions()
+		if ok {
+			fbRecord.Functions = functions
+		}
 		// reportDataType is unmarshalled and set earlier upstream
 		fbRecord.Type = r.reportDataType
+		fbRecord.SchemaVersion = schemaVersionV1
 		// done forming new status report entry for firestore
 		return fbRecord, nil
 	} else {
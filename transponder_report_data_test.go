@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"testing"
+
+	gabs "github.com/Jeffail/gabs/v2"
+)
+
+// build a TransponderReportDataStreamV1 the same way the assembly router does
+func testTransponderReport(t *testing.T, packet string) TransponderReportDataStreamV1 {
+	json, err := gabs.ParseJSON([]byte(packet))
+	if err != nil {
+		t.Fatalf("unable to parse test packet: %v", err)
+	}
+	rds := ReportDataStreamV1{json: json}
+	rds.reportType, _ = json.Path("type").Data().(string)
+	rds.reportDataType, _ = json.Path("dataType").Data().(string)
+	return rds.transponderReportDataStreamV1()
+}
+
+// replaying the same report must land on the same document
+func TestTransponderReportDocumentId(t *testing.T) {
+	status := `{"type":"REPORT_DATA","dataType":"status","transponderId":519372,"accountId":12,
+		"data":{"serial":519372,"configId":473122,"eventStart":1613576740322,"reportTimestamp":1613577228453}}`
+	later := `{"type":"REPORT_DATA","dataType":"status","transponderId":519372,"accountId":12,
+		"data":{"serial":519372,"configId":473122,"eventStart":1613576740322,"reportTimestamp":1613577228454}}`
+	parking := `{"type":"REPORT_DATA","dataType":"parking","transponderId":519372,"accountId":12,
+		"data":{"serial":519372,"configId":473122,"eventStart":1613576740322,"reportTimestamp":1613577228453}}`
+	noSerial := `{"type":"REPORT_DATA","dataType":"status","transponderId":519372,"accountId":12,
+		"data":{"reportTimestamp":1613577228453}}`
+
+	r := testTransponderReport(t, status)
+	id, ok := r.documentId()
+	if !ok || id == "" {
+		t.Fatalf("documentId() = %q, %t, want a document id", id, ok)
+	}
+	replay := testTransponderReport(t, status)
+	if replayId, _ := replay.documentId(); replayId != id {
+		t.Errorf("documentId() of replayed report = %s, want: %s", replayId, id)
+	}
+	for name, packet := range map[string]string{"later": later, "parking": parking} {
+		r := testTransponderReport(t, packet)
+		if otherId, _ := r.documentId(); otherId == id {
+			t.Errorf("documentId() of %s report = %s, want a different id", name, otherId)
+		}
+	}
+	r = testTransponderReport(t, noSerial)
+	if _, ok := r.documentId(); ok {
+		t.Errorf("documentId() without a serial = true, want: false")
+	}
+}
+
+// the README's stopped, parking and status samples keep their functions block as sent
+func TestTransponderFunctions(t *testing.T) {
+	want := map[string]*TransponderFunctionsV1{
+		"stopped": nil,
+		"parking": {Average: map[string]float64{"batteryVoltage": 12.369361}},
+		"status":  {Integrate: map[string]float64{"speed": 3.0439425}},
+	}
+
+	fixtures, err := os.Open("testdata/transponder/readme_samples.jsonl")
+	if err != nil {
+		t.Fatalf("unable to open fixtures: %v", err)
+	}
+	defer fixtures.Close()
+	seen := 0
+	scanner := bufio.NewScanner(fixtures)
+	for scanner.Scan() {
+		r := testTransponderReport(t, scanner.Text())
+		record, err := r.firestoreRecord()
+		if err != nil {
+			t.Fatalf("firestoreRecord(%s) error: %v", r.reportDataType, err)
+		}
+		w, ok := want[r.reportDataType]
+		if !ok {
+			t.Fatalf("no expectation for %s fixture", r.reportDataType)
+		}
+		seen++
+		if !reflect.DeepEqual(record.Functions, w) {
+			t.Errorf("%s functions = %+v, want %+v", r.reportDataType, record.Functions, w)
+		}
+	}
+	if seen != len(want) {
+		t.Errorf("read %d fixtures, want %d", seen, len(want))
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// transponder event dataTypes recorded as hard events on the trip they happen during
+var tripHardEventTypes = map[string]bool{
+	"hard_accel":     true,
+	"hard_braking":   true,
+	"hard_cornering": true,
+	"overspeeding":   true,
+}
+
+// mean Earth radius in meters, for haversine distances
+const earthRadiusMeters float64 = 6371008.8
+
+// A trip stitched together from a vehicle's stream reports, kept at
+// /account/{id}/vehicle/{webId}/trip/{tripId}
+type FirestoreTripV1 struct {
+	TripId          string           `firestore:"tripId"`
+	Serial          float64          `firestore:"serial,omitempty"`
+	StartTimestamp  time.Time        `firestore:"startTimestamp"`
+	EndTimestamp    time.Time        `firestore:"endTimestamp"`
+	StartLatLng     *latlng.LatLng   `firestore:"startLatLng,omitempty"`
+	EndLatLng       *latlng.LatLng   `firestore:"endLatLng,omitempty"`
+	StartAddress    string           `firestore:"startAddress,omitempty"`
+	EndAddress      string           `firestore:"endAddress,omitempty"`
+	Duration        float64          `firestore:"duration"`     // milliseconds between start and end
+	Distance        float64          `firestore:"distance"`     // meters along the positions reported during the trip
+	MaxSpeed        float64          `firestore:"maxSpeed"`     // same units as report speed
+	AverageSpeed    float64          `firestore:"averageSpeed"` // mean of the speeds reported during the trip
+	Polyline        []*latlng.LatLng `firestore:"polyline"`
+	HardEvents      []TripEventV1    `firestore:"hardEvents"`
+	EndReason       string           `firestore:"endReason"` // parking, trip_end or gap
+	SchemaVersion   int              `firestore:"schemaVersion"`
+	FirestoreUpdate time.Time        `firestore:"fsUpdateTimestamp,serverTimestamp"`
+	cwAccountId     string           // owning vehicle, not written
+	cwDeviceWebId   string
+}
+
+// A hard event (hard_braking, overspeeding, ...) that happened during a trip
+type TripEventV1 struct {
+	Type            string         `firestore:"type"`
+	ReportTimestamp time.Time      `firestore:"reportTimestamp"`
+	LatLng          *latlng.LatLng `firestore:"latLng,omitempty"`
+	Speed           float64        `firestore:"speed,omitempty"`
+}
+
+// A vehicle's trip state, kept at /account/{id}/vehicle/{webId}/state/trip so a trip in
+// progress survives a restart. Written with the trip still open at shutdown and without it
+// whenever a trip finalizes.
+type FirestoreTripStateV1 struct {
+	OpenTrip        *FirestoreOpenTripV1 `firestore:"openTrip"`
+	LastTripEnd     time.Time            `firestore:"lastTripEndTimestamp"`
+	StateTimestamp  time.Time            `firestore:"stateTimestamp"` // newest reportTimestamp the state knows about
+	SchemaVersion   int                  `firestore:"schemaVersion"`
+	FirestoreUpdate time.Time            `firestore:"fsUpdateTimestamp,serverTimestamp"`
+	cwAccountId     string               // owning vehicle, not written
+	cwDeviceWebId   string
+}
+
+// An open trip as far as it got, everything needed to carry on with it
+type FirestoreOpenTripV1 struct {
+	Serial         float64       `firestore:"serial,omitempty"`
+	StartTimestamp time.Time     `firestore:"startTimestamp"`
+	LastTimestamp  time.Time     `firestore:"lastTimestamp"`
+	Points         []TripPointV1 `firestore:"points"`
+	Distance       float64       `firestore:"distance"`
+	SpeedSum       float64       `firestore:"speedSum"`
+	SpeedSamples   int           `firestore:"speedSamples"`
+	MaxSpeed       float64       `firestore:"maxSpeed"`
+	HardEvents     []TripEventV1 `firestore:"hardEvents"`
+}
+
+// A position reported during an open trip, as stored
+type TripPointV1 struct {
+	ReportTimestamp time.Time      `firestore:"reportTimestamp"`
+	LatLng          *latlng.LatLng `firestore:"latLng"`
+}
+
+// a position reported during an open trip
+type tripPoint struct {
+	at     time.Time
+	latLng *latlng.LatLng
+}
+
+// a vehicle's trip that hasn't finalized yet
+type openTrip struct {
+	cwAccountId   string
+	cwDeviceWebId string
+	serial        float64
+	start         time.Time
+	last          time.Time // newest reportTimestamp seen during the trip
+	lastSeen      time.Time // wall clock time we last heard about the trip, for gap sweeps
+	points        []tripPoint
+	distance      float64 // meters between every position accepted, not just the points we keep
+	speedSum      float64
+	speedSamples  int
+	maxSpeed      float64
+	hardEvents    []TripEventV1
+}
+
+// in-memory trip state machine for every vehicle
+type TripTracker struct {
+	mu    sync.Mutex
+	trips map[string]*openTrip // "cwAccountId/cwDeviceWebId":open trip
+	ended map[string]time.Time // "cwAccountId/cwDeviceWebId":end of the last finalized trip
+}
+
+// create a firestore reference location for a vehicle's trip state
+func tripStateReference(c *firestore.Client, cwAccountId string, cwDeviceWebId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("vehicle").Doc(cwDeviceWebId).Collection("state").Doc("trip")
+}
+
+// create a firestore reference location for a vehicle's trip
+func tripReference(c *firestore.Client, cwAccountId string, cwDeviceWebId string, tripId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("vehicle").Doc(cwDeviceWebId).Collection("trip").Doc(tripId)
+}
+
+// feed a transponder report into the vehicle's trip state machine, returning any trips it finalized.
+// A trip starts with an in progress trip_report or a report with speed, and finalizes on parking,
+// a trip_report that's no longer in progress, or no reports for TRIP_GAP_TIMEOUT.
+// The first report for a vehicle since boot carries on with the trip state read returns,
+// when read fails the report is skipped so we don't start a trip that's already open.
+func (t *TripTracker) observe(cwAccountId string, cwDeviceWebId string, record FirestoreTransponderReportV1, read func() (FirestoreTripStateV1, bool, error)) []FirestoreTripV1 {
+	if record.ReportTimestamp.IsZero() {
+		return nil
+	}
+	key := cwAccountId + "/" + cwDeviceWebId
+	stored := FirestoreTripStateV1{}
+	err := seedTracker(&t.mu,
+		func() bool { _, known := t.ended[key]; return known },
+		func() (err error) {
+			if read != nil {
+				stored, _, err = read()
+			}
+			return err
+		},
+		func() {
+			if t.trips == nil {
+				t.trips = make(map[string]*openTrip)
+				t.ended = make(map[string]time.Time)
+			}
+			t.ended[key] = stored.LastTripEnd
+			if stored.OpenTrip != nil {
+				t.trips[key] = openTripFromState(cwAccountId, cwDeviceWebId, stored.OpenTrip)
+				log.Debugf("TripTracker: carrying on with the trip for %s started at %v", key, stored.OpenTrip.StartTimestamp)
+			}
+		})
+	if err != nil {
+		log.Warnf("TripTracker: unable to read stored trip state of %s, skipping %s report: %v", key, record.Type, err)
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var finalized []FirestoreTripV1
+	trip, open := t.trips[key]
+	if open && record.ReportTimestamp.Sub(trip.last) > tripGapTimeout {
+		// we lost track of the vehicle long enough that this report belongs to something new
+		finalized = append(finalized, t.end(key, "gap"))
+		open = false
+	}
+
+	if !open {
+		if !tripStarts(record) {
+			return finalized
+		}
+		if !record.ReportTimestamp.After(t.ended[key]) {
+			// a late report from a trip we've already written, don't start a phantom trip
+			return finalized
+		}
+		start := record.ReportTimestamp
+		if record.Type == "trip_report" && !record.EventStart.IsZero() && record.EventStart.Before(start) {
+			start = record.EventStart
+		}
+		trip = &openTrip{cwAccountId: cwAccountId, cwDeviceWebId: cwDeviceWebId, start: start, last: start}
+		t.trips[key] = trip
+		log.Debugf("TripTracker: trip started for %s at %v", key, start)
+	}
+	if record.ReportTimestamp.Before(trip.start) {
+		log.Debugf("TripTracker: ignoring %s report for %s from before its trip started", record.Type, key)
+		return finalized
+	}
+	trip.apply(record)
+
+	switch {
+	case record.Type == "parking":
+		finalized = append(finalized, t.end(key, "parking"))
+	case record.Type == "trip_report" && !record.InProgress:
+		finalized = append(finalized, t.end(key, "trip_end"))
+	}
+	return finalized
+}
+
+// finalize and forget a vehicle's open trip, t.mu must be held
+func (t *TripTracker) end(key string, reason string) FirestoreTripV1 {
+	trip := t.trips[key]
+	delete(t.trips, key)
+	t.ended[key] = trip.last
+	return trip.finalize(reason)
+}
+
+// finalize trips we haven't heard anything about for TRIP_GAP_TIMEOUT
+func (t *TripTracker) sweep(at time.Time) []FirestoreTripV1 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var finalized []FirestoreTripV1
+	for key, trip := range t.trips {
+		if at.Sub(trip.lastSeen) > tripGapTimeout {
+			finalized = append(finalized, t.end(key, "gap"))
+		}
+	}
+	return finalized
+}
+
+// the trip state of every vehicle with a trip open, for writing at shutdown
+func (t *TripTracker) open() []FirestoreTripStateV1 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var states []FirestoreTripStateV1
+	for key, trip := range t.trips {
+		states = append(states, trip.state(t.ended[key]))
+	}
+	return states
+}
+
+// does this report put a parked vehicle in motion?
+func tripStarts(record FirestoreTransponderReportV1) bool {
+	switch record.Type {
+	case "parking":
+		return false
+	case "trip_report":
+		return record.InProgress
+	}
+	return record.Speed > 0
+}
+
+// fold a report into an open trip
+func (trip *openTrip) apply(record FirestoreTransponderReportV1) {
+	trip.lastSeen = now()
+	if record.ReportTimestamp.After(trip.last) {
+		trip.last = record.ReportTimestamp
+	}
+	if record.Serial != 0 {
+		trip.serial = record.Serial
+	}
+	if record.LatLng != nil {
+		// reports can arrive out of order across writers, keep points in time order
+		p := tripPoint{at: record.ReportTimestamp, latLng: record.LatLng}
+		i := sort.Search(len(trip.points), func(i int) bool { return trip.points[i].at.After(p.at) })
+		trip.distance += tripInsertDistance(trip.points, i, p.latLng)
+		trip.points = append(trip.points, tripPoint{})
+		copy(trip.points[i+1:], trip.points[i:])
+		trip.points[i] = p
+		if len(trip.points) > 4*tripMaxPoints {
+			trip.points = decimateTripPoints(trip.points, 2*tripMaxPoints)
+		}
+	}
+	if record.Type != "parking" {
+		trip.speedSum += record.Speed
+		trip.speedSamples++
+		if record.Speed > trip.maxSpeed {
+			trip.maxSpeed = record.Speed
+		}
+	}
+	if tripHardEventTypes[record.Type] {
+		trip.hardEvents = append(trip.hardEvents, TripEventV1{
+			Type:            record.Type,
+			ReportTimestamp: record.ReportTimestamp,
+			LatLng:          record.LatLng,
+			Speed:           record.Speed,
+		})
+	}
+}
+
+// distance a position adds to a trip when inserted before points[i]: the detour from the point
+// before it to the one after it. Points only arrive in the middle of a trip out of order, the
+// newest point is never decimated away so in order positions are counted exactly.
+func tripInsertDistance(points []tripPoint, i int, latLng *latlng.LatLng) float64 {
+	var d float64
+	if i > 0 {
+		d += haversineMeters(points[i-1].latLng, latLng)
+	}
+	if i < len(points) {
+		d += haversineMeters(latLng, points[i].latLng)
+		if i > 0 {
+			d -= haversineMeters(points[i-1].latLng, points[i].latLng)
+		}
+	}
+	return d
+}
+
+// an open trip as stored in its vehicle's trip state
+func (trip *openTrip) state(lastTripEnd time.Time) FirestoreTripStateV1 {
+	open := &FirestoreOpenTripV1{
+		Serial:         trip.serial,
+		StartTimestamp: trip.start,
+		LastTimestamp:  trip.last,
+		Points:         []TripPointV1{},
+		Distance:       trip.distance,
+		SpeedSum:       trip.speedSum,
+		SpeedSamples:   trip.speedSamples,
+		MaxSpeed:       trip.maxSpeed,
+		HardEvents:     trip.hardEvents,
+	}
+	if open.HardEvents == nil {
+		open.HardEvents = []TripEventV1{}
+	}
+	for _, p := range trip.points {
+		open.Points = append(open.Points, TripPointV1{ReportTimestamp: p.at, LatLng: p.latLng})
+	}
+	return FirestoreTripStateV1{
+		OpenTrip:       open,
+		LastTripEnd:    lastTripEnd,
+		StateTimestamp: trip.last,
+		SchemaVersion:  schemaVersionV1,
+		cwAccountId:    trip.cwAccountId,
+		cwDeviceWebId:  trip.cwDeviceWebId,
+	}
+}
+
+// pick up an open trip from its stored state. It counts as heard from now, a trip
+// that went quiet while we were down is ended by its next report or the gap sweeper.
+func openTripFromState(cwAccountId string, cwDeviceWebId string, stored *FirestoreOpenTripV1) *openTrip {
+	trip := &openTrip{
+		cwAccountId:   cwAccountId,
+		cwDeviceWebId: cwDeviceWebId,
+		serial:        stored.Serial,
+		start:         stored.StartTimestamp,
+		last:          stored.LastTimestamp,
+		lastSeen:      now(),
+		distance:      stored.Distance,
+		speedSum:      stored.SpeedSum,
+		speedSamples:  stored.SpeedSamples,
+		maxSpeed:      stored.MaxSpeed,
+		hardEvents:    stored.HardEvents,
+	}
+	for _, p := range stored.Points {
+		trip.points = append(trip.points, tripPoint{at: p.ReportTimestamp, latLng: p.LatLng})
+	}
+	return trip
+}
+
+// turn an open trip into its Firestore document
+func (trip *openTrip) finalize(reason string) FirestoreTripV1 {
+	record := FirestoreTripV1{
+		TripId:         tripId(trip.cwAccountId, trip.cwDeviceWebId, trip.start),
+		Serial:         trip.serial,
+		StartTimestamp: trip.start,
+		EndTimestamp:   trip.last,
+		Duration:       float64(trip.last.Sub(trip.start) / time.Millisecond),
+		MaxSpeed:       trip.maxSpeed,
+		Polyline:       []*latlng.LatLng{},
+		HardEvents:     trip.hardEvents,
+		EndReason:      reason,
+		SchemaVersion:  schemaVersionV1,
+		cwAccountId:    trip.cwAccountId,
+		cwDeviceWebId:  trip.cwDeviceWebId,
+	}
+	if trip.speedSamples > 0 {
+		record.AverageSpeed = trip.speedSum / float64(trip.speedSamples)
+	}
+	if record.HardEvents == nil {
+		record.HardEvents = []TripEventV1{}
+	}
+	if len(trip.points) > 0 {
+		record.StartLatLng = trip.points[0].latLng
+		record.EndLatLng = trip.points[len(trip.points)-1].latLng
+	}
+	record.Distance = trip.distance
+	for _, p := range decimateTripPoints(trip.points, tripMaxPoints) {
+		record.Polyline = append(record.Polyline, p.latLng)
+	}
+	return record
+}
+
+// a trip is identified by its vehicle and start time, so a replayed trip overwrites itself
+func tripId(cwAccountId string, cwDeviceWebId string, start time.Time) string {
+	identity := fmt.Sprintf("%s|%s|%d", cwAccountId, cwDeviceWebId, start.UnixNano()/int64(time.Millisecond))
+	return fmt.Sprintf("%x", sha1.Sum([]byte(identity)))
+}
+
+// thin points down to at most max, evenly spaced, always keeping the first and last
+func decimateTripPoints(points []tripPoint, max int) []tripPoint {
+	if len(points) <= max || max < 2 {
+		return points
+	}
+	kept := make([]tripPoint, 0, max)
+	step := float64(len(points)-1) / float64(max-1)
+	for i := 0; i < max; i++ {
+		kept = append(kept, points[int(math.Round(float64(i)*step))])
+	}
+	return kept
+}
+
+// great-circle distance between two positions in meters
+func haversineMeters(a *latlng.LatLng, b *latlng.LatLng) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// queue writes for finalized trips, and clear them from their vehicle's trip state
+func writeTrips(ctx context.Context, c *firestore.Client, finalized []FirestoreTripV1) {
+	for _, trip := range finalized {
+		log.Debugf("Trip %s for %s/%s finalized (%s), %.0fm", trip.TripId, trip.cwAccountId, trip.cwDeviceWebId, trip.EndReason, trip.Distance)
+		geocodeTrip(&trip)
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: tripReference(c, trip.cwAccountId, trip.cwDeviceWebId, trip.TripId), data: trip})
+		state := FirestoreTripStateV1{LastTripEnd: trip.EndTimestamp, StateTimestamp: trip.EndTimestamp, SchemaVersion: schemaVersionV1}
+		guard := &FirestoreWriteGuardV1{field: "stateTimestamp", at: state.StateTimestamp}
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: tripStateReference(c, trip.cwAccountId, trip.cwDeviceWebId), data: state, guard: guard})
+	}
+}
+
+// store the trips still open at shutdown so they carry on after the restart. The sink may
+// already be flushing, so they're committed here rather than queued; the guard keeps the
+// state of a trip that finalized later in the sink's hands from being overwritten.
+func writeOpenTrips(c *firestore.Client, states []FirestoreTripStateV1) {
+	if len(states) == 0 {
+		return
+	}
+	log.Infof("TripTracker: storing %d open trips at shutdown", len(states))
+	flushCtx, cancel := context.WithTimeout(context.Background(), firestoreShutdownTimeout)
+	defer cancel()
+	var writes []FirestoreWriteV1
+	for _, state := range states {
+		guard := &FirestoreWriteGuardV1{field: "stateTimestamp", at: state.StateTimestamp}
+		writes = append(writes, FirestoreWriteV1{ref: tripStateReference(c, state.cwAccountId, state.cwDeviceWebId), data: state, guard: guard})
+	}
+	commitFirestoreBatch(flushCtx, c, writes)
+}
+
+// read a vehicle's stored trip state
+func readTripState(ctx context.Context, c *firestore.Client, cwAccountId string, cwDeviceWebId string) func() (FirestoreTripStateV1, bool, error) {
+	return func() (stored FirestoreTripStateV1, found bool, err error) {
+		found, err = readSeedDocument(ctx, tripStateReference(c, cwAccountId, cwDeviceWebId), &stored)
+		return stored, found, err
+	}
+}
+
+// finalize trips for vehicles that went quiet without parking, and store the ones still open
+// at shutdown. Callers add it to firestoreSinkDone before starting it.
+func tripGapSweeper(ctx context.Context, c *firestore.Client) {
+	defer firestoreSinkDone.Done()
+	interval := tripGapTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			writeOpenTrips(c, trips.open())
+			return
+		case <-ticker.C:
+			writeTrips(ctx, c, trips.sweep(now()))
+		}
+	}
+}
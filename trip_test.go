@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func testTripReport(dataType string, at time.Time, lat float64, speed float64) FirestoreTransponderReportV1 {
+	return FirestoreTransponderReportV1{
+		Type:            dataType,
+		ReportTimestamp: at,
+		LatLng:          &latlng.LatLng{Latitude: lat, Longitude: -70.5},
+		Speed:           speed,
+	}
+}
+
+func TestTripTrackerObserve(t *testing.T) {
+	tripGapTimeout = 15 * time.Minute
+	tripMaxPoints = 1000
+	start := time.Date(2021, 2, 17, 15, 0, 0, 0, time.UTC)
+	minute := func(m int) time.Time { return start.Add(time.Duration(m) * time.Minute) }
+
+	tracker := TripTracker{}
+	if got := tracker.observe("12", "34", testTripReport("status", minute(0), 41.40, 0), nil); len(got) != 0 {
+		t.Fatalf("observe() of a parked status = %d trips, want: 0", len(got))
+	}
+	tracker.observe("12", "34", testTripReport("status", minute(1), 41.41, 30), nil)
+	tracker.observe("12", "34", testTripReport("hard_braking", minute(3), 41.43, 10), nil)
+	// arrives after a later report from another writer, still lands in order
+	tracker.observe("12", "34", testTripReport("status", minute(2), 41.42, 50), nil)
+	got := tracker.observe("12", "34", testTripReport("parking", minute(4), 41.44, 0), nil)
+	if len(got) != 1 {
+		t.Fatalf("observe() of parking = %d trips, want: 1", len(got))
+	}
+	trip := got[0]
+	if trip.EndReason != "parking" || !trip.StartTimestamp.Equal(minute(1)) || !trip.EndTimestamp.Equal(minute(4)) {
+		t.Errorf("trip = %s %v..%v, want: parking %v..%v", trip.EndReason, trip.StartTimestamp, trip.EndTimestamp, minute(1), minute(4))
+	}
+	if len(trip.Polyline) != 4 || trip.Polyline[1].Latitude != 41.42 {
+		t.Errorf("trip polyline = %v, want 4 points in time order", trip.Polyline)
+	}
+	// 0.03 degrees of latitude is ~3336m
+	if math.Abs(trip.Distance-3335.8) > 1 {
+		t.Errorf("trip distance = %.1f, want: ~3335.8", trip.Distance)
+	}
+	if trip.MaxSpeed != 50 || trip.AverageSpeed != 30 {
+		t.Errorf("trip speed max:%v avg:%v, want: max:50 avg:30", trip.MaxSpeed, trip.AverageSpeed)
+	}
+	if len(trip.HardEvents) != 1 || trip.HardEvents[0].Type != "hard_braking" {
+		t.Errorf("trip hard events = %v, want one hard_braking", trip.HardEvents)
+	}
+	if trip.TripId != tripId("12", "34", minute(1)) {
+		t.Errorf("trip id = %s, want it derived from the vehicle and start time", trip.TripId)
+	}
+
+	// a straggler from the finished trip must not start a new one
+	if got := tracker.observe("12", "34", testTripReport("status", minute(3), 41.43, 20), nil); len(got) != 0 || len(tracker.trips) != 0 {
+		t.Errorf("observe() of a late report started a trip")
+	}
+
+	// reports after a long silence belong to a new trip
+	tracker.observe("12", "34", testTripReport("status", minute(10), 41.45, 20), nil)
+	got = tracker.observe("12", "34", testTripReport("status", minute(40), 41.50, 20), nil)
+	if len(got) != 1 || got[0].EndReason != "gap" || !got[0].EndTimestamp.Equal(minute(10)) {
+		t.Errorf("observe() after a gap = %v, want one trip ended by gap at %v", got, minute(10))
+	}
+	if _, open := tracker.trips["12/34"]; !open {
+		t.Errorf("observe() after a gap didn't start a new trip")
+	}
+
+	// trip_report brackets a trip on its own
+	tracker = TripTracker{}
+	inProgress := testTripReport("trip_report", minute(5), 41.40, 0)
+	inProgress.InProgress = true
+	inProgress.EventStart = minute(4)
+	tracker.observe("12", "34", inProgress, nil)
+	got = tracker.observe("12", "34", testTripReport("trip_report", minute(9), 41.41, 0), nil)
+	if len(got) != 1 || got[0].EndReason != "trip_end" || !got[0].StartTimestamp.Equal(minute(4)) {
+		t.Errorf("observe() of a finished trip_report = %v, want one trip_end trip from %v", got, minute(4))
+	}
+}
+
+// long trips keep a thinned out polyline, but their distance counts every position
+func TestTripDistanceLongTrip(t *testing.T) {
+	tripGapTimeout = 15 * time.Minute
+	tripMaxPoints = 10
+	defer func() { tripMaxPoints = DefaultTripMaxPoints }()
+	start := time.Date(2021, 2, 17, 15, 0, 0, 0, time.UTC)
+	tracker := TripTracker{}
+	var want float64
+	var prev *latlng.LatLng
+	for i := 0; i < 200; i++ {
+		// zig-zag, so thinned out points would cut corners
+		r := testTripReport("status", start.Add(time.Duration(i)*time.Second), 41.40+float64(i)*0.0001, 20)
+		r.LatLng.Longitude += float64(i%2) * 0.001
+		if prev != nil {
+			want += haversineMeters(prev, r.LatLng)
+		}
+		prev = r.LatLng
+		tracker.observe("12", "34", r, nil)
+	}
+	got := tracker.observe("12", "34", FirestoreTransponderReportV1{Type: "parking", ReportTimestamp: start.Add(time.Hour)}, nil)
+	if len(got) != 1 {
+		t.Fatalf("observe() of parking = %d trips, want: 1", len(got))
+	}
+	if len(got[0].Polyline) > tripMaxPoints {
+		t.Errorf("polyline has %d points, want at most %d", len(got[0].Polyline), tripMaxPoints)
+	}
+	if math.Abs(got[0].Distance-want) > 0.01 {
+		t.Errorf("trip distance = %.1f, want: %.1f", got[0].Distance, want)
+	}
+}
+
+func TestDecimateTripPoints(t *testing.T) {
+	var points []tripPoint
+	for i := 0; i < 101; i++ {
+		points = append(points, tripPoint{latLng: &latlng.LatLng{Latitude: float64(i)}})
+	}
+	kept := decimateTripPoints(points, 11)
+	if len(kept) != 11 || kept[0].latLng.Latitude != 0 || kept[10].latLng.Latitude != 100 || kept[5].latLng.Latitude != 50 {
+		t.Errorf("decimateTripPoints() = %d points, want 11 evenly spaced keeping both ends", len(kept))
+	}
+}
+
+// a trip open at shutdown carries on after a restart from its stored state, as if we'd never stopped
+func TestTripTrackerSeed(t *testing.T) {
+	tripGapTimeout = 15 * time.Minute
+	tripMaxPoints = 1000
+	start := time.Date(2021, 2, 17, 15, 0, 0, 0, time.UTC)
+	minute := func(m int) time.Time { return start.Add(time.Duration(m) * time.Minute) }
+	reports := []FirestoreTransponderReportV1{
+		testTripReport("status", minute(1), 41.41, 30),
+		testTripReport("hard_braking", minute(2), 41.42, 60),
+		testTripReport("status", minute(3), 41.43, 20),
+		testTripReport("parking", minute(4), 41.44, 0),
+	}
+
+	uninterrupted := TripTracker{}
+	var want []FirestoreTripV1
+	for _, r := range reports {
+		want = append(want, uninterrupted.observe("12", "34", r, nil)...)
+	}
+
+	before := TripTracker{}
+	before.observe("12", "34", reports[0], nil)
+	before.observe("12", "34", reports[1], nil)
+	states := before.open()
+	if len(states) != 1 || states[0].OpenTrip == nil || !states[0].StateTimestamp.Equal(minute(2)) {
+		t.Fatalf("open() = %+v, want the one open trip as of %v", states, minute(2))
+	}
+
+	after := TripTracker{}
+	failing := func() (FirestoreTripStateV1, bool, error) {
+		return FirestoreTripStateV1{}, false, errors.New("unavailable")
+	}
+	if got := after.observe("12", "34", reports[2], failing); len(got) != 0 || len(after.trips) != 0 {
+		t.Errorf("observe() with a failing read = %v, want the report skipped", got)
+	}
+	reads := 0
+	read := func() (FirestoreTripStateV1, bool, error) { reads++; return states[0], true, nil }
+	var got []FirestoreTripV1
+	for _, r := range reports[2:] {
+		got = append(got, after.observe("12", "34", r, read)...)
+	}
+	if reads != 1 {
+		t.Errorf("stored trip state read %d times, want: 1", reads)
+	}
+	if len(got) != 1 || len(want) != 1 {
+		t.Fatalf("observe() after a restart = %d trips, want: %d", len(got), len(want))
+	}
+	if got[0].TripId != want[0].TripId || !got[0].StartTimestamp.Equal(want[0].StartTimestamp) || got[0].Distance != want[0].Distance ||
+		got[0].MaxSpeed != want[0].MaxSpeed || got[0].AverageSpeed != want[0].AverageSpeed || len(got[0].Polyline) != len(want[0].Polyline) ||
+		len(got[0].HardEvents) != len(want[0].HardEvents) {
+		t.Errorf("trip after a restart =\n%+v\nwant\n%+v", got[0], want[0])
+	}
+
+	// a trip that finalized before the restart isn't started again by a late report
+	restarted := TripTracker{}
+	ended := func() (FirestoreTripStateV1, bool, error) {
+		return FirestoreTripStateV1{LastTripEnd: minute(4)}, true, nil
+	}
+	if got := restarted.observe("12", "34", testTripReport("status", minute(3), 41.43, 20), ended); len(got) != 0 || len(restarted.trips) != 0 {
+		t.Errorf("observe() of a late report after a restart started a trip")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// collection under a vehicle holding its unidentified driving segments
+const unidentifiedDrivingCollection string = "unidentified_driving"
+
+// assignment states of an unidentified driving segment, back-office staff move a
+// segment from pending to assigned (setting assignedUserId) or rejected
+const unidentifiedPending string = "pending"
+
+// ELD navigation records sent without a driver, grouped into driving segments kept at
+// /account/{id}/vehicle/{webId}/unidentified_driving/{segmentId}, the records themselves in
+// the segment's report_data. Records join the vehicle's open segment unless TRIP_GAP_TIMEOUT
+// has passed since its nearest record, in which case they start a new one.
+type UnidentifiedDrivingTracker struct {
+	mu       sync.Mutex
+	segments map[string]*unidentifiedSegment // "cwAccountId/cwDeviceWebId":open segment, nil if none
+}
+
+// The firestream owned fields of a stored segment, read back to carry on with it after a restart
+type FirestoreUnidentifiedSegmentV1 struct {
+	SegmentId         string         `firestore:"segmentId"`
+	StartTimestamp    time.Time      `firestore:"startTimestamp"`
+	EndTimestamp      time.Time      `firestore:"endTimestamp"`
+	RecordCount       int            `firestore:"recordCount"`
+	TransponderId     float64        `firestore:"transponderId"`
+	StartLocation     *latlng.LatLng `firestore:"startLocation"`
+	EndLocation       *latlng.LatLng `firestore:"endLocation"`
+	StartVehicleMiles float64        `firestore:"startVehicleMiles"`
+	EndVehicleMiles   float64        `firestore:"endVehicleMiles"`
+}
+
+// a vehicle's open unidentified driving segment
+type unidentifiedSegment struct {
+	id            string
+	transponderId float64
+	start         time.Time
+	end           time.Time
+	startLatLng   *latlng.LatLng
+	endLatLng     *latlng.LatLng
+	startMiles    float64 // totalVehicleMiles at the start of the segment
+	endMiles      float64
+	records       int
+}
+
+// create a firestore reference location for an unidentified driving segment
+func unidentifiedSegmentReference(c *firestore.Client, cwAccountId string, cwDeviceWebId string, segmentId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("vehicle").Doc(cwDeviceWebId).Collection(unidentifiedDrivingCollection).Doc(segmentId)
+}
+
+// segments are keyed by vehicle and the time of their first record
+func unidentifiedSegmentId(cwAccountId string, cwDeviceWebId string, start time.Time) string {
+	identity := fmt.Sprintf("%s|%s|%d", cwAccountId, cwDeviceWebId, start.UnixNano()/int64(time.Millisecond))
+	return fmt.Sprintf("%x", sha1.Sum([]byte(identity)))
+}
+
+// fold a driverless navigation record into its vehicle's open segment, returning the segment
+// it landed in and whether that segment is new. The first record for a vehicle since boot
+// carries on with its latest stored segment, which read returns; when read fails the record
+// isn't placed, rather than opening a second segment over one that's still going.
+func (t *UnidentifiedDrivingTracker) observe(cwAccountId string, cwDeviceWebId string, record FirestoreEldReportV1, read func() (FirestoreUnidentifiedSegmentV1, bool, error)) (unidentifiedSegment, bool) {
+	at := record.EventStartTimestamp
+	if at.IsZero() {
+		at = record.RecordTimestamp
+	}
+	if at.IsZero() {
+		return unidentifiedSegment{}, false
+	}
+	key := cwAccountId + "/" + cwDeviceWebId
+	stored, found := FirestoreUnidentifiedSegmentV1{}, false
+	err := seedTracker(&t.mu,
+		func() bool { _, known := t.segments[key]; return known },
+		func() (err error) {
+			if read != nil {
+				stored, found, err = read()
+			}
+			return err
+		},
+		func() {
+			if t.segments == nil {
+				t.segments = make(map[string]*unidentifiedSegment)
+			}
+			t.segments[key] = nil
+			if found && stored.SegmentId != "" {
+				t.segments[key] = &unidentifiedSegment{
+					id:            stored.SegmentId,
+					transponderId: stored.TransponderId,
+					start:         stored.StartTimestamp,
+					end:           stored.EndTimestamp,
+					startLatLng:   stored.StartLocation,
+					endLatLng:     stored.EndLocation,
+					startMiles:    stored.StartVehicleMiles,
+					endMiles:      stored.EndVehicleMiles,
+					records:       stored.RecordCount,
+				}
+			}
+		})
+	if err != nil {
+		log.Warnf("UnidentifiedDrivingTracker: unable to read the latest stored segment of %s, skipping record %s: %v", key, record.RecordId, err)
+		return unidentifiedSegment{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.segments[key]
+	open := s != nil
+	if !open || at.Sub(s.end) > tripGapTimeout || s.start.Sub(at) > tripGapTimeout {
+		s = &unidentifiedSegment{
+			id:          unidentifiedSegmentId(cwAccountId, cwDeviceWebId, at),
+			start:       at,
+			end:         at,
+			startLatLng: record.Location,
+			endLatLng:   record.Location,
+			startMiles:  record.TotalVehicleMiles,
+			endMiles:    record.TotalVehicleMiles,
+		}
+		t.segments[key] = s
+		open = false
+		log.Debugf("UnidentifiedDrivingTracker: segment %s started for %s at %v", s.id, key, at)
+	}
+	s.records++
+	if record.TransponderId != 0 {
+		s.transponderId = record.TransponderId
+	}
+	// records can arrive out of order, the segment's edges move with them
+	if !at.After(s.start) {
+		s.start = at
+		if record.Location != nil {
+			s.startLatLng = record.Location
+		}
+		if record.TotalVehicleMiles != 0 {
+			s.startMiles = record.TotalVehicleMiles
+		}
+	}
+	if !at.Before(s.end) {
+		s.end = at
+		if record.Location != nil {
+			s.endLatLng = record.Location
+		}
+		if record.TotalVehicleMiles != 0 {
+			s.endMiles = record.TotalVehicleMiles
+		}
+	}
+	return *s, !open
+}
+
+// fields firestream owns on a segment document. A new segment is created pending assignment,
+// later updates leave assignment fields alone so they never undo back-office work.
+func (s unidentifiedSegment) fields(created bool) map[string]interface{} {
+	fields := map[string]interface{}{
+		"segmentId":         s.id,
+		"startTimestamp":    s.start,
+		"endTimestamp":      s.end,
+		"duration":          float64(s.end.Sub(s.start) / time.Millisecond),
+		"recordCount":       s.records,
+		"schemaVersion":     schemaVersionV1,
+		"fsUpdateTimestamp": firestore.ServerTimestamp,
+	}
+	if s.transponderId != 0 {
+		fields["transponderId"] = s.transponderId
+	}
+	if s.startLatLng != nil {
+		fields["startLocation"] = s.startLatLng
+	}
+	if s.endLatLng != nil {
+		fields["endLocation"] = s.endLatLng
+	}
+	if s.startMiles != 0 {
+		fields["startVehicleMiles"] = s.startMiles
+	}
+	if s.endMiles != 0 {
+		fields["endVehicleMiles"] = s.endMiles
+	}
+	if s.startMiles != 0 && s.endMiles >= s.startMiles {
+		fields["distance"] = s.endMiles - s.startMiles // vehicle miles
+	}
+	if created {
+		fields["assignmentStatus"] = unidentifiedPending
+	}
+	return fields
+}
+
+// file a driverless navigation record under its vehicle's unidentified driving segment,
+// returning the document reference for the record itself
+func writeUnidentifiedDriving(ctx context.Context, c *firestore.Client, r *EldReportDataStreamV1, record FirestoreEldReportV1) (*firestore.DocumentRef, bool) {
+	read := func() (FirestoreUnidentifiedSegmentV1, bool, error) {
+		return readLatestUnidentifiedSegment(ctx, c, r.cwAccountId, r.cwDeviceWebId)
+	}
+	segment, created := unidentifiedDriving.observe(r.cwAccountId, r.cwDeviceWebId, record, read)
+	if segment.id == "" {
+		return nil, false
+	}
+	ref := unidentifiedSegmentReference(c, r.cwAccountId, r.cwDeviceWebId, segment.id)
+	if created {
+		// a replay from before the latest stored segment can start an older one over,
+		// it's only pending assignment if it isn't stored yet
+		guard := &FirestoreWriteGuardV1{create: true}
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: segment.fields(true), opts: []firestore.SetOption{firestore.MergeAll}, guard: guard})
+	}
+	queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: segment.fields(false), opts: []firestore.SetOption{firestore.MergeAll}})
+	if record.RecordId != "" && validFirestoreDocumentId(record.RecordId) {
+		return ref.Collection("report_data").Doc(record.RecordId), true
+	}
+	return ref.Collection("report_data").NewDoc(), true
+}
+
+// read a vehicle's segment with the newest endTimestamp, found is false when it has none
+func readLatestUnidentifiedSegment(ctx context.Context, c *firestore.Client, cwAccountId string, cwDeviceWebId string) (stored FirestoreUnidentifiedSegmentV1, found bool, err error) {
+	segments := c.Collection("account").Doc(cwAccountId).Collection("vehicle").Doc(cwDeviceWebId).Collection(unidentifiedDrivingCollection)
+	var docs []*firestore.DocumentSnapshot
+	err = withFirestoreRetry(ctx, func(attemptCtx context.Context) (err error) {
+		docs, err = segments.OrderBy("endTimestamp", firestore.Desc).Limit(1).Documents(attemptCtx).GetAll()
+		return err
+	})
+	if err != nil || len(docs) == 0 {
+		return stored, false, err
+	}
+	return stored, true, docs[0].DataTo(&stored)
+}
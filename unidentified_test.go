@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// a driverless navigation record at an odometer reading
+func testUnidentifiedNavigation(id string, at time.Time, miles float64) FirestoreEldReportV1 {
+	r := testEldNavigation(id, at)
+	r.TotalVehicleMiles = miles
+	r.Location = &latlng.LatLng{Latitude: 41.41, Longitude: -70.58 + miles/1000}
+	return r
+}
+
+// driverless navigation records build on their vehicle's segment until a gap starts a new one
+func TestUnidentifiedDrivingSegments(t *testing.T) {
+	tripGapTimeout = DefaultTripGapTimeout
+	var tracker UnidentifiedDrivingTracker
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+
+	first, created := tracker.observe("1001", "2002", testUnidentifiedNavigation("a", start, 100), nil)
+	if !created || first.id == "" || first.records != 1 {
+		t.Fatalf("observe() first record = %+v, %t, want a new segment", first, created)
+	}
+	if fields := first.fields(created); fields["assignmentStatus"] != unidentifiedPending {
+		t.Errorf("new segment assignmentStatus = %v, want: %s", fields["assignmentStatus"], unidentifiedPending)
+	}
+	tracker.observe("1001", "2002", testUnidentifiedNavigation("c", start.Add(10*time.Minute), 108), nil)
+	// late, but still part of the segment
+	s, created := tracker.observe("1001", "2002", testUnidentifiedNavigation("b", start.Add(5*time.Minute), 104), nil)
+	if created || s.id != first.id || s.records != 3 || !s.end.Equal(start.Add(10*time.Minute)) {
+		t.Errorf("observe() same segment = %+v, %t", s, created)
+	}
+	fields := s.fields(created)
+	if _, ok := fields["assignmentStatus"]; ok {
+		t.Errorf("segment update sets assignmentStatus, would undo an assignment")
+	}
+	if fields["distance"] != 8.0 || fields["duration"] != float64(10*time.Minute/time.Millisecond) {
+		t.Errorf("segment distance, duration = %v, %v, want: 8, 600000", fields["distance"], fields["duration"])
+	}
+
+	later, created := tracker.observe("1001", "2002", testUnidentifiedNavigation("d", start.Add(time.Hour), 130), nil)
+	if !created || later.id == first.id {
+		t.Errorf("observe() after a gap = %s, %t, want a new segment", later.id, created)
+	}
+	other, created := tracker.observe("1001", "3003", testUnidentifiedNavigation("e", start.Add(time.Hour), 50), nil)
+	if !created || other.id == later.id {
+		t.Errorf("observe() for another vehicle = %s, %t, want its own segment", other.id, created)
+	}
+}
+
+// after a restart the vehicle's latest stored segment is carried on with rather than overlapped
+func TestUnidentifiedDrivingSeed(t *testing.T) {
+	tripGapTimeout = DefaultTripGapTimeout
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	var before UnidentifiedDrivingTracker
+	before.observe("1001", "2002", testUnidentifiedNavigation("a", start, 100), nil)
+	open, _ := before.observe("1001", "2002", testUnidentifiedNavigation("b", start.Add(5*time.Minute), 104), nil)
+	fields := open.fields(false)
+	stored := FirestoreUnidentifiedSegmentV1{
+		SegmentId:         fields["segmentId"].(string),
+		StartTimestamp:    fields["startTimestamp"].(time.Time),
+		EndTimestamp:      fields["endTimestamp"].(time.Time),
+		RecordCount:       fields["recordCount"].(int),
+		StartLocation:     fields["startLocation"].(*latlng.LatLng),
+		EndLocation:       fields["endLocation"].(*latlng.LatLng),
+		StartVehicleMiles: fields["startVehicleMiles"].(float64),
+		EndVehicleMiles:   fields["endVehicleMiles"].(float64),
+	}
+
+	var after UnidentifiedDrivingTracker
+	failing := func() (FirestoreUnidentifiedSegmentV1, bool, error) { return stored, false, errors.New("unavailable") }
+	if s, _ := after.observe("1001", "2002", testUnidentifiedNavigation("c", start.Add(10*time.Minute), 108), failing); s.id != "" {
+		t.Errorf("observe() with a failing read = %+v, want the record not placed", s)
+	}
+	reads := 0
+	read := func() (FirestoreUnidentifiedSegmentV1, bool, error) { reads++; return stored, true, nil }
+	s, created := after.observe("1001", "2002", testUnidentifiedNavigation("c", start.Add(10*time.Minute), 108), read)
+	if created || s.id != open.id || s.records != 3 || !s.start.Equal(start) {
+		t.Errorf("observe() after a restart = %+v, %t, want the stored segment carried on with", s, created)
+	}
+	if fields := s.fields(created); fields["distance"] != 8.0 {
+		t.Errorf("carried on segment distance = %v, want: 8", fields["distance"])
+	}
+	later, created := after.observe("1001", "2002", testUnidentifiedNavigation("d", start.Add(time.Hour), 130), read)
+	if !created || later.id == open.id || reads != 1 {
+		t.Errorf("observe() after a gap = %s, %t with %d reads, want a new segment and one read", later.id, created, reads)
+	}
+
+	// a vehicle without stored segments is only read once
+	var none UnidentifiedDrivingTracker
+	reads = 0
+	empty := func() (FirestoreUnidentifiedSegmentV1, bool, error) {
+		reads++
+		return FirestoreUnidentifiedSegmentV1{}, false, nil
+	}
+	none.observe("1001", "3003", FirestoreEldReportV1{}, empty) // no time, not placed and not read
+	first, created := none.observe("1001", "3003", testUnidentifiedNavigation("e", start, 50), empty)
+	none.observe("1001", "3003", testUnidentifiedNavigation("f", start.Add(time.Minute), 51), empty)
+	if !created || first.id == "" || reads != 1 {
+		t.Errorf("observe() without a stored segment = %s, %t with %d reads, want a new segment and one read", first.id, created, reads)
+	}
+}
+
+// navigation records without a userId build as unidentified when their transponder is known
+func TestEldUnidentifiedBuild(t *testing.T) {
+	testNavajoReferenceIds(t, map[string]string{"12": "1001"}, map[string]string{"519372": "2002"})
+
+	r := testEldReport(t, `{"type":"ELD_RECORD","dataType":"navigation","accountId":12,
+		"data":{"recordId":"u1","recordTimestamp":1613576740322,"sentFrom":{"transponderId":519372}}}`)
+	if !r.build() || !r.unidentified() || r.cwDeviceWebId != "2002" {
+		t.Errorf("build() of driverless navigation = unidentified:%t webId:%s", r.unidentified(), r.cwDeviceWebId)
+	}
+	r = testEldReport(t, `{"type":"ELD_RECORD","dataType":"duty_status","accountId":12,
+		"data":{"recordId":"u2","recordTimestamp":1613576740322,"sentFrom":{"transponderId":519372}}}`)
+	if r.build() {
+		t.Errorf("build() of driverless duty_status = true, want: false")
+	}
+	r = testEldReport(t, `{"type":"ELD_RECORD","dataType":"navigation","accountId":12,
+		"data":{"recordId":"u3","recordTimestamp":1613576740322,"sentFrom":{"transponderId":1}}}`)
+	if r.build() {
+		t.Errorf("build() of driverless navigation from an unknown transponder = true, want: false")
+	}
+}
+
+// a new segment's pending status is only written if the segment isn't stored yet, so a replay
+// after a restart can't undo an assignment
+func TestWriteUnidentifiedDrivingAssignment(t *testing.T) {
+	tripGapTimeout = DefaultTripGapTimeout
+	c := testOfflineFirestoreClient(t)
+	defer c.Close()
+	writes := testQueuedFirestoreWrites(t)
+	prev := unidentifiedDriving.segments
+	// the vehicle has no stored segment, there's no Firestore to read that from here
+	unidentifiedDriving.segments = map[string]*unidentifiedSegment{"1001/2002": nil}
+	t.Cleanup(func() { unidentifiedDriving.segments = prev })
+
+	r := &EldReportDataStreamV1{cwAccountId: "1001", cwDeviceWebId: "2002"}
+	start := time.Date(2021, 2, 17, 6, 0, 0, 0, time.UTC)
+	if _, ok := writeUnidentifiedDriving(context.Background(), c, r, testUnidentifiedNavigation("a", start, 100)); !ok {
+		t.Fatalf("writeUnidentifiedDriving() = false")
+	}
+	create, update := <-writes, <-writes
+	if create.guard == nil || !create.guard.create || create.data.(map[string]interface{})["assignmentStatus"] != unidentifiedPending {
+		t.Errorf("new segment write = guard %+v, data %v, want a create-only write pending assignment", create.guard, create.data)
+	}
+	if _, ok := update.data.(map[string]interface{})["assignmentStatus"]; ok || update.guard != nil {
+		t.Errorf("segment update = guard %+v, data %v, want an unguarded write without assignmentStatus", update.guard, update.data)
+	}
+
+	writeUnidentifiedDriving(context.Background(), c, r, testUnidentifiedNavigation("b", start.Add(time.Minute), 101))
+	if w := <-writes; w.guard != nil || len(writes) != 0 {
+		t.Errorf("second record queued a guarded write or more than one write")
+	}
+}
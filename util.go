@@ -23,7 +23,7 @@ func now() time.Time {
 // program if it receives an interrupt from the OS. We then handle this by calling
 // our clean up procedure and exiting the program.
 func setupCloseHandler(cancel context.CancelFunc) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	for {
 		select {
@@ -66,5 +66,11 @@ func initGlobalChannels() (ok bool) {
 	transponderReportsV1 = make(chan TransponderReportDataStreamV1)
 	videoReportsV1 = make(chan VideoReportDataStreamV1)
 	eldReportsV1 = make(chan EldReportDataStreamV1)
+	// documents ready to be batched into Firestore
+	firestoreWrites = make(chan FirestoreWriteV1)
+	firestoreGovernedWrites = make([]chan FirestoreWriteV1, firestoreBatchWriters)
+	for i := range firestoreGovernedWrites {
+		firestoreGovernedWrites[i] = make(chan FirestoreWriteV1, firestoreMaxBatchSize)
+	}
 	return ok
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Most recent known state of a vehicle, kept at /account/{id}/vehicle/{webId}/state/latest
+// so clients can find a vehicle without querying report_data ordered by time
+type FirestoreVehicleLatestV1 struct {
+	Serial             float64        `firestore:"serial,omitempty"`
+	LatLng             *latlng.LatLng `firestore:"latLng,omitempty"`
+	Geohash            *GeohashesV1   `firestore:"geohash,omitempty"`
+	LocationAccuracy   float64        `firestore:"locationAccuracy,omitempty"`
+	Heading            float64        `firestore:"heading,omitempty"`
+	Speed              float64        `firestore:"speed"`
+	BatteryVoltage     float64        `firestore:"batteryVoltage,omitempty"`
+	IsLowBattery       bool           `firestore:"isLowBatteryVoltage"`
+	CellSignalStrength float64        `firestore:"cellSignalStrength,omitempty"`
+	Odometer           float64        `firestore:"odometer,omitempty"`
+	LastReportType     string         `firestore:"lastReportType,omitempty"`    // dataType of the newest report seen
+	ReportTimestamp    time.Time      `firestore:"reportTimestamp,omitempty"`   // reportTimestamp of the newest report seen
+	PositionTimestamp  time.Time      `firestore:"positionTimestamp,omitempty"` // reportTimestamp of the newest report carrying a location
+	SchemaVersion      int            `firestore:"schemaVersion"`
+	FirestoreUpdate    time.Time      `firestore:"fsUpdateTimestamp,serverTimestamp"` // if zero, Firestore sets this on their end
+}
+
+// in-memory copy of every vehicle's latest state, used to make sure the
+// Firestore document only ever moves forward in time
+type VehicleStateTracker struct {
+	mu     sync.Mutex
+	states map[string]*FirestoreVehicleLatestV1 // "cwAccountId/cwDeviceWebId":state
+}
+
+// create a firestore reference location for a vehicle's latest state
+func vehicleLatestReference(c *firestore.Client, cwAccountId string, cwDeviceWebId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("vehicle").Doc(cwDeviceWebId).Collection("state").Doc("latest")
+}
+
+// fold a freshly marshalled transponder report into the vehicle's latest state and
+// queue a write of the result. Reports older than what we already have are ignored.
+func (t *VehicleStateTracker) update(ctx context.Context, c *firestore.Client, r *TransponderReportDataStreamV1, record FirestoreTransponderReportV1) (FirestoreVehicleLatestV1, bool) {
+	if record.ReportTimestamp.IsZero() {
+		return FirestoreVehicleLatestV1{}, false
+	}
+	key := r.cwAccountId + "/" + r.cwDeviceWebId
+	ref := vehicleLatestReference(c, r.cwAccountId, r.cwDeviceWebId)
+
+	t.mu.Lock()
+	if t.states == nil {
+		t.states = make(map[string]*FirestoreVehicleLatestV1)
+	}
+	_, known := t.states[key]
+	t.mu.Unlock()
+	if !known {
+		// first time we've seen this vehicle since boot, pick up where the document left off
+		seed := t.seed(ctx, ref)
+		t.mu.Lock()
+		if _, known = t.states[key]; !known {
+			t.states[key] = seed
+		}
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	state := t.states[key]
+	if !record.ReportTimestamp.After(state.ReportTimestamp) {
+		t.mu.Unlock()
+		log.Debugf("VehicleStateTracker: ignoring %s report for %s older than latest state (%v <= %v)", record.Type, key, record.ReportTimestamp, state.ReportTimestamp)
+		return *state, false
+	}
+	state.applyReport(record)
+	latest := *state
+	t.mu.Unlock()
+
+	latest.FirestoreUpdate = time.Time{} // let Firestore stamp every update
+	latest.SchemaVersion = schemaVersionV1
+	// the tracker only moves forward, the guard makes sure the document does too
+	// when an older write commits after a newer one
+	guard := &FirestoreWriteGuardV1{field: "reportTimestamp", at: latest.ReportTimestamp}
+	queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: latest, guard: guard})
+	return latest, true
+}
+
+// read an existing latest state document, a missing or unreadable document starts us from scratch
+func (t *VehicleStateTracker) seed(ctx context.Context, ref *firestore.DocumentRef) *FirestoreVehicleLatestV1 {
+	state := &FirestoreVehicleLatestV1{}
+	readCtx, cancel := context.WithTimeout(ctx, firestoreWriteTimeout)
+	defer cancel()
+	snap, err := ref.Get(readCtx)
+	if err != nil {
+		if status.Code(err) != codes.NotFound {
+			log.Warnf("VehicleStateTracker: unable to read %s, starting from an empty state: %v", ref.Path, err)
+		}
+		return state
+	}
+	if err := snap.DataTo(state); err != nil {
+		log.Warnf("VehicleStateTracker: unable to decode %s, starting from an empty state: %v", ref.Path, err)
+		return &FirestoreVehicleLatestV1{}
+	}
+	return state
+}
+
+// copy whatever a report knows about the vehicle over our current state. Values a report
+// doesn't carry (no location on a report, ...) keep their previous value.
+func (s *FirestoreVehicleLatestV1) applyReport(record FirestoreTransponderReportV1) {
+	s.ReportTimestamp = record.ReportTimestamp
+	s.LastReportType = record.Type
+	if record.Serial != 0 {
+		s.Serial = record.Serial
+	}
+	if record.LatLng != nil {
+		s.LatLng = record.LatLng
+		s.Geohash = geohashes(record.LatLng)
+		s.LocationAccuracy = record.LocationAccuracy
+		s.Heading = record.Heading
+		s.PositionTimestamp = record.ReportTimestamp
+	}
+	if record.LatLng != nil || record.Speed != 0 {
+		s.Speed = record.Speed
+	}
+	if record.BatteryVoltage != 0 {
+		s.BatteryVoltage = record.BatteryVoltage
+		s.IsLowBattery = record.IsLowBattery
+	}
+	if record.CellSignalStrength != 0 {
+		s.CellSignalStrength = record.CellSignalStrength
+	}
+	if record.Odometer != 0 {
+		s.Odometer = record.Odometer
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// reports only overwrite what they carry, the rest of the state stays as it was
+func TestVehicleStateApplyReport(t *testing.T) {
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	where := &latlng.LatLng{Latitude: 37.7793, Longitude: -122.4193}
+	state := FirestoreVehicleLatestV1{}
+	state.applyReport(FirestoreTransponderReportV1{Type: "status", ReportTimestamp: at, Serial: 7, LatLng: where, Heading: 90, Speed: 42, BatteryVoltage: 12.6, Odometer: 1000})
+	state.applyReport(FirestoreTransponderReportV1{Type: "ignition_off", ReportTimestamp: at.Add(time.Minute), CellSignalStrength: -70})
+
+	if state.LastReportType != "ignition_off" || !state.ReportTimestamp.Equal(at.Add(time.Minute)) {
+		t.Errorf("last report = %s at %v, want ignition_off at %v", state.LastReportType, state.ReportTimestamp, at.Add(time.Minute))
+	}
+	if state.LatLng != where || !state.PositionTimestamp.Equal(at) || state.Heading != 90 || state.Geohash == nil {
+		t.Errorf("position = %v (%v, heading %v), want the status report's", state.LatLng, state.PositionTimestamp, state.Heading)
+	}
+	if state.Speed != 42 || state.Serial != 7 || state.BatteryVoltage != 12.6 || state.Odometer != 1000 || state.CellSignalStrength != -70 {
+		t.Errorf("state = %+v, want values carried over from both reports", state)
+	}
+}
+
+// the state only moves forward, and its write is guarded so the document does too
+func TestVehicleStateUpdate(t *testing.T) {
+	c := testOfflineFirestoreClient(t)
+	queued := testQueuedFirestoreWrites(t)
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	r := &TransponderReportDataStreamV1{cwAccountId: "1001", cwDeviceWebId: "2002"}
+	// a known vehicle, so update() doesn't read Firestore
+	tracker := VehicleStateTracker{states: map[string]*FirestoreVehicleLatestV1{"1001/2002": {ReportTimestamp: at}}}
+
+	latest, advanced := tracker.update(context.Background(), c, r, FirestoreTransponderReportV1{Type: "status", ReportTimestamp: at.Add(time.Minute), Speed: 30})
+	if !advanced || latest.Speed != 30 {
+		t.Fatalf("update() with a newer report = %+v, %t, want it applied", latest, advanced)
+	}
+	w := <-queued
+	if w.ref.Path != vehicleLatestReference(c, "1001", "2002").Path || w.guard == nil || w.guard.field != "reportTimestamp" || !w.guard.at.Equal(at.Add(time.Minute)) {
+		t.Errorf("queued write = %s guarded by %+v, want state/latest guarded at %v", w.ref.Path, w.guard, at.Add(time.Minute))
+	}
+
+	if _, advanced := tracker.update(context.Background(), c, r, FirestoreTransponderReportV1{Type: "status", ReportTimestamp: at.Add(30 * time.Second), Speed: 10}); advanced {
+		t.Errorf("update() applied a report older than the latest state")
+	}
+	if _, advanced := tracker.update(context.Background(), c, r, FirestoreTransponderReportV1{Type: "status"}); advanced {
+		t.Errorf("update() applied a report without a reportTimestamp")
+	}
+	if len(queued) != 0 {
+		t.Errorf("%d writes queued for reports that didn't advance the state", len(queued))
+	}
+}
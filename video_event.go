@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Dashcam footage uploads over several video reports sent for the same videoEventId. Each event
+// is kept as one document at /account/{id}/vehicle/{webId}/video_event/{videoEventId} with its
+// footage merged by footageId. Uploads whose lastChunkRxTimestamp hasn't advanced for
+// VIDEO_UPLOAD_STALL_TIMEOUT are flagged uploadStalled until they move again.
+type VideoEventTracker struct {
+	mu     sync.Mutex
+	events map[string]*videoEvent // "cwAccountId/cwDeviceWebId/videoEventId":event
+}
+
+// a video event with uploads still in flight
+type videoEvent struct {
+	cwAccountId   string
+	cwDeviceWebId string
+	record        FirestoreVideoReportV1
+	advanced      map[string]time.Time // footageId:when its upload last moved
+	lastSeen      time.Time
+}
+
+// a video event document update, fields are written with MergeAll
+type videoEventWrite struct {
+	cwAccountId   string
+	cwDeviceWebId string
+	videoEventId  string
+	fields        map[string]interface{}
+}
+
+// events with stalled uploads are forgotten after this long without a report
+const videoEventMemory time.Duration = 24 * time.Hour
+
+// create a firestore reference location for a video event
+func videoEventReference(c *firestore.Client, cwAccountId string, cwDeviceWebId string, videoEventId string) *firestore.DocumentRef {
+	return c.Collection("account").Doc(cwAccountId).Collection("vehicle").Doc(cwDeviceWebId).Collection("video_event").Doc(videoEventId)
+}
+
+// uploads that won't move any further
+func videoUploadFinished(uploadStatus string) bool {
+	switch strings.ToUpper(uploadStatus) {
+	case "COMPLETED", "FAILED":
+		return true
+	}
+	return false
+}
+
+// fold a video report into its event, returning the document update. Events we haven't seen
+// since boot start from the stored event read returns (read may be nil when there's nothing to
+// read); when the read fails there's no update, an event written without its stored footage would lose it.
+func (t *VideoEventTracker) observe(cwAccountId string, cwDeviceWebId string, record FirestoreVideoReportV1, at time.Time, read func() (FirestoreVideoReportV1, bool, error)) (videoEventWrite, error) {
+	key := cwAccountId + "/" + cwDeviceWebId + "/" + record.VideoEventId
+	created, err := t.seed(key, cwAccountId, cwDeviceWebId, at, read)
+	if err != nil {
+		return videoEventWrite{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.events[key]
+	e.merge(record, at)
+	e.stalls(at)
+	e.lastSeen = at
+	w := e.write(created)
+	if e.finished() {
+		delete(t.events, key)
+	}
+	return w, nil
+}
+
+// sign a video event's footage again (only footageId's when set), returning the document update
+// and the new URLs by footageId. The event is read from Firestore first if we don't hold it.
+func (t *VideoEventTracker) refresh(cwAccountId string, cwDeviceWebId string, videoEventId string, footageId string, at time.Time, read func() (FirestoreVideoReportV1, bool, error)) (videoEventWrite, map[string]interface{}, error) {
+	key := cwAccountId + "/" + cwDeviceWebId + "/" + videoEventId
+	created, err := t.seed(key, cwAccountId, cwDeviceWebId, at, read)
+	if err != nil {
+		return videoEventWrite{}, nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.events[key]
+	if created {
+		// nothing stored and nothing reported, there's no event to sign
+		delete(t.events, key)
+		return videoEventWrite{}, nil, errors.New("no such video event")
+	}
+	if signFootage(e.record.Footage, footageId, at) == 0 {
+		return videoEventWrite{}, nil, errors.New("no footage to sign")
+	}
+	urls := make(map[string]interface{})
+	for _, f := range e.record.Footage {
+		if f.SignedUrl != "" && (footageId == "" || f.FootageId == footageId) {
+			urls[f.FootageId] = map[string]interface{}{
+				"signedUrl":           f.SignedUrl,
+				"signedUrlExpiration": f.SignedUrlExpiration,
+			}
+		}
+	}
+	w := e.write(false)
+	if e.finished() {
+		delete(t.events, key)
+	}
+	return w, urls, nil
+}
+
+// make sure we hold an event, starting it from the stored one read returns the first time we see
+// it. created is true when this call started an event that isn't stored yet.
+func (t *VideoEventTracker) seed(key string, cwAccountId string, cwDeviceWebId string, at time.Time, read func() (FirestoreVideoReportV1, bool, error)) (created bool, err error) {
+	var stored FirestoreVideoReportV1
+	found := false
+	err = seedTracker(&t.mu,
+		func() bool { _, known := t.events[key]; return known },
+		func() (err error) {
+			if read != nil {
+				stored, found, err = read()
+			}
+			return err
+		},
+		func() {
+			if t.events == nil {
+				t.events = make(map[string]*videoEvent)
+			}
+			e := &videoEvent{cwAccountId: cwAccountId, cwDeviceWebId: cwDeviceWebId, advanced: make(map[string]time.Time), lastSeen: at}
+			if found {
+				e.record = stored
+				for _, f := range stored.Footage {
+					e.advanced[f.FootageId] = at
+				}
+			}
+			t.events[key] = e
+			created = !found
+		})
+	return created, err
+}
+
+// take a report's event metadata and footage into the event
+func (e *videoEvent) merge(record FirestoreVideoReportV1, at time.Time) {
+	footage := e.record.Footage
+	e.record = record
+	e.record.Footage = footage
+	for _, update := range record.Footage {
+		if update.FootageId == "" {
+			log.Warnf("VideoEventTracker: dropping footage without a footageId from video event %s", record.VideoEventId)
+			continue
+		}
+		i := 0
+		for i < len(e.record.Footage) && e.record.Footage[i].FootageId != update.FootageId {
+			i++
+		}
+		if i == len(e.record.Footage) {
+			e.record.Footage = append(e.record.Footage, update)
+			e.advanced[update.FootageId] = at
+			continue
+		}
+		old := e.record.Footage[i]
+		if update.LastChunkRxTime.Before(old.LastChunkRxTime) {
+			// an older upload state arriving late, keep the one we have
+			update.UploadStatus = old.UploadStatus
+			update.UploadStartTime = old.UploadStartTime
+			update.LastChunkRxTime = old.LastChunkRxTime
+			update.BytesRemaining = old.BytesRemaining
+			update.UploadStatusReason = old.UploadStatusReason
+		}
+		if update.LastChunkRxTime.After(old.LastChunkRxTime) || update.UploadStatus != old.UploadStatus {
+			e.advanced[update.FootageId] = at
+		}
+		update.UploadStalled = old.UploadStalled
+		e.record.Footage[i] = update
+	}
+}
+
+// raise or clear the stalled flag on every footage upload, returning whether any flipped
+func (e *videoEvent) stalls(at time.Time) (changed bool) {
+	e.record.UploadStalled = false
+	for i, f := range e.record.Footage {
+		stalled := !videoUploadFinished(f.UploadStatus) && at.Sub(e.advanced[f.FootageId]) > videoUploadStallTimeout
+		if stalled != f.UploadStalled {
+			changed = true
+			e.record.Footage[i].UploadStalled = stalled
+			if stalled {
+				log.Infof("Video upload of footage %s for %s/%s stalled, %.0f bytes remaining", f.FootageId, e.cwAccountId, e.cwDeviceWebId, f.BytesRemaining)
+			}
+		}
+		e.record.UploadStalled = e.record.UploadStalled || stalled
+	}
+	return changed
+}
+
+// every footage upload has finished
+func (e *videoEvent) finished() bool {
+	for _, f := range e.record.Footage {
+		if !videoUploadFinished(f.UploadStatus) {
+			return false
+		}
+	}
+	return true
+}
+
+// fields firestream owns on a video event document, the creation time is only stamped once
+func (e *videoEvent) write(created bool) videoEventWrite {
+	r := e.record
+	fields := map[string]interface{}{
+		"videoEventId":      r.VideoEventId,
+		"type":              r.Type,
+		"uploadStalled":     r.UploadStalled,
+		"schemaVersion":     schemaVersionV1,
+		"fsUpdateTimestamp": firestore.ServerTimestamp,
+	}
+	if r.TerminalNumber != "" {
+		fields["terminalNumber"] = r.TerminalNumber
+	}
+	if r.TransponderId != 0 {
+		fields["transponderId"] = r.TransponderId
+	}
+	if !r.EventTimestamp.IsZero() {
+		fields["eventTimestamp"] = r.EventTimestamp
+	}
+	if r.Username != "" {
+		fields["username"] = r.Username
+	}
+	if len(r.EventType) > 0 {
+		fields["eventType"] = r.EventType
+	}
+	if r.Location != nil {
+		fields["location"] = r.Location
+		fields["geohash"] = r.Geohash
+	}
+	if r.LocationAccuracy != 0 {
+		fields["locationAccuracy"] = r.LocationAccuracy
+	}
+	if r.Speed != 0 {
+		fields["speed"] = r.Speed
+	}
+	if r.Heading != 0 {
+		fields["heading"] = r.Heading
+	}
+	if len(r.Footage) > 0 {
+		// merge keeps updating e.record.Footage in place after this is queued
+		fields["footage"] = append([]VideoReportFootageV1(nil), r.Footage...)
+	}
+	if created {
+		fields["fsCreateTimestamp"] = firestore.ServerTimestamp
+	}
+	return videoEventWrite{cwAccountId: e.cwAccountId, cwDeviceWebId: e.cwDeviceWebId, videoEventId: r.VideoEventId, fields: fields}
+}
+
+// raise stalled flags on uploads that stopped moving, and forget events that went quiet
+func (t *VideoEventTracker) sweep(at time.Time) []videoEventWrite {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var writes []videoEventWrite
+	for key, e := range t.events {
+		if e.stalls(at) {
+			writes = append(writes, e.write(false))
+		}
+		if at.Sub(e.lastSeen) > videoEventMemory {
+			delete(t.events, key)
+		}
+	}
+	return writes
+}
+
+func writeVideoEvents(ctx context.Context, c *firestore.Client, writes []videoEventWrite) {
+	for _, w := range writes {
+		ref := videoEventReference(c, w.cwAccountId, w.cwDeviceWebId, w.videoEventId)
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref, data: w.fields, opts: []firestore.SetOption{firestore.MergeAll}})
+	}
+}
+
+// update and write a video event from a video report
+func writeVideoEvent(ctx context.Context, c *firestore.Client, r *VideoReportDataStreamV1, record FirestoreVideoReportV1) {
+	ref := videoEventReference(c, r.cwAccountId, r.cwDeviceWebId, record.VideoEventId)
+	read := func() (event FirestoreVideoReportV1, found bool, err error) {
+		found, err = readSeedDocument(ctx, ref, &event)
+		return event, found, err
+	}
+	w, err := videoEvents.observe(r.cwAccountId, r.cwDeviceWebId, record, now(), read)
+	if err != nil {
+		log.Warnf("VideoEventTracker: unable to read %s, skipping this report of it: %v", ref.Path, err)
+		return
+	}
+	writeVideoEvents(ctx, c, []videoEventWrite{w})
+}
+
+// flag footage uploads that stopped moving without another report to tell us
+func videoStallSweeper(ctx context.Context, c *firestore.Client) {
+	interval := videoUploadStallTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			writeVideoEvents(ctx, c, videoEvents.sweep(now()))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func videoTestFootage(id string, status string, lastChunk time.Time, remaining float64) VideoReportFootageV1 {
+	return VideoReportFootageV1{FootageId: id, GarminCameraName: "0", UploadStatus: status, LastChunkRxTime: lastChunk, BytesRemaining: remaining}
+}
+
+// reports for the same video event merge their footage by footageId into one document
+func TestVideoEventMerge(t *testing.T) {
+	defer func(d time.Duration) { videoUploadStallTimeout = d }(videoUploadStallTimeout)
+	videoUploadStallTimeout = 5 * time.Minute
+	tracker := VideoEventTracker{}
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	report := func(footage ...VideoReportFootageV1) FirestoreVideoReportV1 {
+		return FirestoreVideoReportV1{VideoEventId: "4ad20507", TransponderId: 519521, Type: "video_upload", Footage: footage}
+	}
+
+	w, _ := tracker.observe("1001", "2002", report(videoTestFootage("cam0", "IN_PROGRESS", at, 8000)), at, nil)
+	if w.videoEventId != "4ad20507" || w.fields["fsCreateTimestamp"] == nil {
+		t.Errorf("first report = %s created:%t, want 4ad20507 created", w.videoEventId, w.fields["fsCreateTimestamp"] != nil)
+	}
+	w, _ = tracker.observe("1001", "2002", report(videoTestFootage("cam1", "IN_PROGRESS", at, 9000)), at.Add(time.Second), nil)
+	if _, ok := w.fields["fsCreateTimestamp"]; ok {
+		t.Errorf("an update stamped fsCreateTimestamp again")
+	}
+	w, _ = tracker.observe("1001", "2002", report(videoTestFootage("cam0", "IN_PROGRESS", at.Add(time.Minute), 2000)), at.Add(time.Minute), nil)
+	footage := w.fields["footage"].([]VideoReportFootageV1)
+	if len(footage) != 2 || footage[0].FootageId != "cam0" || footage[0].BytesRemaining != 2000 || footage[1].FootageId != "cam1" {
+		t.Errorf("merged footage = %+v", footage)
+	}
+
+	// an older upload state arriving late doesn't undo progress
+	w, _ = tracker.observe("1001", "2002", report(videoTestFootage("cam0", "IN_PROGRESS", at, 8000)), at.Add(2*time.Minute), nil)
+	if f := w.fields["footage"].([]VideoReportFootageV1)[0]; f.BytesRemaining != 2000 || !f.LastChunkRxTime.Equal(at.Add(time.Minute)) {
+		t.Errorf("late upload state replaced newer progress: %+v", f)
+	}
+
+	// once every upload finished the event is forgotten, a later report re-reads it
+	tracker.observe("1001", "2002", report(videoTestFootage("cam0", "COMPLETED", at.Add(3*time.Minute), 0)), at.Add(3*time.Minute), nil)
+	tracker.observe("1001", "2002", report(videoTestFootage("cam1", "COMPLETED", at.Add(3*time.Minute), 0)), at.Add(3*time.Minute), nil)
+	reads := 0
+	read := func() (FirestoreVideoReportV1, bool, error) {
+		reads++
+		return report(videoTestFootage("cam0", "COMPLETED", at.Add(3*time.Minute), 0), videoTestFootage("cam1", "COMPLETED", at.Add(3*time.Minute), 0)), true, nil
+	}
+	w, _ = tracker.observe("1001", "2002", report(videoTestFootage("cam2", "IN_PROGRESS", at.Add(4*time.Minute), 100)), at.Add(4*time.Minute), read)
+	if reads != 1 || len(w.fields["footage"].([]VideoReportFootageV1)) != 3 || w.fields["fsCreateTimestamp"] != nil {
+		t.Errorf("re-seeded event = reads:%d footage:%d created:%t", reads, len(w.fields["footage"].([]VideoReportFootageV1)), w.fields["fsCreateTimestamp"] != nil)
+	}
+}
+
+// uploads whose last chunk stops advancing are flagged stalled until they move again
+func TestVideoEventStall(t *testing.T) {
+	defer func(d time.Duration) { videoUploadStallTimeout = d }(videoUploadStallTimeout)
+	videoUploadStallTimeout = 5 * time.Minute
+	tracker := VideoEventTracker{}
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	report := FirestoreVideoReportV1{VideoEventId: "4ad20507", Footage: []VideoReportFootageV1{
+		videoTestFootage("cam0", "IN_PROGRESS", at, 8000),
+		videoTestFootage("cam1", "COMPLETED", at, 0),
+	}}
+	tracker.observe("1001", "2002", report, at, nil)
+
+	if writes := tracker.sweep(at.Add(4 * time.Minute)); len(writes) != 0 {
+		t.Errorf("sweep before VIDEO_UPLOAD_STALL_TIMEOUT wrote %d updates", len(writes))
+	}
+	writes := tracker.sweep(at.Add(6 * time.Minute))
+	if len(writes) != 1 || writes[0].fields["uploadStalled"] != true {
+		t.Fatalf("sweep after VIDEO_UPLOAD_STALL_TIMEOUT = %+v, want one stalled update", writes)
+	}
+	if footage := writes[0].fields["footage"].([]VideoReportFootageV1); !footage[0].UploadStalled || footage[1].UploadStalled {
+		t.Errorf("stalled flags = cam0:%t cam1:%t, want only the unfinished upload", footage[0].UploadStalled, footage[1].UploadStalled)
+	}
+	if writes := tracker.sweep(at.Add(7 * time.Minute)); len(writes) != 0 {
+		t.Errorf("sweep of an already stalled upload wrote %d updates", len(writes))
+	}
+
+	// the upload moving again clears the flag
+	report.Footage[0] = videoTestFootage("cam0", "IN_PROGRESS", at.Add(8*time.Minute), 1000)
+	w, _ := tracker.observe("1001", "2002", report, at.Add(8*time.Minute), nil)
+	if w.fields["uploadStalled"] != false || w.fields["footage"].([]VideoReportFootageV1)[0].UploadStalled {
+		t.Errorf("upload that advanced is still stalled")
+	}
+
+	// events that went quiet are forgotten
+	tracker.sweep(at.Add(8*time.Minute + videoEventMemory + time.Minute))
+	if len(tracker.events) != 0 {
+		t.Errorf("%d events kept past videoEventMemory", len(tracker.events))
+	}
+}
+
+// a stored event that can't be read isn't rewritten as a new one without its footage
+func TestVideoEventReadError(t *testing.T) {
+	tracker := VideoEventTracker{}
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	report := FirestoreVideoReportV1{VideoEventId: "4ad20507", Footage: []VideoReportFootageV1{videoTestFootage("cam1", "IN_PROGRESS", at, 9000)}}
+	failing := func() (FirestoreVideoReportV1, bool, error) {
+		return FirestoreVideoReportV1{}, false, errors.New("unavailable")
+	}
+	if w, err := tracker.observe("1001", "2002", report, at, failing); err == nil || w.fields != nil {
+		t.Fatalf("observe() with a failed read = %v, %v, want no update and an error", w.fields, err)
+	}
+	stored := func() (FirestoreVideoReportV1, bool, error) {
+		return FirestoreVideoReportV1{VideoEventId: "4ad20507", Footage: []VideoReportFootageV1{videoTestFootage("cam0", "COMPLETED", at, 0)}}, true, nil
+	}
+	w, err := tracker.observe("1001", "2002", report, at.Add(time.Second), stored)
+	if err != nil || len(w.fields["footage"].([]VideoReportFootageV1)) != 2 || w.fields["fsCreateTimestamp"] != nil {
+		t.Errorf("observe() after a failed read = %v, %v, want the stored footage kept", w.fields, err)
+	}
+}
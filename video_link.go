@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Dashcams record video events around the same moments transponders report hard events, but the
+// two arrive separately and in either order. Events of the same vehicle within VIDEO_LINK_WINDOW
+// of each other are linked both ways: the hard event's report_data document gets the video event
+// in its video_link subcollection, the video event gets the report under safetyEvents. Report
+// documents are replaced whole when a report is written again, so links can't live on them.
+type VideoLinkTracker struct {
+	mu        sync.Mutex
+	safety    map[string][]linkSafetyEvent // "cwAccountId/cwDeviceWebId":recent hard events
+	videos    map[string][]linkVideoEvent  // "cwAccountId/cwDeviceWebId":recent video events
+	linked    map[string]bool              // "videoEventId|report document id":already linked
+	lastPrune time.Time
+}
+
+// subcollection of a hard event's report_data document holding the video events linked to it
+const videoLinkCollection string = "video_link"
+
+// A video event linked to a hard event, kept at .../report_data/{id}/video_link/{videoEventId}.
+// Type and ReportTimestamp are the hard event's, so retention prunes links along with their report.
+type FirestoreVideoLinkV1 struct {
+	VideoEvent      *firestore.DocumentRef `firestore:"videoEvent"`
+	EventTimestamp  time.Time              `firestore:"eventTimestamp"`
+	EventType       []string               `firestore:"eventType"`
+	Type            string                 `firestore:"type"`
+	ReportTimestamp time.Time              `firestore:"reportTimestamp"`
+	SchemaVersion   int                    `firestore:"schemaVersion"`
+}
+
+// a hard event report we may link video to
+type linkSafetyEvent struct {
+	refs     []*firestore.DocumentRef // every schema version of the report, the first one is linked from video
+	dataType string
+	at       time.Time // eventStart, or reportTimestamp when the report has none
+	reported time.Time
+	seen     time.Time
+}
+
+// a video event we may link hard events to
+type linkVideoEvent struct {
+	ref       *firestore.DocumentRef
+	eventType []string
+	at        time.Time
+	seen      time.Time
+}
+
+// a hard event and a video event that belong together
+type videoSafetyLink struct {
+	safety linkSafetyEvent
+	video  linkVideoEvent
+}
+
+// events wait this long for the other side to show up
+const videoLinkMemory time.Duration = time.Hour
+
+func videoLinkMatches(safety linkSafetyEvent, video linkVideoEvent) bool {
+	d := safety.at.Sub(video.at)
+	return -videoLinkWindow <= d && d <= videoLinkWindow
+}
+
+// remember a hard event, returning links to video events already seen for the vehicle
+func (t *VideoLinkTracker) observeSafety(key string, s linkSafetyEvent) []videoSafetyLink {
+	if s.at.IsZero() || len(s.refs) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(key, s.seen)
+	t.safety[key] = append(t.safety[key], s)
+	var links []videoSafetyLink
+	for _, v := range t.videos[key] {
+		if videoLinkMatches(s, v) {
+			links = t.link(links, s, v)
+		}
+	}
+	return links
+}
+
+// remember a video event, returning links to hard events already seen for the vehicle.
+// Reports of the same video event replace the one we had.
+func (t *VideoLinkTracker) observeVideo(key string, v linkVideoEvent) []videoSafetyLink {
+	if v.at.IsZero() || v.ref == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(key, v.seen)
+	videos := t.videos[key][:0]
+	for _, known := range t.videos[key] {
+		if known.ref.ID != v.ref.ID {
+			videos = append(videos, known)
+		}
+	}
+	t.videos[key] = append(videos, v)
+	var links []videoSafetyLink
+	for _, s := range t.safety[key] {
+		if videoLinkMatches(s, v) {
+			links = t.link(links, s, v)
+		}
+	}
+	return links
+}
+
+// add a link unless we've made it before, t.mu must be held
+func (t *VideoLinkTracker) link(links []videoSafetyLink, s linkSafetyEvent, v linkVideoEvent) []videoSafetyLink {
+	pair := v.ref.ID + "|" + s.refs[0].ID
+	if t.linked[pair] {
+		return links
+	}
+	t.linked[pair] = true
+	return append(links, videoSafetyLink{safety: s, video: v})
+}
+
+// forget events that waited longer than videoLinkMemory: the vehicle's on every event, every other
+// vehicle's at most once a minute so vehicles that stopped reporting don't stay with us. t.mu must be held
+func (t *VideoLinkTracker) prune(key string, at time.Time) {
+	if t.safety == nil {
+		t.safety = make(map[string][]linkSafetyEvent)
+		t.videos = make(map[string][]linkVideoEvent)
+		t.linked = make(map[string]bool)
+	}
+	t.pruneVehicle(key, at)
+	if at.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = at
+	for k := range t.safety {
+		t.pruneVehicle(k, at)
+	}
+	for k := range t.videos {
+		t.pruneVehicle(k, at)
+	}
+}
+
+// forget one vehicle's events that waited longer than videoLinkMemory, and the vehicle when none are left
+func (t *VideoLinkTracker) pruneVehicle(key string, at time.Time) {
+	safety := t.safety[key][:0]
+	for _, s := range t.safety[key] {
+		if at.Sub(s.seen) <= videoLinkMemory {
+			safety = append(safety, s)
+		}
+	}
+	videos := t.videos[key][:0]
+	for _, v := range t.videos[key] {
+		if at.Sub(v.seen) <= videoLinkMemory {
+			videos = append(videos, v)
+			continue
+		}
+		for pair := range t.linked {
+			if strings.HasPrefix(pair, v.ref.ID+"|") {
+				delete(t.linked, pair)
+			}
+		}
+	}
+	t.safety[key], t.videos[key] = safety, videos
+	if len(safety) == 0 {
+		delete(t.safety, key)
+	}
+	if len(videos) == 0 {
+		delete(t.videos, key)
+	}
+}
+
+// write both sides of each link
+func writeVideoLinks(ctx context.Context, links []videoSafetyLink) {
+	for _, l := range links {
+		log.Debugf("Linking video event %s to %s report %s", l.video.ref.ID, l.safety.dataType, l.safety.refs[0].ID)
+		toVideo := FirestoreVideoLinkV1{
+			VideoEvent:      l.video.ref,
+			EventTimestamp:  l.video.at,
+			EventType:       l.video.eventType,
+			Type:            l.safety.dataType,
+			ReportTimestamp: l.safety.reported,
+			SchemaVersion:   schemaVersionV1,
+		}
+		for _, ref := range l.safety.refs {
+			queueFirestoreWrite(ctx, FirestoreWriteV1{ref: ref.Collection(videoLinkCollection).Doc(l.video.ref.ID), data: toVideo})
+		}
+		toSafety := map[string]interface{}{
+			"safetyEvents": map[string]interface{}{
+				l.safety.refs[0].ID: map[string]interface{}{
+					"reportData":      l.safety.refs[0],
+					"type":            l.safety.dataType,
+					"reportTimestamp": l.safety.at,
+				},
+			},
+		}
+		queueFirestoreWrite(ctx, FirestoreWriteV1{ref: l.video.ref, data: toSafety, opts: []firestore.SetOption{firestore.MergeAll}})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// hard events and video events of a vehicle within VIDEO_LINK_WINDOW link up, whichever arrives first
+func TestVideoLinks(t *testing.T) {
+	defer func(d time.Duration) { videoLinkWindow = d }(videoLinkWindow)
+	videoLinkWindow = 30 * time.Second
+	c := testOfflineFirestoreClient(t)
+	tracker := VideoLinkTracker{}
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	reports := c.Collection("account").Doc("1001").Collection("vehicle").Doc("2002").Collection("report_data")
+	video := func(id string, eventAt time.Time) linkVideoEvent {
+		return linkVideoEvent{ref: videoEventReference(c, "1001", "2002", id), eventType: []string{"TRANSPONDER_STOPPED"}, at: eventAt, seen: at}
+	}
+	safety := func(id string, eventAt time.Time) linkSafetyEvent {
+		return linkSafetyEvent{refs: []*firestore.DocumentRef{reports.Doc(id)}, dataType: "hard_braking", at: eventAt, seen: at}
+	}
+
+	// video first, then the hard event a few seconds earlier
+	if links := tracker.observeVideo("1001/2002", video("4ad20507", at)); len(links) != 0 {
+		t.Errorf("video with no hard events linked %d", len(links))
+	}
+	links := tracker.observeSafety("1001/2002", safety("brake1", at.Add(-5*time.Second)))
+	if len(links) != 1 || links[0].video.ref.ID != "4ad20507" || links[0].safety.refs[0].ID != "brake1" {
+		t.Fatalf("hard event links = %+v, want 4ad20507<->brake1", links)
+	}
+
+	// hard event first, then the video; events outside the window or of other vehicles don't link
+	tracker.observeSafety("1001/2002", safety("brake2", at.Add(10*time.Minute)))
+	tracker.observeSafety("1001/3003", safety("brake3", at.Add(10*time.Minute)))
+	links = tracker.observeVideo("1001/2002", video("5be31618", at.Add(10*time.Minute+20*time.Second)))
+	if len(links) != 1 || links[0].safety.refs[0].ID != "brake2" {
+		t.Errorf("video links = %+v, want only brake2", links)
+	}
+
+	// video events are reported again as their footage uploads, links aren't repeated
+	if links := tracker.observeVideo("1001/2002", video("4ad20507", at)); len(links) != 0 {
+		t.Errorf("repeated video report linked %d again", len(links))
+	}
+}
+
+// events that never find their other side are forgotten
+func TestVideoLinksPrune(t *testing.T) {
+	defer func(d time.Duration) { videoLinkWindow = d }(videoLinkWindow)
+	videoLinkWindow = 30 * time.Second
+	c := testOfflineFirestoreClient(t)
+	tracker := VideoLinkTracker{}
+	at := time.Date(2021, 2, 20, 22, 0, 0, 0, time.UTC)
+	tracker.observeVideo("1001/2002", linkVideoEvent{ref: videoEventReference(c, "1001", "2002", "4ad20507"), at: at, seen: at})
+
+	later := at.Add(videoLinkMemory + time.Minute)
+	s := linkSafetyEvent{refs: []*firestore.DocumentRef{c.Collection("report_data").Doc("brake1")}, dataType: "hard_braking", at: at, seen: later}
+	if links := tracker.observeSafety("1001/2002", s); len(links) != 0 {
+		t.Errorf("hard event linked to a video event past videoLinkMemory")
+	}
+	if len(tracker.videos["1001/2002"]) != 0 {
+		t.Errorf("%d video events kept past videoLinkMemory", len(tracker.videos["1001/2002"]))
+	}
+
+	// a vehicle that stopped reporting is forgotten when another vehicle reports
+	tracker.observeSafety("1001/3003", linkSafetyEvent{refs: s.refs, dataType: "hard_braking", at: later, seen: later})
+	tracker.observeVideo("1001/2002", linkVideoEvent{ref: videoEventReference(c, "1001", "2002", "5be31618"), at: later, seen: later.Add(videoLinkMemory + time.Minute)})
+	if _, ok := tracker.safety["1001/3003"]; ok {
+		t.Errorf("idle vehicle's hard events kept past videoLinkMemory")
+	}
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	gabs "github.com/Jeffail/gabs/v2"
+
 	"cloud.google.com/go/firestore"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/genproto/googleapis/type/latlng"
 )
 
-// UNFINISHED!! https://track.carmasys.com:8343/browse/FIRE-2
-
 func videoReportWriterV1(ctx context.Context, c *firestore.Client) {
 	for {
 		select {
@@ -19,10 +20,11 @@ func videoReportWriterV1(ctx context.Context, c *firestore.Client) {
 		case rds := <-videoReportsV1:
 			log.Debugf("videoReportWriterV1() received new report: %s:%s to process into Firestore...\n", rds.reportType, rds.reportDataType)
 			// validate and populate our report struct
-			// ok := rds.build() ...
-
-			// build firestore reference
-			ref := rds.firestoreReference(c)
+			ok := rds.build()
+			if !ok {
+				log.Warnf("Unable to validate and build a VideoReportDataStreamV1 object sent from upstream channel videoReportsV1\n")
+				break // unable to validate the packet, drop it and move on
+			}
 
 			// marshall our video data streaming record into a firestore status record
 			record, err := rds.firestoreRecord()
@@ -31,31 +33,87 @@ func videoReportWriterV1(ctx context.Context, c *firestore.Client) {
 				break
 			}
 
-			// check result
-			result, err := ref.NewDoc().Set(ctx, record)
-			if err != nil {
-				log.Errorf("Firestore write error :%v", err)
-			} else {
-				log.Debugf("Firestore write result: %v", result)
+			// the apps can't read footage buckets, hand them signed URLs
+			signFootage(record.Footage, ``, now())
+
+			// updates for the same video event merge into one document
+			if validFirestoreDocumentId(record.VideoEventId) {
+				writeVideoEvent(ctx, c, &rds, record)
+				// link the video to hard events the vehicle reported around it
+				video := linkVideoEvent{
+					ref:       videoEventReference(c, rds.cwAccountId, rds.cwDeviceWebId, record.VideoEventId),
+					eventType: record.EventType,
+					at:        record.EventTimestamp,
+					seen:      now(),
+				}
+				writeVideoLinks(ctx, videoLinks.observeVideo(rds.cwAccountId+"/"+rds.cwDeviceWebId, video))
+				break
 			}
+			// hand off to the Firestore sink to be batched
+			log.Warnf("Video report without a usable videoEventId (%q), writing it to a document of its own", record.VideoEventId)
+			queueFirestoreWrite(ctx, FirestoreWriteV1{ref: rds.firestoreReference(c).NewDoc(), data: record})
 			// wait for more
 		}
 	}
 }
 
-// Methods on *VideorReportDataStreamV1
+// Methods on *VideoReportDataStreamV1
 // These methods are intentionally left unversioned for now.
 
 // create a firestore reference location on a V1 video report
-// /account/{id}/vehicle/{cwWebId}/video_event/{UUID}
+// /account/{id}/vehicle/{cwWebId}/video_event/{videoEventId}
 func (r *VideoReportDataStreamV1) firestoreReference(c *firestore.Client) *firestore.CollectionRef {
 	ref := c.Collection("account").Doc(r.cwAccountId).Collection("vehicle").Doc(r.cwDeviceWebId).Collection("video_event")
 	return ref
 }
 
+// validate/populate all items needed for an actionable VideoReportDataStreamV1 type
+func (r *VideoReportDataStreamV1) build() (ok bool) {
+	// video reports require an accountId and the transponderId the footage came from
+	clApiAcctIdf, aIdOk := r.json.Path("accountId").Data().(float64)
+	transponderIdf, tIdOk := r.transponderId()
+	if !aIdOk || !tIdOk {
+		log.Warnf("VideoReportDataStreamV1.build(): report doesn't contain required value(s): accountId:%t, videoEventMetadata.transponderId:%t\n", aIdOk, tIdOk)
+		return false
+	}
+	transponderId := fmt.Sprintf("%.0f", transponderIdf)
+	clApiAcctId := fmt.Sprintf("%.0f", clApiAcctIdf)
+	// get our clapi ids <-> cartwheel ids out of global map
+	return r.cartwheelMap(transponderId, clApiAcctId)
+}
+
+// fetch / insert cartwheel ids from in-memory map into our record
+func (r *VideoReportDataStreamV1) cartwheelMap(t string, a string) (ok bool) {
+	navajoReferenceIds.mutex.Lock()
+	defer navajoReferenceIds.mutex.Unlock()
+	// check global struct NavajoReferenceIds for matches
+	cwAccountId, acctOk := navajoReferenceIds.clAccountIdMap[a]
+	if !acctOk {
+		log.Warnf("getCartwheelIds() unable to find match for CL API AccountId (%v) : Navajo Account Id\n", a)
+		return false
+	}
+	cwDeviceId, deviceOk := navajoReferenceIds.clDeviceIdMap[t]
+	if !deviceOk {
+		log.Warnf("getCartwheelIds() unable to find match for CL API TransponderId (%v) : Navajo Device Id\n", t)
+		return false
+	}
+	r.cwAccountId = cwAccountId
+	r.cwDeviceWebId = cwDeviceId
+	return true
+}
+
+// video events sit under the packet's data object, fall back to the top level
+// for packets that send the event unwrapped
+func (r *VideoReportDataStreamV1) field(path string) *gabs.Container {
+	if f := r.json.Path("data." + path); f.Data() != nil {
+		return f
+	}
+	return r.json.Path(path)
+}
+
 // parse a streaming report JSON packet for videoEventId
 func (r *VideoReportDataStreamV1) videoEventId() (string, bool) {
-	videoEventId, ok := r.json.Path("videoEventId").Data().(string)
+	videoEventId, ok := r.field("videoEventId").Data().(string)
 	if ok {
 		return videoEventId, true
 	} else {
@@ -65,7 +123,7 @@ func (r *VideoReportDataStreamV1) videoEventId() (string, bool) {
 
 // parse a streaming report JSON packet for terminalNumber
 func (r *VideoReportDataStreamV1) terminalNumber() (string, bool) {
-	terminalNumber, ok := r.json.Path("videoEventMetadata.terminalNumber").Data().(string)
+	terminalNumber, ok := r.field("videoEventMetadata.terminalNumber").Data().(string)
 	if ok {
 		return terminalNumber, true
 	} else {
@@ -75,7 +133,7 @@ func (r *VideoReportDataStreamV1) terminalNumber() (string, bool) {
 
 // parse a streaming report JSON packet for transponderId
 func (r *VideoReportDataStreamV1) transponderId() (float64, bool) {
-	transponderId, ok := r.json.Path("videoEventMetadata.transponderid").Data().(float64)
+	transponderId, ok := r.field("videoEventMetadata.transponderId").Data().(float64)
 	if ok {
 		return transponderId, true
 	} else {
@@ -85,7 +143,7 @@ func (r *VideoReportDataStreamV1) transponderId() (float64, bool) {
 
 // parse a streaming report JSON packet for eventTimestamp
 func (r *VideoReportDataStreamV1) eventTimestamp() (time.Time, bool) {
-	eventTimestamp, ok := r.json.Path("videoEventMetadata.eventTimestamp").Data().(float64)
+	eventTimestamp, ok := r.field("videoEventMetadata.eventTimestamp").Data().(float64)
 	if ok {
 		// there's a float64 there as UTC epoch time. convert to time.Time
 		es, _ := nanoEpochTimeObject(eventTimestamp)
@@ -97,7 +155,7 @@ func (r *VideoReportDataStreamV1) eventTimestamp() (time.Time, bool) {
 
 // parse a streaming report JSON packet for driver's username
 func (r *VideoReportDataStreamV1) username() (string, bool) {
-	username, ok := r.json.Path("videoEventMetadata.username").Data().(string)
+	username, ok := r.field("videoEventMetadata.username").Data().(string)
 	if ok {
 		return username, true
 	} else {
@@ -107,7 +165,7 @@ func (r *VideoReportDataStreamV1) username() (string, bool) {
 
 // parse a streaming report JSON packet for eventType
 func (r *VideoReportDataStreamV1) eventType() (et []string, ok bool) {
-	for _, a := range r.json.Path("videoEventMetadata.eventType").Children() {
+	for _, a := range r.field("videoEventMetadata.eventType").Children() {
 		if IsNilInterface(a) {
 			log.Debugf("NIL INTERFACE DETECTED LOL: VideoReportDataStreamV1.eventType(): %v", r.json.String())
 			return et, false
@@ -123,8 +181,8 @@ func (r *VideoReportDataStreamV1) reportGeoObj() (g *latlng.LatLng, ok bool) {
 	// pull both lat & long from ingested json, convert into GeoPoint *obj
 	lat := "videoEventMetadata.kinematics.location.latitude"
 	lon := "videoEventMetadata.kinematics.location.longitude"
-	locationLatitude, latOk := r.json.Path(lat).Data().(float64)
-	locationLongitude, longOk := r.json.Path(lon).Data().(float64)
+	locationLatitude, latOk := r.field(lat).Data().(float64)
+	locationLongitude, longOk := r.field(lon).Data().(float64)
 	if latOk && longOk {
 		geoPoint := &latlng.LatLng{
 			Latitude:  locationLatitude,
@@ -141,7 +199,7 @@ func (r *VideoReportDataStreamV1) reportGeoObj() (g *latlng.LatLng, ok bool) {
 // parse streaming report JSON packet for location accuracy key
 func (r *VideoReportDataStreamV1) locationAccuracy() (rla float64, ok bool) {
 	accuracy := "videoEventMetadata.kinematics.location.accuracy"
-	locationAccuracy, ok := r.json.Path(accuracy).Data().(float64)
+	locationAccuracy, ok := r.field(accuracy).Data().(float64)
 	if ok {
 		rla = locationAccuracy
 		return rla, true
@@ -153,7 +211,7 @@ func (r *VideoReportDataStreamV1) locationAccuracy() (rla float64, ok bool) {
 // parse streaming report JSON packet for speed
 func (r *VideoReportDataStreamV1) speed() (sp float64, ok bool) {
 	speed := "videoEventMetadata.kinematics.speed"
-	paramsSpeed, ok := r.json.Path(speed).Data().(float64)
+	paramsSpeed, ok := r.field(speed).Data().(float64)
 	if ok {
 		sp = paramsSpeed
 		return sp, true
@@ -165,7 +223,7 @@ func (r *VideoReportDataStreamV1) speed() (sp float64, ok bool) {
 // parse streaming report JSON packet for location heading
 func (r *VideoReportDataStreamV1) locationHeading() (rlh float64, ok bool) {
 	heading := "videoEventMetadata.kinematics.heading"
-	locationHeading, ok := r.json.Path(heading).Data().(float64)
+	locationHeading, ok := r.field(heading).Data().(float64)
 	if ok {
 		rlh = locationHeading
 		return rlh, true
@@ -177,99 +235,180 @@ func (r *VideoReportDataStreamV1) locationHeading() (rlh float64, ok bool) {
 // footageId from a single footage event from within a VideoReportDataStreamV1 object
 // this is called by a higher-level function that iterates over []footage objects
 func (r *VideoReportDataV1) footageId() (id string, ok bool) {
-	username, ok := r.json.Path("footageId").Data().(string)
-	if ok {
-		return username, true
-	} else {
-		return ``, false
+	id, ok = r.json.Path("footageId").Data().(string)
+	return id, ok
+}
+
+// camera the footage was recorded on, "0" for the first camera
+func (r *VideoReportDataV1) garminCameraName() (name string, ok bool) {
+	name, ok = r.json.Path("footageMetadata.garminCameraName").Data().(string)
+	return name, ok
+}
+
+// file name of the footage on the camera
+func (r *VideoReportDataV1) garminFootageFilename() (name string, ok bool) {
+	name, ok = r.json.Path("footageMetadata.garminFootageFileName").Data().(string)
+	return name, ok
+}
+
+// whether the footage is a preview of a longer recording
+func (r *VideoReportDataV1) preview() (preview bool, ok bool) {
+	preview, ok = r.json.Path("footageMetadata.isPreview").Data().(bool)
+	return preview, ok
+}
+
+// time the footage was recorded, sent as UTC epoch millis
+func (r *VideoReportDataV1) footageTimestamp() (time.Time, bool) {
+	ts, ok := r.json.Path("footageMetadata.timestamp").Data().(float64)
+	if !ok {
+		return time.Time{}, false
 	}
+	ft, _ := nanoEpochTimeObject(ts)
+	return ft, true
+}
+
+// length of the footage, 0 for snapshots
+func (r *VideoReportDataV1) footageDuration() (duration float64, ok bool) {
+	duration, ok = r.json.Path("footageMetadata.duration").Data().(float64)
+	return duration, ok
+}
+
+// whether the footage has an audio track
+func (r *VideoReportDataV1) footageAudioIncluded() (audio bool, ok bool) {
+	audio, ok = r.json.Path("footageMetadata.isAudioIncluded").Data().(bool)
+	return audio, ok
+}
+
+// size of the footage file in bytes
+func (r *VideoReportDataV1) size() (size float64, ok bool) {
+	size, ok = r.json.Path("footageMetadata.size").Data().(float64)
+	return size, ok
+}
+
+// base64 md5 of the footage file, as Cloud Storage reports it
+func (r *VideoReportDataV1) md5() (md5 string, ok bool) {
+	md5, ok = r.json.Path("footageMetadata.md5").Data().(string)
+	return md5, ok
+}
+
+// base64 crc32c of the footage file, as Cloud Storage reports it
+func (r *VideoReportDataV1) crc32c() (crc32c string, ok bool) {
+	crc32c, ok = r.json.Path("footageMetadata.crc32c").Data().(string)
+	return crc32c, ok
+}
+
+// MIME type of the footage file
+func (r *VideoReportDataV1) contentType() (contentType string, ok bool) {
+	contentType, ok = r.json.Path("footageMetadata.contentType").Data().(string)
+	return contentType, ok
+}
+
+// gs:// path of the uploaded footage
+func (r *VideoReportDataV1) footagePath() (path string, ok bool) {
+	path, ok = r.json.Path("privateFilePath").Data().(string)
+	return path, ok
+}
+
+// upload status of the footage, COMPLETED once it's all in Cloud Storage
+func (r *VideoReportDataV1) uploadStatus() (status string, ok bool) {
+	status, ok = r.json.Path("uploadState.status").Data().(string)
+	return status, ok
+}
+
+// time the footage upload started, sent as UTC epoch millis
+func (r *VideoReportDataV1) uploadStartTimestamp() (time.Time, bool) {
+	ts, ok := r.json.Path("uploadState.startTimestamp").Data().(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	st, _ := nanoEpochTimeObject(ts)
+	return st, true
+}
+
+// time the last chunk of the footage upload was received, sent as UTC epoch millis
+func (r *VideoReportDataV1) lastChunkRxTimestamp() (time.Time, bool) {
+	ts, ok := r.json.Path("uploadState.lastChunkRxTimestamp").Data().(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	lt, _ := nanoEpochTimeObject(ts)
+	return lt, true
+}
+
+// bytes of the footage still to be uploaded
+func (r *VideoReportDataV1) bytesRemaining() (remaining float64, ok bool) {
+	remaining, ok = r.json.Path("uploadState.bytesRemaining").Data().(float64)
+	return remaining, ok
+}
+
+// why the upload is in its current status
+func (r *VideoReportDataV1) uploadStatusReason() (reason string, ok bool) {
+	reason, ok = r.json.Path("uploadState.reason").Data().(string)
+	return reason, ok
 }
 
 // footage can be an array (ew) of objects if there's more than one camera
 func (vr *VideoReportDataStreamV1) footage() (footage []VideoReportFootageV1, ok bool) {
 	data := VideoReportDataV1{}
-	for _, data.json = range vr.json.Path("footage").Children() {
+	for _, data.json = range vr.field("footage").Children() {
 		entry := VideoReportFootageV1{} // init our footage entry struct
 		// begin identifying available data and packing it into entry
-		footageId, ok := data.footageId()
-		if ok {
+		if footageId, ok := data.footageId(); ok {
 			entry.FootageId = footageId
 		}
-
-		// all populated, append to our array before moving on to next footage entry
-		footage = append(footage, entry)
-	}
-	/*
-		footageId, ok := vr.footageId()
-		if ok {
-			fbRecord.FootageId = footageId
-		}
-		garminCamName, ok := vr.garminCameraName()
-		if ok {
-			fbRecord.GarminCameraName = garminCamName
+		if garminCamName, ok := data.garminCameraName(); ok {
+			entry.GarminCameraName = garminCamName
 		}
-		garminFootageFile, ok := vr.garminFootageFilename()
-		if ok {
-			fbRecord.GarminFootageFilename = garminFootageFile
+		if garminFootageFile, ok := data.garminFootageFilename(); ok {
+			entry.GarminFootageFilename = garminFootageFile
 		}
-		preview, ok := vr.preview()
-		if ok {
-			fbRecord.Preview = preview
+		if preview, ok := data.preview(); ok {
+			entry.Preview = preview
 		}
-		footageTs, ok := vr.footageTimestamp()
-		if ok {
-			fbRecord.FootageTimestamp = footageTs
+		if footageTs, ok := data.footageTimestamp(); ok {
+			entry.FootageTimestamp = footageTs
 		}
-		footageDur, ok := vr.footageDuration()
-		if ok {
-			fbRecord.FootageDuration = footageDur
+		if footageDur, ok := data.footageDuration(); ok {
+			entry.FootageDuration = footageDur
 		}
-		footageAudioInc, ok := vr.footageAudioInc()
-		if ok {
-			fbRecord.FootageAudioIncluded = footageAudioInc
+		if footageAudioInc, ok := data.footageAudioIncluded(); ok {
+			entry.FootageAudioIncluded = footageAudioInc
 		}
-		size, ok := vr.size()
-		if ok {
-			fbRecord.Size = size
+		if size, ok := data.size(); ok {
+			entry.Size = size
 		}
-		md5, ok := vr.md5()
-		if ok {
-			fbRecord.Md5 = md5
+		if md5, ok := data.md5(); ok {
+			entry.Md5 = md5
 		}
-		crc32c, ok := vr.crc32c()
-		if ok {
-			fbRecord.Crc32c = crc32c
+		if crc32c, ok := data.crc32c(); ok {
+			entry.Crc32c = crc32c
 		}
-		contentType, ok := vr.contentType()
-		if ok {
-			fbRecord.ContentType = contentType
+		if contentType, ok := data.contentType(); ok {
+			entry.ContentType = contentType
 		}
-		footagePath, ok := vr.footagePath()
-		if ok {
-			fbRecord.FootagePath = footagePath
+		if footagePath, ok := data.footagePath(); ok {
+			entry.FootagePath = footagePath
 		}
-		uploadStatus, ok := vr.uploadStatus()
-		if ok {
-			fbRecord.UploadStatus = uploadStatus
+		if uploadStatus, ok := data.uploadStatus(); ok {
+			entry.UploadStatus = uploadStatus
 		}
-		uploadStartTs, ok := vr.uploadStartTimestamp()
-		if ok {
-			fbRecord.UploadStartTime = uploadStartTs
+		if uploadStartTs, ok := data.uploadStartTimestamp(); ok {
+			entry.UploadStartTime = uploadStartTs
 		}
-		lastChunkRx, ok := vr.lastChunkRxTimestamp()
-		if ok {
-			fbRecord.LastChunkRxTime = lastChunkRx
+		if lastChunkRx, ok := data.lastChunkRxTimestamp(); ok {
+			entry.LastChunkRxTime = lastChunkRx
 		}
-		bytesRemaining, ok := vr.bytesRemaining()
-		if ok {
-			fbRecord.BytesRemaining = bytesRemaining
+		if bytesRemaining, ok := data.bytesRemaining(); ok {
+			entry.BytesRemaining = bytesRemaining
 		}
-		uploadStatusReason, ok := vr.uploadStatusReason()
-		if ok {
-			fbRecord.UploadStatusReason = uploadStatusReason
+		if uploadStatusReason, ok := data.uploadStatusReason(); ok {
+			entry.UploadStatusReason = uploadStatusReason
 		}
-	*/
-	return footage, ok
+
+		// all populated, append to our array before moving on to next footage entry
+		footage = append(footage, entry)
+	}
+	return footage, len(footage) > 0
 }
 
 func (vr *VideoReportDataStreamV1) firestoreRecord() (fbRecord FirestoreVideoReportV1, err error) {
@@ -301,6 +440,7 @@ func (vr *VideoReportDataStreamV1) firestoreRecord() (fbRecord FirestoreVideoRep
 	location, ok := vr.reportGeoObj()
 	if ok {
 		fbRecord.Location = location
+		fbRecord.Geohash = geohashes(location)
 	}
 	locationAcc, ok := vr.locationAccuracy()
 	if ok {
@@ -319,6 +459,8 @@ func (vr *VideoReportDataStreamV1) firestoreRecord() (fbRecord FirestoreVideoRep
 	if ok {
 		fbRecord.Footage = footageEntries
 	}
+	fbRecord.Type = vr.reportDataType
+	fbRecord.SchemaVersion = schemaVersionV1
 
 	return fbRecord, nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	gabs "github.com/Jeffail/gabs/v2"
+)
+
+// the README's VIDEO_EVENT sample, wrapped the way REPORT_DATA packets arrive (the wrapper is assumed)
+const videoTestPacket = `{"type":"VIDEO_EVENT","dataType":"video_upload","accountId":12,"data":{
+	"videoEventId": "4ad20507",
+	"videoEventMetadata": {
+		"terminalNumber": "1.2738.3955638690",
+		"transponderId": 519521,
+		"username": "chris",
+		"eventTimestamp": 1613858373956,
+		"eventType": ["TRANSPONDER_STOPPED"],
+		"kinematics": {
+			"location": {"latitude": 42.6266232, "longitude": -73.8748708, "accuracy": 9.0460005},
+			"speed": 0.0,
+			"heading": 86.74167
+		}
+	},
+	"footage": [{
+		"footageId": "b042ff1af6c6ac40a5a125de5885cfc9",
+		"footageMetadata": {
+			"garminCameraName": "0",
+			"garminFootageFileName": "snapshot-0-1613858375080",
+			"isPreview": false,
+			"timestamp": 1613858375080,
+			"duration": 0,
+			"isAudioIncluded": false,
+			"size": 88206,
+			"md5": "sEL/GvbGrECloSXeWIXPyQ==",
+			"crc32c": "l1HupQ==",
+			"contentType": "image/jpeg"
+		},
+		"privateFilePath": "gs://dev-carmalinkapi-dashcamfootage/b042ff1af6c6ac40a5a125de5885cfc9/snapshot-0-1613858375080",
+		"uploadState": {
+			"status": "COMPLETED",
+			"startTimestamp": 1613858377070,
+			"lastChunkRxTimestamp": 1613858377568,
+			"bytesRemaining": 0,
+			"reason": "Success"
+		}
+	}]
+}}`
+
+func testVideoReport(t *testing.T, packet string) VideoReportDataStreamV1 {
+	json, err := gabs.ParseJSON([]byte(packet))
+	if err != nil {
+		t.Fatalf("unable to parse test packet: %v", err)
+	}
+	rds := ReportDataStreamV1{json: json}
+	rds.reportType, _ = json.Path("type").Data().(string)
+	rds.reportDataType, _ = json.Path("dataType").Data().(string)
+	return rds.videoReportDataStreamV1()
+}
+
+// video reports are routed by their videoEventId whatever type they're tagged with
+func TestVideoReportPacket(t *testing.T) {
+	tests := []struct {
+		packet string
+		want   bool
+	}{
+		{packet: videoTestPacket, want: true},
+		{packet: `{"type":"VIDEO","dataType":"video_upload","data":{"videoEventId":"4ad20507"}}`, want: true},
+		{packet: `{"type":"video_upload","dataType":"video_upload","data":{}}`, want: true},
+		{packet: `{"type":"NOTIFICATION","dataType":"video_upload","videoEventId":"4ad20507"}`, want: true},
+		{packet: `{"type":"NOTIFICATION","dataType":"geofence","data":{"serial":519372}}`, want: false},
+	}
+	for _, tc := range tests {
+		json, err := gabs.ParseJSON([]byte(tc.packet))
+		if err != nil {
+			t.Fatalf("unable to parse test packet: %v", err)
+		}
+		rds := ReportDataStreamV1{json: json}
+		rds.reportType, _ = json.Path("type").Data().(string)
+		if got := videoReportPacket(rds); got != tc.want {
+			t.Errorf("videoReportPacket(%.40s) = %t, want: %t", tc.packet, got, tc.want)
+		}
+	}
+}
+
+// video reports map their account and transponder to Cartwheel ids, and are dropped when either is unknown
+func TestVideoBuild(t *testing.T) {
+	testNavajoReferenceIds(t, map[string]string{"12": "1001"}, map[string]string{"519521": "2002"})
+
+	r := testVideoReport(t, videoTestPacket)
+	if !r.build() || r.cwAccountId != "1001" || r.cwDeviceWebId != "2002" {
+		t.Errorf("build() = account:%s webId:%s, want 1001/2002", r.cwAccountId, r.cwDeviceWebId)
+	}
+	unknown := testVideoReport(t, `{"type":"VIDEO_EVENT","accountId":12,"data":{"videoEventId":"x","videoEventMetadata":{"transponderId":1}}}`)
+	if unknown.build() {
+		t.Errorf("build() of a video report from an unknown transponder succeeded")
+	}
+	missing := testVideoReport(t, `{"type":"VIDEO_EVENT","accountId":12,"data":{"videoEventId":"x"}}`)
+	if missing.build() {
+		t.Errorf("build() of a video report without a transponderId succeeded")
+	}
+}
+
+// every event and footage field of the README sample lands in the Firestore record
+func TestVideoFirestoreRecord(t *testing.T) {
+	r := testVideoReport(t, videoTestPacket)
+	record, err := r.firestoreRecord()
+	if err != nil {
+		t.Fatalf("firestoreRecord() error: %v", err)
+	}
+	ms := func(ms int64) time.Time { return time.Unix(0, ms*int64(time.Millisecond)).UTC() }
+
+	if record.VideoEventId != "4ad20507" || record.TerminalNumber != "1.2738.3955638690" || record.TransponderId != 519521 ||
+		record.Username != "chris" || !record.EventTimestamp.Equal(ms(1613858373956)) || record.Type != "video_upload" {
+		t.Errorf("event fields = %+v", record)
+	}
+	if len(record.EventType) != 1 || record.EventType[0] != "TRANSPONDER_STOPPED" {
+		t.Errorf("EventType = %v", record.EventType)
+	}
+	if record.Location == nil || record.Location.Latitude != 42.6266232 || record.Location.Longitude != -73.8748708 ||
+		record.Geohash == nil || record.LocationAccuracy != 9.0460005 || record.Heading != 86.74167 {
+		t.Errorf("kinematics = location:%v geohash:%v accuracy:%v heading:%v", record.Location, record.Geohash, record.LocationAccuracy, record.Heading)
+	}
+	if len(record.Footage) != 1 {
+		t.Fatalf("Footage has %d entries, want 1", len(record.Footage))
+	}
+	want := VideoReportFootageV1{
+		FootageId:             "b042ff1af6c6ac40a5a125de5885cfc9",
+		GarminCameraName:      "0",
+		GarminFootageFilename: "snapshot-0-1613858375080",
+		FootageTimestamp:      ms(1613858375080),
+		Size:                  88206,
+		Md5:                   "sEL/GvbGrECloSXeWIXPyQ==",
+		Crc32c:                "l1HupQ==",
+		ContentType:           "image/jpeg",
+		FootagePath:           "gs://dev-carmalinkapi-dashcamfootage/b042ff1af6c6ac40a5a125de5885cfc9/snapshot-0-1613858375080",
+		UploadStatus:          "COMPLETED",
+		UploadStartTime:       ms(1613858377070),
+		LastChunkRxTime:       ms(1613858377568),
+		UploadStatusReason:    "Success",
+	}
+	if got := record.Footage[0]; got != want {
+		t.Errorf("Footage[0] =\n%+v\nwant\n%+v", got, want)
+	}
+}